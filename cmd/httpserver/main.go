@@ -1,19 +1,27 @@
 package main
 
 import (
-	"crypto/sha256"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
-
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/cache"
+	"github.com/nhdewitt/http-from-tcp/internal/cgi"
+	"github.com/nhdewitt/http-from-tcp/internal/fileserver"
+	"github.com/nhdewitt/http-from-tcp/internal/metrics"
+	"github.com/nhdewitt/http-from-tcp/internal/middleware"
+	"github.com/nhdewitt/http-from-tcp/internal/proxy"
 	"github.com/nhdewitt/http-from-tcp/internal/request"
 	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/router"
 	"github.com/nhdewitt/http-from-tcp/internal/server"
+	"github.com/nhdewitt/http-from-tcp/internal/sse"
+	"github.com/nhdewitt/http-from-tcp/internal/websocket"
 )
 
 type htmlTemplate struct {
@@ -23,31 +31,50 @@ type htmlTemplate struct {
 }
 
 const (
-	buffer   = 1024
-	port     = 42069
-	upstream = "https://httpbin.org/"
+	port            = 42069
+	upstream        = "https://httpbin.org/"
+	upstreamTimeout = 30 * time.Second
+	metricsPath     = "/metrics"
+	assetsDir       = "assets"
 )
 
-func Handler(w *response.Writer, req *request.Request) {
-	var statusCode response.StatusCode
-	target := req.RequestLine.RequestTarget
-	if strings.HasPrefix(target, "/httpbin") {
-		proxy(target, w)
-		return
-	} else if strings.HasPrefix(target, "/video") {
-		serveVideo(w)
-		return
+func newRouter(reg *metrics.Registry, m *metrics.ServerMetrics, assets fs.FS) *router.Router {
+	httpbin, err := proxy.New(upstream)
+	if err != nil {
+		log.Fatalf("Error configuring proxy: %v", err)
 	}
-	switch target {
-	case "/yourproblem":
-		statusCode = 400
-	case "/myproblem":
-		statusCode = 500
-	default:
-		statusCode = 200
+	httpbin.Rewrite = proxy.StripPrefix("/httpbin")
+	httpbin.Timeout = upstreamTimeout
+	httpbin.OnUpstream = m.ObserveUpstream
+
+	r := router.New()
+	r.Get(metricsPath, reg.Handler())
+	r.Handle("", "/httpbin/{path...}", cache.New(nil).Middleware()(httpbin.Serve))
+	if assets != nil {
+		r.Get("/video", serveVideo(assets))
+		r.Get("/assets/{path...}", fileserver.New(assets, fileserver.Options{Prefix: "/assets/"}))
 	}
-	err := w.WriteStatusLine(statusCode)
-	if err != nil {
+	if scripts := cgiScripts(); scripts != nil {
+		scripts.LocalRedirect = r.Serve
+		r.Handle("", "/cgi-bin/{path...}", scripts.Serve)
+	}
+	r.Get("/ws/echo", serveEcho)
+	r.Get("/sse/clock", serveClock)
+	etag := middleware.ETag()
+	r.Get("/yourproblem", etag(servePage(response.StatusBadRequest)))
+	r.Get("/myproblem", etag(servePage(response.StatusInternalServerError)))
+	r.Get("/{path...}", etag(servePage(response.StatusOK)))
+	return r
+}
+
+func servePage(statusCode response.StatusCode) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		writePage(w, statusCode)
+	}
+}
+
+func writePage(w *response.Writer, statusCode response.StatusCode) {
+	if err := w.WriteStatusLine(statusCode); err != nil {
 		return
 	}
 
@@ -89,88 +116,109 @@ func Handler(w *response.Writer, req *request.Request) {
 	}
 }
 
-func serveVideo(w *response.Writer) {
-	video, err := os.ReadFile("assets/vim.mp4")
-	if err != nil {
-		return
-	}
-
-	w.WriteStatusLine(200)
-	h := response.GetDefaultHeaders(len(video))
-	h.SetNew("Content-Type", "video/mp4")
-	if err := w.WriteHeaders(h); err != nil {
-		return
-	}
-	if _, err := w.WriteBody(video); err != nil {
-		return
+func serveVideo(assets fs.FS) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		fileserver.ServeFile(w, req, assets, "vim.mp4")
 	}
 }
 
-func proxy(target string, w *response.Writer) {
-	target = strings.TrimPrefix(target, "/httpbin")
-	if !strings.HasPrefix(target, "/") {
-		target = "/" + target
-	}
-	url := upstream + target
-
-	var resp *http.Response
-	resp, err := http.Get(url)
+// serveEcho sends every WebSocket message it receives back to the client.
+func serveEcho(w *response.Writer, req *request.Request) {
+	c, err := websocket.Accept(w, req, websocket.Options{EnableCompression: true})
 	if err != nil {
-		_ = w.WriteStatusLine(502)
 		return
 	}
-	defer resp.Body.Close()
-
-	if err = w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
-		return
+	for {
+		mt, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := c.WriteMessage(mt, data); err != nil {
+			c.Close(websocket.CloseInternalError, "")
+			return
+		}
 	}
+}
 
-	h := response.GetDefaultHeaders(0)
-	h.SetNew("Content-Type", resp.Header.Get("Content-Type"))
-	h.Del("Content-Length")
-	h.SetNew("Transfer-Encoding", "chunked")
-	h.SetNew("Trailer", "X-Content-SHA256, X-Content-Length")
-	if err := w.WriteHeaders(h); err != nil {
+// serveClock streams the time every second until the client goes away.
+func serveClock(w *response.Writer, req *request.Request) {
+	s, err := sse.Start(w, req, sse.Options{})
+	if err != nil {
 		return
 	}
-
-	b := make([]byte, buffer)
-	var bodyBytes []byte
+	defer s.Close()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		n, rerr := resp.Body.Read(b)
-		if n > 0 {
-			if _, err := w.WriteChunkedBody(b[:n]); err != nil {
+		select {
+		case <-s.Done():
+			return
+		case t := <-ticker.C:
+			if err := s.Send(sse.Event{Event: "tick", Data: t.UTC().Format(time.RFC3339)}); err != nil {
 				return
 			}
-			bodyBytes = append(bodyBytes, b[:n]...)
-		}
-		if rerr == io.EOF {
-			break
-		}
-		if rerr != nil {
-			if len(bodyBytes) != 0 {
-				break
-			}
-			return
 		}
 	}
-	h.SetNew("X-Content-Length", fmt.Sprintf("%d", len(bodyBytes)))
-	h.SetNew("X-Content-SHA256", fmt.Sprintf("%x", sha256.Sum256(bodyBytes)))
-	if _, err = w.WriteChunkedBodyDone(h); err != nil {
-		return
+}
+
+// forwardProxy returns the forward proxy if the FORWARD_PROXY environment
+// variable is set. FORWARD_PROXY_AUTH, as user:password, makes it require
+// those credentials.
+func forwardProxy() *proxy.ForwardProxy {
+	if os.Getenv("FORWARD_PROXY") == "" {
+		return nil
+	}
+	fp := &proxy.ForwardProxy{Timeout: upstreamTimeout}
+	if user, password, ok := strings.Cut(os.Getenv("FORWARD_PROXY_AUTH"), ":"); ok {
+		fp.Credentials = map[string]string{user: password}
+	}
+	return fp
+}
+
+// cgiScripts returns a handler running the scripts in the directory named
+// by the CGI_DIR environment variable, if it is set.
+func cgiScripts() *cgi.Handler {
+	dir := os.Getenv("CGI_DIR")
+	if dir == "" {
+		return nil
 	}
+	return &cgi.Handler{Dir: dir, Prefix: "/cgi-bin/", Timeout: upstreamTimeout}
 }
 
 func main() {
-	server, err := server.Serve(port, Handler)
+	accessLog := middleware.NewAccessLogger(os.Stdout, middleware.FormatCombined)
+	reg := metrics.NewRegistry()
+	m := metrics.NewServerMetrics(reg)
+	assets, err := fileserver.Dir(assetsDir)
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		log.Printf("Not serving assets: %v", err)
+	}
+	chain := []server.Middleware{middleware.AccessLog(accessLog), m.Middleware()}
+	if fp := forwardProxy(); fp != nil {
+		// Ahead of Compress, so proxied responses pass through unchanged.
+		chain = append(chain, fp.Middleware())
 	}
-	defer server.Close()
+	chain = append(chain, middleware.Compress(middleware.CompressOptions{}))
+	srv := &server.Server{
+		Addrs:        []string{fmt.Sprintf(":%d", port)},
+		H2C:          true,
+		Handler:      server.Chain(newRouter(reg, m, assets).Serve, chain...),
+		ErrorHandler: m.ErrorHandler(middleware.LogRejected(accessLog, nil)),
+		ConnState:    m.ConnState,
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.ListenAndServe()
+	}()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	select {
+	case err := <-errChan:
+		log.Fatalf("Error starting server: %v", err)
+	case <-sigChan:
+	}
+	srv.Close()
 	log.Println("Server gracefully stopped")
 }
@@ -0,0 +1,527 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+const defaultName = "http-from-tcp"
+
+// heuristicMaxAge caps the freshness lifetime guessed from Last-Modified
+// for responses without explicit freshness.
+const heuristicMaxAge = 24 * time.Hour
+
+// cacheableStatus are the status codes that may be cached without explicit
+// freshness information (RFC 9110 section 15.1).
+var cacheableStatus = map[response.StatusCode]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// conditionalHeaders are stripped from requests sent upstream, so that the
+// cache receives full, storable responses and evaluates the client's
+// preconditions itself.
+var conditionalHeaders = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"}
+
+// unstoredHeaders describe a single connection or message framing and are
+// not stored with an entry.
+var unstoredHeaders = []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "TE", "Upgrade", "Proxy-Authenticate", "Proxy-Connection"}
+
+// DefaultMaxEntryBytes is the largest body a Cache stores when its
+// MaxEntryBytes is 0.
+const DefaultMaxEntryBytes = 8 << 20
+
+// Cache is a shared HTTP cache following RFC 9111. Add it in front of a
+// handler, typically a proxy, with Middleware. Responses are streamed to
+// the client while they are copied for the store.
+type Cache struct {
+	// Name identifies the cache in Cache-Status response headers.
+	Name  string
+	Store Store
+	// MaxEntryBytes limits the body of responses that are stored; larger
+	// ones are passed through only. DefaultMaxEntryBytes if 0.
+	MaxEntryBytes int64
+
+	now   func() time.Time
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// call is an upstream fetch that concurrent misses for the same key wait
+// for instead of fetching too.
+type call struct {
+	done chan struct{}
+}
+
+// New returns a Cache over store, or over a MemoryStore of DefaultMaxBytes
+// if store is nil.
+func New(store Store) *Cache {
+	if store == nil {
+		store = NewMemoryStore(DefaultMaxBytes)
+	}
+	return &Cache{
+		Name:  defaultName,
+		Store: store,
+		now:   time.Now,
+		calls: map[string]*call{},
+	}
+}
+
+// Middleware serves requests from the cache, passing misses to the next
+// handler.
+func (c *Cache) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			c.serve(w, req, next)
+		}
+	}
+}
+
+func (c *Cache) serve(w *response.Writer, req *request.Request, next server.Handler) {
+	key := cacheKey(req)
+	switch req.RequestLine.Method {
+	case "GET", "HEAD":
+	default:
+		c.bypass(w, req, next, "method")
+		// A successful unsafe request invalidates what is stored for
+		// its target (RFC 9111 section 4.4).
+		if code := w.StatusCode(); code >= 200 && code < 400 {
+			c.Store.Delete(key)
+		}
+		return
+	}
+	if req.Headers.Get("Range") != "" {
+		c.bypass(w, req, next, "request")
+		return
+	}
+
+	reqCC := parseCacheControl(req.Headers.Get("Cache-Control"))
+	entry, ok := c.Store.Get(key)
+	fwd := "uri-miss"
+	if ok && !varyMatches(entry, req) {
+		entry, fwd = nil, "vary-miss"
+	}
+	if entry != nil {
+		now := c.now()
+		if c.usable(entry, reqCC, now) {
+			ttl := entry.lifetime() - entry.age(now)
+			c.serveEntry(w, req, entry, now, fmt.Sprintf("hit; ttl=%d", int(ttl.Seconds())))
+			return
+		}
+		fwd = "stale"
+		if _, ok := reqCC["no-cache"]; ok {
+			fwd = "request"
+		}
+	}
+
+	if req.RequestLine.Method == "HEAD" {
+		// A HEAD response has no body to store for later GETs.
+		c.bypass(w, req, next, fwd)
+		return
+	}
+	c.fetch(w, req, next, key, entry, fwd)
+}
+
+// usable reports whether entry may be served without contacting the
+// upstream.
+func (c *Cache) usable(entry *Entry, reqCC map[string]string, now time.Time) bool {
+	cc := parseCacheControl(entry.Headers.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	age := entry.age(now)
+	if v, ok := reqCC["max-age"]; ok {
+		if maxAge, err := strconv.Atoi(v); err == nil && age > time.Duration(maxAge)*time.Second {
+			return false
+		}
+	}
+	return age < entry.lifetime()
+}
+
+// fetch forwards req to next and stores the response if allowed. With a
+// stale entry the request is made conditional so an unchanged response
+// can be refreshed with a 304.
+func (c *Cache) fetch(w *response.Writer, req *request.Request, next server.Handler, key string, stale *Entry, fwd string) {
+	c.mu.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-cl.done
+		if entry, ok := c.Store.Get(key); ok && varyMatches(entry, req) && c.usable(entry, nil, c.now()) {
+			c.serveEntry(w, req, entry, c.now(), "fwd="+fwd+"; collapsed")
+			return
+		}
+		// The response couldn't be shared; fetch our own.
+		c.fetchUpstream(w, req, next, key, stale, fwd)
+		return
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+
+	c.fetchUpstream(w, req, next, key, stale, fwd)
+}
+
+func (c *Cache) fetchUpstream(w *response.Writer, req *request.Request, next server.Handler, key string, stale *Entry, fwd string) {
+	out := req.WithContext(req.Context())
+	out.Headers = maps.Clone(req.Headers)
+	for _, h := range conditionalHeaders {
+		out.Headers.Del(h)
+	}
+	if stale != nil {
+		if etag := stale.Headers.Get("ETag"); etag != "" {
+			out.Headers.SetNew("If-None-Match", etag)
+		}
+		if lm := stale.Headers.Get("Last-Modified"); lm != "" {
+			out.Headers.SetNew("If-Modified-Since", lm)
+		}
+	}
+
+	t := &capture{c: c, w: w, req: req, stale: stale, fwd: fwd, requestTime: c.now(), limit: c.maxEntryBytes()}
+	rw := response.NewTransportWriter(t)
+	next(rw, out)
+	rw.Close()
+
+	if t.replacement != nil {
+		if t.refreshed {
+			c.Store.Set(key, t.replacement)
+		}
+		c.serveEntry(w, req, t.replacement, c.now(), t.status)
+		return
+	}
+	if t.entry != nil && rw.Done() {
+		c.Store.Set(key, t.stored())
+	}
+}
+
+// mayServeStale reports whether stale may stand in for an upstream error,
+// which RFC 9111 section 4.2.4 allows unless the response forbids it.
+func (c *Cache) mayServeStale(stale *Entry) bool {
+	cc := parseCacheControl(stale.Headers.Get("Cache-Control"))
+	for _, d := range []string{"must-revalidate", "proxy-revalidate", "no-cache", "s-maxage"} {
+		if _, ok := cc[d]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// storable returns the entry, still without its body, to store for a
+// response with the given status and headers, or nil if a shared cache may
+// not store it (RFC 9111 section 3).
+func (c *Cache) storable(req *request.Request, code response.StatusCode, rh headers.Headers, requestTime, responseTime time.Time) *Entry {
+	switch code {
+	case response.StatusPartialContent, response.StatusNotModified:
+		return nil
+	}
+	if code < 200 {
+		return nil
+	}
+	reqCC := parseCacheControl(req.Headers.Get("Cache-Control"))
+	cc := parseCacheControl(rh.Get("Cache-Control"))
+	if !cacheableStatus[code] {
+		// Other statuses need explicit permission.
+		_, maxAge := cc["max-age"]
+		_, sMaxAge := cc["s-maxage"]
+		_, public := cc["public"]
+		if !maxAge && !sMaxAge && !public && rh.Get("Expires") == "" {
+			return nil
+		}
+	}
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return nil
+		}
+	}
+	if _, ok := reqCC["no-store"]; ok {
+		return nil
+	}
+	if req.Headers.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, mustRevalidate := cc["must-revalidate"]
+		_, sMaxAge := cc["s-maxage"]
+		if !public && !mustRevalidate && !sMaxAge {
+			return nil
+		}
+	}
+	vary := rh.Get("Vary")
+	if strings.TrimSpace(vary) == "*" {
+		return nil
+	}
+
+	h := maps.Clone(rh)
+	for _, k := range unstoredHeaders {
+		h.Del(k)
+	}
+	entry := &Entry{
+		StatusCode:   code,
+		Headers:      h,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	if entry.lifetime() <= 0 {
+		if _, ok := cc["no-cache"]; !ok {
+			// Nothing would ever be served from it without revalidation
+			// anyway, and there is nothing to revalidate with.
+			if h.Get("ETag") == "" && h.Get("Last-Modified") == "" {
+				return nil
+			}
+		}
+	}
+	for name := range strings.SplitSeq(vary, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if entry.VaryValues == nil {
+				entry.VaryValues = map[string]string{}
+			}
+			entry.VaryValues[strings.ToLower(name)] = req.Headers.Get(name)
+		}
+	}
+	return entry
+}
+
+func (c *Cache) maxEntryBytes() int64 {
+	if c.MaxEntryBytes > 0 {
+		return c.MaxEntryBytes
+	}
+	return DefaultMaxEntryBytes
+}
+
+// capture streams an upstream response to the client while keeping a copy
+// of it to store, as long as it is storable and within the size limit. A
+// 304 revalidating a stale entry, or an error the stale entry may stand in
+// for, is held back so the entry can be served instead.
+type capture struct {
+	c           *Cache
+	w           *response.Writer
+	req         *request.Request
+	stale       *Entry
+	fwd         string
+	requestTime time.Time
+	limit       int64
+
+	// replacement is the entry to send instead of the response, with
+	// status as its Cache-Status; refreshed says it must be stored too.
+	replacement *Entry
+	refreshed   bool
+	status      string
+	// answered is set once preconditions were answered with a 304, so the
+	// body only goes to the entry.
+	answered bool
+	chunked  bool
+	entry    *Entry
+	body     bytes.Buffer
+	trailers headers.Headers
+}
+
+func (t *capture) WriteHead(code response.StatusCode, h headers.Headers) error {
+	now := t.c.now()
+	if t.stale != nil {
+		switch {
+		case code == response.StatusNotModified:
+			refreshed := *t.stale
+			refreshed.Headers = maps.Clone(t.stale.Headers)
+			for k, v := range h {
+				switch k {
+				case "content-length", "content-type", "content-encoding", "content-range":
+					continue
+				}
+				refreshed.Headers.SetNew(k, v)
+			}
+			refreshed.RequestTime, refreshed.ResponseTime = t.requestTime, now
+			t.replacement, t.refreshed, t.status = &refreshed, true, "fwd=stale; fwd-status=304"
+			return nil
+		case code >= 500 && t.c.mayServeStale(t.stale):
+			t.replacement = t.stale
+			t.status = fmt.Sprintf("fwd=stale; fwd-status=%d; detail=stale-on-error", code)
+			return nil
+		}
+	}
+
+	status := fmt.Sprintf("fwd=%s; fwd-status=%d", t.fwd, code)
+	t.entry = t.c.storable(t.req, code, h, t.requestTime, now)
+	if t.entry != nil {
+		// Whether the entry is stored depends on the body, which is yet
+		// to come; only a declared length that fits settles it now.
+		n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		switch {
+		case err == nil && n > t.limit:
+			t.entry = nil
+		case err == nil:
+			status += "; stored"
+		}
+	}
+	h.SetNew("Cache-Status", t.c.Name+"; "+status)
+	t.chunked = strings.Contains(strings.ToLower(h.Get("Transfer-Encoding")), "chunked")
+	if code == response.StatusOK && response.CheckConditional(t.w, t.req, h) {
+		t.answered = true
+		return nil
+	}
+	if err := t.w.WriteStatusLine(code); err != nil {
+		return err
+	}
+	return t.w.WriteHeaders(h)
+}
+
+func (t *capture) WriteBody(p []byte) (int, error) {
+	if t.entry != nil {
+		if int64(t.body.Len()+len(p)) > t.limit {
+			t.entry, t.body = nil, bytes.Buffer{}
+		} else {
+			t.body.Write(p)
+		}
+	}
+	if t.replacement != nil || t.answered {
+		return len(p), nil
+	}
+	return t.w.Write(p)
+}
+
+func (t *capture) WriteEnd(trailers headers.Headers) error {
+	t.trailers = trailers
+	if t.replacement != nil || t.answered || !t.chunked {
+		return nil
+	}
+	_, err := t.w.WriteChunkedBodyDone(trailers)
+	return err
+}
+
+// stored completes the captured entry with the body and any trailers.
+func (t *capture) stored() *Entry {
+	e := t.entry
+	e.Body = bytes.Clone(t.body.Bytes())
+	for k := range t.trailers {
+		if k != "trailer" {
+			e.Headers.SetNew(k, t.trailers.Get(k))
+		}
+	}
+	e.Headers.SetNew("Content-Length", strconv.Itoa(len(e.Body)))
+	return e
+}
+
+func (c *Cache) serveEntry(w *response.Writer, req *request.Request, entry *Entry, now time.Time, status string) {
+	h := maps.Clone(entry.Headers)
+	h.SetNew("Age", strconv.Itoa(int(entry.age(now).Seconds())))
+	h.SetNew("Cache-Status", c.Name+"; "+status)
+	if entry.StatusCode == response.StatusOK && response.CheckConditional(w, req, h) {
+		return
+	}
+	if err := w.WriteStatusLine(entry.StatusCode); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if req.RequestLine.Method == "HEAD" || len(entry.Body) == 0 {
+		return
+	}
+	w.WriteBody(entry.Body)
+}
+
+// bypass sends req to next without involving the cache beyond reporting
+// why in Cache-Status.
+func (c *Cache) bypass(w *response.Writer, req *request.Request, next server.Handler, fwd string) {
+	w.OnHeaders(func(code response.StatusCode, h headers.Headers) {
+		h.SetNew("Cache-Status", fmt.Sprintf("%s; fwd=%s; fwd-status=%d", c.Name, fwd, code))
+	})
+	next(w, req)
+}
+
+// lifetime is the freshness lifetime of the entry (RFC 9111 section 4.2.1).
+func (e *Entry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Headers.Get("Cache-Control"))
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return 0
+			}
+			return time.Duration(n) * time.Second
+		}
+	}
+
+	date := e.date()
+	if exp := e.Headers.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date)
+	}
+	if lm, err := http.ParseTime(e.Headers.Get("Last-Modified")); err == nil && cacheableStatus[e.StatusCode] && date.After(lm) {
+		// The usual heuristic: a tenth of the time since the last change.
+		return min(date.Sub(lm)/10, heuristicMaxAge)
+	}
+	return 0
+}
+
+// age is the current age of the entry (RFC 9111 section 4.2.3).
+func (e *Entry) age(now time.Time) time.Duration {
+	apparent := max(e.ResponseTime.Sub(e.date()), 0)
+	var ageValue time.Duration
+	if n, err := strconv.Atoi(e.Headers.Get("Age")); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparent, corrected) + now.Sub(e.ResponseTime)
+}
+
+func (e *Entry) date() time.Time {
+	if t, err := http.ParseTime(e.Headers.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// varyMatches reports whether req selects entry under the entry's Vary
+// header.
+func varyMatches(entry *Entry, req *request.Request) bool {
+	for name, v := range entry.VaryValues {
+		if normalize(req.Headers.Get(name)) != normalize(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalize(v string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(v, ",", ", ")), " ")
+}
+
+// cacheKey identifies the target of req. GET and HEAD share entries.
+func cacheKey(req *request.Request) string {
+	return req.Headers.Get("Host") + req.RequestLine.RequestTarget
+}
+
+// parseCacheControl parses a Cache-Control value into lowercase directive
+// names and their unquoted arguments.
+func parseCacheControl(v string) map[string]string {
+	cc := map[string]string{}
+	for part := range strings.SplitSeq(v, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+	}
+	return cc
+}
@@ -0,0 +1,419 @@
+package cache
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// origin is a handler standing in for an upstream. It answers with the
+// configured status and headers and counts how often it is called.
+type origin struct {
+	mu      sync.Mutex
+	status  response.StatusCode
+	headers map[string]string
+	body    string
+	calls   atomic.Int64
+	last    *request.Request
+}
+
+func newOrigin(body string, hdrs ...string) *origin {
+	o := &origin{status: response.StatusOK, headers: map[string]string{}, body: body}
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		o.headers[hdrs[i]] = hdrs[i+1]
+	}
+	return o
+}
+
+func (o *origin) serve(w *response.Writer, req *request.Request) {
+	o.calls.Add(1)
+	o.mu.Lock()
+	o.last = req
+	status, body := o.status, o.body
+	h := response.GetDefaultHeaders(len(body))
+	for k, v := range o.headers {
+		h.SetNew(k, v)
+	}
+	o.mu.Unlock()
+
+	if etag := h.Get("ETag"); etag != "" && req.Headers.Get("If-None-Match") == etag {
+		status, body = response.StatusNotModified, ""
+		h.Del("Content-Length")
+	}
+	w.WriteStatusLine(status)
+	w.WriteHeaders(h)
+	if body != "" {
+		w.WriteBody([]byte(body))
+	}
+}
+
+type testCache struct {
+	*Cache
+	now     time.Time
+	handler server.Handler
+}
+
+func newTestCache(t *testing.T, o *origin, store Store) *testCache {
+	t.Helper()
+	tc := &testCache{Cache: New(store), now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	tc.Cache.now = func() time.Time { return tc.now }
+	tc.handler = tc.Middleware()(o.serve)
+	return tc
+}
+
+func (tc *testCache) do(t *testing.T, method, target string, hdrs ...string) (*response.Recorder, string) {
+	t.Helper()
+	raw := method + " " + target + " HTTP/1.1\r\nHost: example.com\r\n" + strings.Join(hdrs, "")
+	if method == "POST" {
+		raw += "Content-Length: 0\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	rec, w := response.NewRecorder()
+	tc.handler(w, req)
+	require.NoError(t, w.Close())
+	return rec, rec.Headers.Get("Cache-Status")
+}
+
+func TestCacheFreshness(t *testing.T) {
+	o := newOrigin("hello", "Cache-Control", "max-age=60", "ETag", `"v1"`)
+	tc := newTestCache(t, o, nil)
+
+	rec, status := tc.do(t, "GET", "/a")
+	assert.Equal(t, "hello", rec.Body.String())
+	assert.Equal(t, "http-from-tcp; fwd=uri-miss; fwd-status=200; stored", status)
+
+	tc.now = tc.now.Add(20 * time.Second)
+	rec, status = tc.do(t, "GET", "/a")
+	assert.Equal(t, "hello", rec.Body.String())
+	assert.Equal(t, "http-from-tcp; hit; ttl=40", status)
+	assert.Equal(t, "20", rec.Headers.Get("Age"))
+	assert.Equal(t, int64(1), o.calls.Load())
+
+	// Test: HEAD is answered from the GET entry
+	rec, status = tc.do(t, "HEAD", "/a")
+	assert.Contains(t, status, "hit")
+	assert.Empty(t, rec.Body.String())
+	assert.Equal(t, "5", rec.Headers.Get("Content-Length"))
+
+	// Test: Client preconditions are evaluated against the entry
+	rec, _ = tc.do(t, "GET", "/a", "If-None-Match: \"v1\"\r\n")
+	assert.Equal(t, response.StatusNotModified, rec.StatusCode)
+	assert.Equal(t, int64(1), o.calls.Load())
+
+	// Test: Stale entries are revalidated with the stored validator
+	tc.now = tc.now.Add(time.Minute)
+	rec, status = tc.do(t, "GET", "/a")
+	assert.Equal(t, "hello", rec.Body.String())
+	assert.Equal(t, "http-from-tcp; fwd=stale; fwd-status=304", status)
+	assert.Equal(t, `"v1"`, o.last.Headers.Get("If-None-Match"))
+	assert.Equal(t, "0", rec.Headers.Get("Age"))
+	rec, status = tc.do(t, "GET", "/a")
+	assert.Contains(t, status, "hit")
+	assert.Equal(t, int64(2), o.calls.Load())
+
+	// Test: Request directives
+	_, status = tc.do(t, "GET", "/a", "Cache-Control: no-cache\r\n")
+	assert.Equal(t, "http-from-tcp; fwd=stale; fwd-status=304", status)
+	tc.now = tc.now.Add(10 * time.Second)
+	_, status = tc.do(t, "GET", "/a", "Cache-Control: max-age=5\r\n")
+	assert.Contains(t, status, "fwd=stale")
+}
+
+func TestCacheLifetime(t *testing.T) {
+	date := "Wed, 01 May 2024 12:00:00 GMT"
+	tests := []struct {
+		name string
+		hdrs []string
+		want time.Duration
+	}{
+		{"max-age", []string{"Cache-Control", "max-age=60"}, time.Minute},
+		{"s-maxage wins", []string{"Cache-Control", "max-age=60, s-maxage=10"}, 10 * time.Second},
+		{"expires", []string{"Date", date, "Expires", "Wed, 01 May 2024 12:05:00 GMT"}, 5 * time.Minute},
+		{"bad expires", []string{"Date", date, "Expires", "0"}, 0},
+		{"heuristic", []string{"Date", date, "Last-Modified", "Wed, 01 May 2024 02:00:00 GMT"}, time.Hour},
+		{"none", nil, 0},
+	}
+	for _, tt := range tests {
+		h := headers.NewHeaders()
+		for i := 0; i+1 < len(tt.hdrs); i += 2 {
+			h.Set(tt.hdrs[i], tt.hdrs[i+1])
+		}
+		e := &Entry{StatusCode: response.StatusOK, Headers: h}
+		assert.Equal(t, tt.want, e.lifetime(), tt.name)
+	}
+
+	// Test: Age accounts for the Age header and the time in transit
+	now := time.Date(2024, 5, 1, 12, 0, 10, 0, time.UTC)
+	h := headers.NewHeaders()
+	h.Set("Date", date)
+	h.Set("Age", "30")
+	e := &Entry{Headers: h, RequestTime: now.Add(-2 * time.Second), ResponseTime: now}
+	assert.Equal(t, 52*time.Second, e.age(now.Add(20*time.Second)))
+}
+
+func TestCacheNotStored(t *testing.T) {
+	tests := []struct {
+		name string
+		o    *origin
+		hdrs []string
+	}{
+		{"no-store", newOrigin("x", "Cache-Control", "max-age=60, no-store"), nil},
+		{"private", newOrigin("x", "Cache-Control", "private, max-age=60"), nil},
+		{"vary star", newOrigin("x", "Cache-Control", "max-age=60", "Vary", "*"), nil},
+		{"no freshness or validator", newOrigin("x"), nil},
+		{"request no-store", newOrigin("x", "Cache-Control", "max-age=60"), []string{"Cache-Control: no-store\r\n"}},
+		{"authorization", newOrigin("x", "Cache-Control", "max-age=60"), []string{"Authorization: Bearer t\r\n"}},
+	}
+	for _, tt := range tests {
+		tc := newTestCache(t, tt.o, nil)
+		_, status := tc.do(t, "GET", "/", tt.hdrs...)
+		assert.NotContains(t, status, "stored", tt.name)
+		tc.do(t, "GET", "/", tt.hdrs...)
+		assert.Equal(t, int64(2), tt.o.calls.Load(), tt.name)
+	}
+
+	// Test: Authorization with public is shared
+	o := newOrigin("x", "Cache-Control", "public, max-age=60")
+	tc := newTestCache(t, o, nil)
+	_, status := tc.do(t, "GET", "/", "Authorization: Bearer t\r\n")
+	assert.Contains(t, status, "stored")
+
+	// Test: Uncacheable status with explicit freshness
+	o = newOrigin("moved", "Cache-Control", "max-age=60", "Location", "/b")
+	o.status = 302
+	tc = newTestCache(t, o, nil)
+	_, status = tc.do(t, "GET", "/")
+	assert.Contains(t, status, "stored")
+	o.headers = map[string]string{"Location": "/b"}
+	_, status = tc.do(t, "GET", "/other")
+	assert.NotContains(t, status, "stored")
+}
+
+func TestCacheVary(t *testing.T) {
+	o := newOrigin("x", "Cache-Control", "max-age=60", "Vary", "Accept-Encoding")
+	tc := newTestCache(t, o, nil)
+
+	_, status := tc.do(t, "GET", "/", "Accept-Encoding: gzip\r\n")
+	assert.Contains(t, status, "stored")
+	_, status = tc.do(t, "GET", "/", "Accept-Encoding:  gzip \r\n")
+	assert.Contains(t, status, "hit")
+	_, status = tc.do(t, "GET", "/", "Accept-Encoding: br\r\n")
+	assert.Contains(t, status, "fwd=vary-miss")
+	_, status = tc.do(t, "GET", "/")
+	assert.Contains(t, status, "fwd=vary-miss")
+}
+
+func TestCacheStaleOnError(t *testing.T) {
+	for _, cc := range []string{"max-age=60", "max-age=60, must-revalidate"} {
+		o := newOrigin("good", "Cache-Control", cc, "ETag", `"v1"`)
+		tc := newTestCache(t, o, nil)
+		tc.do(t, "GET", "/")
+
+		o.mu.Lock()
+		o.status, o.body, o.headers = response.StatusServiceUnavailable, "down", map[string]string{}
+		o.mu.Unlock()
+		tc.now = tc.now.Add(2 * time.Minute)
+		rec, status := tc.do(t, "GET", "/")
+		if strings.Contains(cc, "must-revalidate") {
+			assert.Equal(t, response.StatusServiceUnavailable, rec.StatusCode)
+			assert.Equal(t, "down", rec.Body.String())
+		} else {
+			assert.Equal(t, response.StatusOK, rec.StatusCode)
+			assert.Equal(t, "good", rec.Body.String())
+			assert.Contains(t, status, "stale-on-error")
+		}
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	o := newOrigin("x", "Cache-Control", "max-age=60")
+	tc := newTestCache(t, o, nil)
+	tc.do(t, "GET", "/item")
+	_, status := tc.do(t, "GET", "/item")
+	assert.Contains(t, status, "hit")
+
+	_, status = tc.do(t, "POST", "/item")
+	assert.Equal(t, "http-from-tcp; fwd=method; fwd-status=200", status)
+	_, status = tc.do(t, "GET", "/item")
+	assert.Contains(t, status, "fwd=uri-miss")
+
+	// Test: Range requests bypass the cache
+	_, status = tc.do(t, "GET", "/item", "Range: bytes=0-0\r\n")
+	assert.Contains(t, status, "fwd=request")
+}
+
+// notifyTransport records a response and signals when body bytes arrive.
+type notifyTransport struct {
+	body bytes.Buffer
+	got  chan struct{}
+}
+
+func (n *notifyTransport) WriteHead(response.StatusCode, headers.Headers) error { return nil }
+
+func (n *notifyTransport) WriteBody(p []byte) (int, error) {
+	if n.body.Len() == 0 {
+		close(n.got)
+	}
+	return n.body.Write(p)
+}
+
+func (n *notifyTransport) WriteEnd(headers.Headers) error { return nil }
+
+func TestCacheStreamsResponses(t *testing.T) {
+	o := newOrigin("")
+	tc := newTestCache(t, o, nil)
+	client := &notifyTransport{got: make(chan struct{})}
+	tc.handler = tc.Middleware()(func(w *response.Writer, req *request.Request) {
+		o.calls.Add(1)
+		h := headers.NewHeaders()
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.Write([]byte("first "))
+		select {
+		case <-client.got:
+		case <-time.After(time.Second):
+			t.Error("the first chunk was held back")
+		}
+		w.Write([]byte("second"))
+		w.WriteChunkedBodyDone(nil)
+	})
+
+	req, err := request.RequestFromReader(strings.NewReader("GET /s HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	w := response.NewTransportWriter(client)
+	tc.handler(w, req)
+	require.NoError(t, w.Close())
+	assert.Equal(t, "first second", client.body.String())
+
+	rec, status := tc.do(t, "GET", "/s")
+	assert.Contains(t, status, "hit")
+	assert.Equal(t, "first second", rec.Body.String())
+	assert.Equal(t, int64(1), o.calls.Load())
+}
+
+func TestCacheMaxEntryBytes(t *testing.T) {
+	o := newOrigin("hello", "Cache-Control", "max-age=60")
+	tc := newTestCache(t, o, nil)
+	tc.MaxEntryBytes = 4
+
+	rec, status := tc.do(t, "GET", "/big")
+	assert.Equal(t, "hello", rec.Body.String())
+	assert.NotContains(t, status, "stored")
+	_, status = tc.do(t, "GET", "/big")
+	assert.Contains(t, status, "fwd=uri-miss")
+	assert.Equal(t, int64(2), o.calls.Load())
+
+	// Test: Bodies of unknown length stop being captured at the limit
+	tc.handler = tc.Middleware()(func(w *response.Writer, req *request.Request) {
+		o.calls.Add(1)
+		h := headers.NewHeaders()
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.Write([]byte("hel"))
+		w.Write([]byte("lo"))
+		w.WriteChunkedBodyDone(nil)
+	})
+	rec, _ = tc.do(t, "GET", "/chunked")
+	assert.Equal(t, "hello", rec.Body.String())
+	_, status = tc.do(t, "GET", "/chunked")
+	assert.Contains(t, status, "fwd=uri-miss")
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	o := newOrigin("slow", "Cache-Control", "max-age=60")
+	release := make(chan struct{})
+	tc := newTestCache(t, o, nil)
+	tc.handler = tc.Middleware()(func(w *response.Writer, req *request.Request) {
+		<-release
+		o.serve(w, req)
+	})
+
+	const n = 10
+	var wg sync.WaitGroup
+	bodies := make([]string, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec, _ := tc.do(t, "GET", "/slow")
+			bodies[i] = rec.Body.String()
+		}()
+	}
+	require.Eventually(t, func() bool {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		return len(tc.calls) == 1
+	}, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), o.calls.Load())
+	for _, b := range bodies {
+		assert.Equal(t, "slow", b)
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	s := NewMemoryStore(100)
+	entry := func(n int) *Entry {
+		return &Entry{Headers: headers.NewHeaders(), Body: bytes.Repeat([]byte("x"), n)}
+	}
+	s.Set("a", entry(40))
+	s.Set("b", entry(40))
+	_, ok := s.Get("a")
+	require.True(t, ok)
+	s.Set("c", entry(40))
+
+	_, ok = s.Get("b")
+	assert.False(t, ok, "least recently used is evicted")
+	_, ok = s.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, s.Len())
+
+	s.Set("huge", entry(200))
+	_, ok = s.Get("huge")
+	assert.False(t, ok)
+	s.Delete("a")
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir)
+	require.NoError(t, err)
+
+	o := newOrigin("persisted", "Cache-Control", "max-age=60", "Vary", "Accept")
+	tc := newTestCache(t, o, s)
+	tc.do(t, "GET", "/d", "Accept: text/plain\r\n")
+
+	// A new cache over the same directory sees the entry.
+	s2, err := NewDiskStore(dir)
+	require.NoError(t, err)
+	tc2 := newTestCache(t, o, s2)
+	rec, status := tc2.do(t, "GET", "/d", "Accept: text/plain\r\n")
+	assert.Contains(t, status, "hit")
+	assert.Equal(t, "persisted", rec.Body.String())
+	assert.Equal(t, int64(1), o.calls.Load())
+
+	s2.Delete("example.com/d")
+	_, ok := s2.Get("example.com/d")
+	assert.False(t, ok)
+	_, ok = s2.Get("missing")
+	assert.False(t, ok)
+}
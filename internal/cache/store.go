@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+)
+
+// DefaultMaxBytes is the size of the MemoryStore used when a Cache has no
+// store.
+const DefaultMaxBytes = 64 << 20
+
+// Entry is a stored response.
+type Entry struct {
+	StatusCode response.StatusCode
+	Headers    headers.Headers
+	Body       []byte
+	// RequestTime and ResponseTime are when the request that produced the
+	// response was sent and when the response arrived, for computing its
+	// age.
+	RequestTime  time.Time
+	ResponseTime time.Time
+	// VaryValues holds the values the request had for each field named in
+	// the response's Vary header.
+	VaryValues map[string]string
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body))
+	for k, v := range e.Headers {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// Store holds entries by key. Implementations must be safe for concurrent
+// use.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, e *Entry)
+	Delete(key string)
+}
+
+// MemoryStore is an in-memory Store that evicts the least recently used
+// entries once it holds more than its byte limit.
+type MemoryStore struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true
+}
+
+// Set stores e, unless it alone is larger than the store.
+func (s *MemoryStore) Set(key string, e *Entry) {
+	size := e.size() + int64(len(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	if size > s.maxBytes {
+		return
+	}
+	s.items[key] = s.lru.PushFront(&memoryItem{key, e, size})
+	s.bytes += size
+	for s.bytes > s.maxBytes {
+		s.remove(s.lru.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+// Len returns the number of entries held.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+func (s *MemoryStore) remove(key string) {
+	if el, ok := s.items[key]; ok {
+		s.bytes -= el.Value.(*memoryItem).size
+		s.lru.Remove(el)
+		delete(s.items, key)
+	}
+}
+
+// DiskStore is a Store keeping one JSON file per entry in a directory, so
+// entries survive restarts. It does not evict; stale entries are replaced
+// when they are fetched again.
+type DiskStore struct {
+	dir string
+}
+
+// NewDiskStore returns a DiskStore in dir, creating it if needed.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+// diskEntry is the file format of a DiskStore entry. The key is kept to
+// rule out hash collisions.
+type diskEntry struct {
+	Key   string `json:"key"`
+	Entry *Entry `json:"entry"`
+}
+
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *DiskStore) Get(key string) (*Entry, bool) {
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var de diskEntry
+	if err := json.Unmarshal(data, &de); err != nil || de.Key != key || de.Entry == nil {
+		return nil, false
+	}
+	return de.Entry, true
+}
+
+// Set writes e to a temporary file and renames it into place, so readers
+// never see a partial entry. Failures leave the entry uncached.
+func (s *DiskStore) Set(key string, e *Entry) {
+	data, err := json.Marshal(diskEntry{key, e})
+	if err != nil {
+		return
+	}
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, werr := f.Write(data)
+	cerr := f.Close()
+	if werr != nil || cerr != nil || os.Rename(f.Name(), s.path(key)) != nil {
+		os.Remove(f.Name())
+	}
+}
+
+func (s *DiskStore) Delete(key string) {
+	os.Remove(s.path(key))
+}
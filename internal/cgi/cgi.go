@@ -0,0 +1,475 @@
+// Package cgi runs CGI/1.1 scripts (RFC 3875) as request handlers.
+package cgi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+const (
+	// DefaultTimeout bounds scripts run by a Handler without a Timeout.
+	DefaultTimeout = 30 * time.Second
+
+	serverSoftware = "http-from-tcp"
+	copyBuffer     = 32 * 1024
+	// maxHeaderBytes limits the header section of a script's output.
+	maxHeaderBytes = 64 * 1024
+	// waitDelay is how long output is still read once a script has exited
+	// or been killed, in case a child it started holds stdout open.
+	waitDelay = time.Second
+	// maxStderrLine splits long stderr lines when logging them.
+	maxStderrLine = 4096
+	// maxRedirects limits how many local redirects one request may
+	// follow, so a script redirecting to itself cannot loop forever.
+	maxRedirects = 10
+)
+
+// redirectsKey is the context key holding how many local redirects led
+// to a request.
+type redirectsKey struct{}
+
+// hopHeaders are fields of a script's response that belong to the
+// connection, which the server manages itself.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Handler runs the scripts in a directory. A request for
+// Prefix + "name/extra/path" runs Dir/name with PATH_INFO "/extra/path".
+type Handler struct {
+	// Dir is the directory holding the scripts. Only executable regular
+	// files directly in Dir are run.
+	Dir string
+	// Prefix is the URL path the handler is mounted at, e.g. "/cgi-bin/".
+	Prefix string
+	// Env holds extra "KEY=value" variables for scripts.
+	Env []string
+	// InheritEnv names variables of the server's environment passed on
+	// to scripts. PATH is always passed unless Env sets it.
+	InheritEnv []string
+	// Timeout bounds how long a script may run before it is killed;
+	// DefaultTimeout if 0.
+	Timeout time.Duration
+	// LocalRedirect, if set, serves local redirects: responses made of
+	// just a Location header with a path, which RFC 3875 has the server
+	// answer as a GET for that path. If nil they are sent to the client
+	// as a 302.
+	LocalRedirect server.Handler
+	// Logger logs script failures and stderr output; nil means the log
+	// package's default.
+	Logger *log.Logger
+}
+
+// Serve has the signature of server.Handler.
+func (h *Handler) Serve(w *response.Writer, req *request.Request) {
+	script, name, pathInfo, code := h.resolve(req.Path())
+	if code != 0 {
+		response.WriteError(w, code, nil)
+		return
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Dir = filepath.Dir(script)
+	cmd.Env = h.env(req, script, name, pathInfo)
+	cmd.Stdin = bytes.NewReader(req.Body)
+	stderr := &lineLogger{logf: h.logf, prefix: "cgi: " + name + ": "}
+	cmd.Stderr = stderr
+	cmd.WaitDelay = waitDelay
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	if err := cmd.Start(); err != nil {
+		h.logf("cgi: %s: %v", name, err)
+		response.WriteError(w, response.StatusInternalServerError, nil)
+		return
+	}
+	waitErr := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		pw.Close()
+		stderr.flush()
+		waitErr <- err
+	}()
+
+	h.relay(ctx, w, req, bufio.NewReader(pr), name)
+
+	// Kill the script if it is still running, e.g. because the client
+	// went away, and report how it ended unless it was killed.
+	killed := ctx.Err() != nil
+	pr.Close()
+	cancel()
+	if err := <-waitErr; err != nil && !killed {
+		h.logf("cgi: %s: %v", name, err)
+	}
+}
+
+// resolve maps a request path to the script to run, returning the
+// script's file name, its name as a URL path element and the path info.
+// It returns a status code instead if there is no script to run.
+func (h *Handler) resolve(urlPath string) (script, name, pathInfo string, code response.StatusCode) {
+	prefix := strings.TrimSuffix(h.Prefix, "/") + "/"
+	rest, ok := strings.CutPrefix(urlPath, prefix)
+	if !ok {
+		return "", "", "", response.StatusNotFound
+	}
+	rawName, rawInfo, _ := strings.Cut(rest, "/")
+	name, err := url.PathUnescape(rawName)
+	if err != nil || name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\\x00") {
+		return "", "", "", response.StatusNotFound
+	}
+	if rawInfo != "" || strings.HasSuffix(rest, "/") {
+		pathInfo, err = url.PathUnescape("/" + rawInfo)
+		if err != nil || strings.Contains(pathInfo, "\x00") {
+			return "", "", "", response.StatusNotFound
+		}
+	}
+
+	dir, err := filepath.Abs(h.Dir)
+	if err != nil {
+		return "", "", "", response.StatusInternalServerError
+	}
+	script = filepath.Join(dir, name)
+	info, err := os.Stat(script)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return "", "", "", response.StatusNotFound
+	case err != nil:
+		return "", "", "", response.StatusForbidden
+	case !info.Mode().IsRegular(), info.Mode().Perm()&0o111 == 0:
+		return "", "", "", response.StatusForbidden
+	}
+	return script, name, pathInfo, 0
+}
+
+// env builds the environment for a script: the configured variables,
+// then the meta-variables of RFC 3875 section 4.1, then the request's
+// header fields as HTTP_* variables.
+func (h *Handler) env(req *request.Request, script, name, pathInfo string) []string {
+	var env []string
+	hasPath := false
+	for _, kv := range h.Env {
+		if strings.HasPrefix(kv, "PATH=") {
+			hasPath = true
+		}
+	}
+	inherit := h.InheritEnv
+	if !hasPath {
+		inherit = append([]string{"PATH"}, inherit...)
+	}
+	for _, k := range inherit {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	env = append(env, h.Env...)
+
+	_, query, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	serverName, serverPort := splitHostPort(req.Headers.Get("Host"))
+	if req.LocalAddr != nil {
+		host, port := splitHostPort(req.LocalAddr.String())
+		if serverName == "" {
+			serverName = host
+		}
+		serverPort = port
+	}
+	if serverPort == "" {
+		serverPort = "80"
+		if req.TLS != nil {
+			serverPort = "443"
+		}
+	}
+	meta := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   serverSoftware,
+		"SERVER_PROTOCOL":   "HTTP/" + req.RequestLine.HttpVersion,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REQUEST_METHOD":    req.RequestLine.Method,
+		"REQUEST_URI":       req.RequestLine.RequestTarget,
+		"QUERY_STRING":      query,
+		"SCRIPT_NAME":       strings.TrimSuffix(h.Prefix, "/") + "/" + name,
+		"SCRIPT_FILENAME":   script,
+	}
+	if pathInfo != "" {
+		meta["PATH_INFO"] = pathInfo
+	}
+	if req.RemoteAddr != nil {
+		host, port := splitHostPort(req.RemoteAddr.String())
+		meta["REMOTE_ADDR"] = host
+		meta["REMOTE_HOST"] = host
+		meta["REMOTE_PORT"] = port
+	}
+	if len(req.Body) > 0 {
+		meta["CONTENT_LENGTH"] = strconv.Itoa(len(req.Body))
+	}
+	if ct := req.Headers.Get("Content-Type"); ct != "" {
+		meta["CONTENT_TYPE"] = ct
+	}
+	if req.TLS != nil {
+		meta["HTTPS"] = "on"
+	}
+	for k, v := range meta {
+		env = append(env, k+"="+v)
+	}
+
+	for k, v := range req.Headers {
+		if envName, ok := headerEnvName(k); ok {
+			env = append(env, envName+"="+v)
+		}
+	}
+	return env
+}
+
+// headerEnvName returns the HTTP_* variable for header field k. Fields
+// that are passed as other meta-variables are left out, as are Proxy,
+// which scripts would take for their HTTP_PROXY setting, and names with
+// characters that don't map to a variable name unambiguously.
+func headerEnvName(k string) (string, bool) {
+	switch strings.ToLower(k) {
+	case "content-length", "content-type", "proxy", "proxy-authorization":
+		return "", false
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return "", false
+		}
+	}
+	return "HTTP_" + strings.ToUpper(strings.ReplaceAll(k, "-", "_")), true
+}
+
+// relay parses the script's output from r and writes the response.
+func (h *Handler) relay(ctx context.Context, w *response.Writer, req *request.Request, r *bufio.Reader, name string) {
+	rh, err := readHeader(r)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			h.logf("cgi: %s: timed out", name)
+			response.WriteError(w, response.StatusGatewayTimeout, nil)
+			return
+		}
+		h.logf("cgi: %s: %v", name, err)
+		response.WriteError(w, response.StatusBadGateway, nil)
+		return
+	}
+
+	code := response.StatusOK
+	if status := rh.Get("Status"); status != "" {
+		n, err := strconv.Atoi(strings.SplitN(strings.TrimSpace(status), " ", 2)[0])
+		if err != nil || n < 100 || n > 599 {
+			h.logf("cgi: %s: invalid status %q", name, status)
+			response.WriteError(w, response.StatusBadGateway, nil)
+			return
+		}
+		code = response.StatusCode(n)
+		rh.Del("Status")
+	}
+
+	location := rh.Get("Location")
+	switch {
+	case location != "" && code == response.StatusOK && strings.HasPrefix(location, "/") && len(rh) == 1:
+		// A local redirect: the response is just the Location header.
+		if h.LocalRedirect != nil {
+			io.Copy(io.Discard, r)
+			n, _ := req.Context().Value(redirectsKey{}).(int)
+			if n >= maxRedirects {
+				h.logf("cgi: %s: more than %d local redirects", name, maxRedirects)
+				response.WriteError(w, response.StatusInternalServerError, nil)
+				return
+			}
+			h.LocalRedirect(w, localRequest(req, location, n+1))
+			return
+		}
+		code = response.StatusCode(302)
+	case location != "" && code == response.StatusOK:
+		code = response.StatusCode(302)
+	case location == "" && rh.Get("Content-Type") == "" && bodyAllowed(code):
+		h.logf("cgi: %s: response has no Content-Type", name)
+		response.WriteError(w, response.StatusBadGateway, nil)
+		return
+	}
+
+	for _, k := range hopHeaders {
+		rh.Del(k)
+	}
+	bodiless := req.RequestLine.Method == "HEAD" || !bodyAllowed(code)
+	chunked := false
+	if cl := rh.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err != nil || n < 0 {
+			rh.Del("Content-Length")
+		}
+	}
+	if rh.Get("Content-Length") == "" && !bodiless {
+		chunked = true
+		rh.SetNew("Transfer-Encoding", "chunked")
+	}
+
+	if err := w.WriteStatusLine(code); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(rh); err != nil {
+		return
+	}
+	if bodiless {
+		io.Copy(io.Discard, r)
+		return
+	}
+
+	buf := make([]byte, copyBuffer)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// Killed mid-body; the response ends where the output did.
+		h.logf("cgi: %s: timed out", name)
+		return
+	}
+	if chunked {
+		w.WriteChunkedBodyDone(nil)
+	}
+}
+
+// readHeader reads the header section of a script's response, whose
+// lines may end in LF or CRLF.
+func readHeader(r *bufio.Reader) (headers.Headers, error) {
+	h := headers.NewHeaders()
+	size := 0
+	for {
+		line, err := r.ReadString('\n')
+		size += len(line)
+		if size > maxHeaderBytes {
+			return nil, errors.New("response header too large")
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("script exited before the end of its response header")
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || k == "" || strings.ContainsAny(k, " \t") {
+			return nil, fmt.Errorf("malformed response header line %q", line)
+		}
+		h.Set(k, strings.TrimSpace(v))
+	}
+	if len(h) == 0 {
+		return nil, errors.New("empty response header")
+	}
+	return h, nil
+}
+
+// localRequest returns the GET request a local redirect to target stands
+// for, recording that it is the nth redirect.
+func localRequest(req *request.Request, target string, n int) *request.Request {
+	r := req.WithContext(context.WithValue(req.Context(), redirectsKey{}, n))
+	r.RequestLine.Method = "GET"
+	r.RequestLine.RequestTarget = target
+	r.Body = []byte{}
+	r.Headers = headers.NewHeaders()
+	for k, v := range req.Headers {
+		switch strings.ToLower(k) {
+		case "content-length", "content-type", "transfer-encoding":
+			continue
+		}
+		r.Headers.SetNew(k, v)
+	}
+	return r
+}
+
+func bodyAllowed(code response.StatusCode) bool {
+	return code >= 200 && code != response.StatusNoContent && code != response.StatusNotModified
+}
+
+// splitHostPort splits addr into host and port, either of which may be
+// empty.
+func splitHostPort(addr string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+	return host, port
+}
+
+// lineLogger logs what is written to it line by line.
+type lineLogger struct {
+	logf   func(format string, args ...any)
+	prefix string
+	buf    []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			if len(l.buf) >= maxStderrLine {
+				l.flush()
+			}
+			return len(p), nil
+		}
+		l.logf("%s%s", l.prefix, bytes.TrimRight(l.buf[:i], "\r"))
+		l.buf = l.buf[i+1:]
+	}
+}
+
+// flush logs what is left of an unterminated line.
+func (l *lineLogger) flush() {
+	if len(l.buf) > 0 {
+		l.logf("%s%s", l.prefix, l.buf)
+		l.buf = nil
+	}
+}
+
+func (h *Handler) logf(format string, args ...any) {
+	if h.Logger != nil {
+		h.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
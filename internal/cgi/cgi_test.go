@@ -0,0 +1,231 @@
+package cgi
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHandler returns a Handler mounted at /cgi-bin/ for a directory with
+// the given shell scripts.
+func newHandler(t *testing.T, scripts map[string]string) *Handler {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("scripts need a Unix shell")
+	}
+	dir := t.TempDir()
+	for name, body := range scripts {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body), 0o755))
+	}
+	return &Handler{Dir: dir, Prefix: "/cgi-bin/", Logger: log.New(io.Discard, "", 0)}
+}
+
+// serve parses raw, runs h for it from 192.0.2.7:40123 and records the
+// response.
+func serve(t *testing.T, h func(*response.Writer, *request.Request), raw string) *response.Recorder {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 40123}
+	req.LocalAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8080}
+
+	rec, w := response.NewRecorder()
+	h(w, req)
+	require.NoError(t, w.Close())
+	return rec
+}
+
+func TestHandlerEnvironmentAndBody(t *testing.T) {
+	t.Setenv("CGI_TEST_SECRET", "hidden")
+	t.Setenv("CGI_TEST_SHARED", "shared")
+	h := newHandler(t, map[string]string{
+		"env.sh": "printf 'Content-Type: text/plain\\r\\n\\r\\n'\nenv\necho BODY=$(cat)\n",
+	})
+	h.Env = []string{"EXTRA=1"}
+	h.InheritEnv = []string{"CGI_TEST_SHARED"}
+
+	rec := serve(t, h.Serve, "POST /cgi-bin/env.sh/a%20b/c?x=1&y=2 HTTP/1.1\r\n"+
+		"Host: example.com:8080\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 5\r\n"+
+		"X-Custom-Header: yes\r\n"+
+		"Proxy: http://evil.example/\r\n"+
+		"\r\n"+
+		"hello")
+	require.Equal(t, response.StatusOK, rec.StatusCode)
+	assert.Equal(t, "chunked", rec.Headers.Get("Transfer-Encoding"))
+	assert.Equal(t, "text/plain", rec.Headers.Get("Content-Type"))
+
+	env := map[string]string{}
+	for line := range strings.Lines(rec.Body.String()) {
+		k, v, _ := strings.Cut(strings.TrimSuffix(line, "\n"), "=")
+		env[k] = v
+	}
+	for k, want := range map[string]string{
+		"GATEWAY_INTERFACE":    "CGI/1.1",
+		"SERVER_PROTOCOL":      "HTTP/1.1",
+		"SERVER_NAME":          "example.com",
+		"SERVER_PORT":          "8080",
+		"REQUEST_METHOD":       "POST",
+		"QUERY_STRING":         "x=1&y=2",
+		"SCRIPT_NAME":          "/cgi-bin/env.sh",
+		"PATH_INFO":            "/a b/c",
+		"REMOTE_ADDR":          "192.0.2.7",
+		"REMOTE_PORT":          "40123",
+		"CONTENT_LENGTH":       "5",
+		"CONTENT_TYPE":         "text/plain",
+		"HTTP_HOST":            "example.com:8080",
+		"HTTP_X_CUSTOM_HEADER": "yes",
+		"EXTRA":                "1",
+		"CGI_TEST_SHARED":      "shared",
+		"BODY":                 "hello",
+	} {
+		assert.Equal(t, want, env[k], k)
+	}
+	for _, k := range []string{"HTTP_PROXY", "HTTP_CONTENT_LENGTH", "HTTPS", "CGI_TEST_SECRET"} {
+		assert.NotContains(t, env, k)
+	}
+	assert.NotEmpty(t, env["PATH"])
+}
+
+func TestHandlerStatusAndLength(t *testing.T) {
+	h := newHandler(t, map[string]string{
+		"missing.sh": "echo 'Status: 404 Not Here'\necho 'Content-Type: text/plain'\necho 'Content-Length: 5'\necho 'X-Script: 1'\necho\necho gone\n",
+		"empty.sh":   "echo 'Status: 204'\necho\n",
+	})
+
+	rec := serve(t, h.Serve, "GET /cgi-bin/missing.sh HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, response.StatusNotFound, rec.StatusCode)
+	assert.Equal(t, "5", rec.Headers.Get("Content-Length"))
+	assert.Empty(t, rec.Headers.Get("Transfer-Encoding"))
+	assert.Equal(t, "1", rec.Headers.Get("X-Script"))
+	assert.Empty(t, rec.Headers.Get("Status"))
+	assert.Equal(t, "gone\n", rec.Body.String())
+
+	rec = serve(t, h.Serve, "HEAD /cgi-bin/missing.sh HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, response.StatusNotFound, rec.StatusCode)
+	assert.Empty(t, rec.Body.String())
+
+	rec = serve(t, h.Serve, "GET /cgi-bin/empty.sh HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, response.StatusNoContent, rec.StatusCode)
+	assert.Empty(t, rec.Body.String())
+}
+
+func TestHandlerLocation(t *testing.T) {
+	h := newHandler(t, map[string]string{
+		"away.sh":  "echo 'Location: https://example.com/'\necho\n",
+		"local.sh": "echo 'Location: /other?q=1'\necho\n",
+		"moved.sh": "echo 'Status: 301 Moved Permanently'\necho 'Location: /new'\necho 'Content-Type: text/plain'\necho\necho moved\n",
+	})
+
+	rec := serve(t, h.Serve, "GET /cgi-bin/away.sh HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, response.StatusCode(302), rec.StatusCode)
+	assert.Equal(t, "https://example.com/", rec.Headers.Get("Location"))
+
+	rec = serve(t, h.Serve, "GET /cgi-bin/local.sh HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, response.StatusCode(302), rec.StatusCode, "local redirects go to the client without LocalRedirect")
+	assert.Equal(t, "/other?q=1", rec.Headers.Get("Location"))
+
+	rec = serve(t, h.Serve, "GET /cgi-bin/moved.sh HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, response.StatusMovedPermanently, rec.StatusCode)
+	assert.Equal(t, "/new", rec.Headers.Get("Location"))
+	assert.Equal(t, "moved\n", rec.Body.String())
+
+	var got *request.Request
+	h.LocalRedirect = func(w *response.Writer, req *request.Request) {
+		got = req
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(2))
+		w.WriteBody([]byte("ok"))
+	}
+	rec = serve(t, h.Serve, "POST /cgi-bin/local.sh HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc")
+	assert.Equal(t, response.StatusOK, rec.StatusCode)
+	assert.Equal(t, "ok", rec.Body.String())
+	require.NotNil(t, got)
+	assert.Equal(t, "GET", got.RequestLine.Method)
+	assert.Equal(t, "/other?q=1", got.RequestLine.RequestTarget)
+	assert.Empty(t, got.Body)
+	assert.Empty(t, got.Headers.Get("Content-Length"))
+	assert.Equal(t, "x", got.Headers.Get("Host"))
+}
+
+func TestHandlerRedirectLoop(t *testing.T) {
+	h := newHandler(t, map[string]string{
+		"loop.sh": "echo 'Location: /cgi-bin/loop.sh'\necho\n",
+	})
+	runs := 0
+	h.LocalRedirect = func(w *response.Writer, req *request.Request) {
+		runs++
+		h.Serve(w, req)
+	}
+
+	rec := serve(t, h.Serve, "GET /cgi-bin/loop.sh HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, response.StatusInternalServerError, rec.StatusCode)
+	assert.Equal(t, maxRedirects, runs)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	h := newHandler(t, map[string]string{
+		"slow.sh":    "sleep 10\n",
+		"partial.sh": "echo 'Content-Type: text/plain'\necho\necho start\nsleep 10\necho end\n",
+	})
+	h.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	rec := serve(t, h.Serve, "GET /cgi-bin/slow.sh HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, response.StatusGatewayTimeout, rec.StatusCode)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	start = time.Now()
+	rec = serve(t, h.Serve, "GET /cgi-bin/partial.sh HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, response.StatusOK, rec.StatusCode)
+	assert.Equal(t, "start\n", rec.Body.String())
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestHandlerErrors(t *testing.T) {
+	h := newHandler(t, map[string]string{
+		"ok.sh":      "echo 'Content-Type: text/plain'\necho\necho ok\n",
+		".hidden.sh": "echo 'Content-Type: text/plain'\necho\n",
+		"notype.sh":  "echo 'X-Foo: bar'\necho\necho body\n",
+		"garbage.sh": "echo 'this is not a header'\necho\n",
+		"nothing.sh": "exit 1\n",
+		"status.sh":  "echo 'Status: abc'\necho\n",
+	})
+	require.NoError(t, os.WriteFile(filepath.Join(h.Dir, "noexec.sh"), []byte("#!/bin/sh\n"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(h.Dir, "subdir"), 0o755))
+
+	cases := map[string]response.StatusCode{
+		"/cgi-bin/ok.sh":            200,
+		"/cgi-bin/ok.sh/":           200,
+		"/cgi-bin/missing.sh":       404,
+		"/cgi-bin/":                 404,
+		"/cgi-bin":                  404,
+		"/elsewhere/ok.sh":          404,
+		"/cgi-bin/.hidden.sh":       404,
+		"/cgi-bin/..%2Fcgi_test.go": 404,
+		"/cgi-bin/%2e%2e/ok.sh":     404,
+		"/cgi-bin/ok.sh%00":         404,
+		"/cgi-bin/noexec.sh":        403,
+		"/cgi-bin/subdir":           403,
+		"/cgi-bin/notype.sh":        502,
+		"/cgi-bin/garbage.sh":       502,
+		"/cgi-bin/nothing.sh":       502,
+		"/cgi-bin/status.sh":        502,
+	}
+	for path, want := range cases {
+		rec := serve(t, h.Serve, "GET "+path+" HTTP/1.1\r\nHost: x\r\n\r\n")
+		assert.Equal(t, want, rec.StatusCode, path)
+	}
+}
@@ -0,0 +1,243 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+const defaultIndex = "index.html"
+
+type ListingMode int
+
+const (
+	// ListingNone answers requests for directories without an index with 403.
+	ListingNone ListingMode = iota
+	// ListingHTML renders directories as an HTML page.
+	ListingHTML
+	// ListingJSON renders directories as a JSON array.
+	ListingJSON
+	// ListingAuto picks JSON when the client accepts application/json and
+	// HTML otherwise.
+	ListingAuto
+)
+
+type Options struct {
+	// Prefix is removed from the request path before it is resolved, so
+	// a handler mounted at /static/ can serve the root of the file system.
+	Prefix string
+	// Index is served for directory requests; "index.html" if empty.
+	Index   string
+	Listing ListingMode
+}
+
+// listEntry is a directory entry in a JSON listing.
+type listEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Dir returns a file system rooted at dir that refuses to resolve any path,
+// including through symlinks, to a location outside dir.
+func Dir(dir string) (fs.FS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return root.FS(), nil
+}
+
+// New returns a handler serving files from fsys.
+func New(fsys fs.FS, opts Options) server.Handler {
+	if opts.Index == "" {
+		opts.Index = defaultIndex
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		urlPath := req.Path()
+		name, ok := resolve(strings.TrimPrefix(urlPath, strings.TrimSuffix(opts.Prefix, "/")))
+		if !ok {
+			response.WriteError(w, response.StatusNotFound, nil)
+			return
+		}
+
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			response.WriteError(w, statusForError(err), nil)
+			return
+		}
+		if !info.IsDir() {
+			ServeFile(w, req, fsys, name)
+			return
+		}
+
+		if !strings.HasSuffix(urlPath, "/") {
+			redirect(w, urlPath+"/")
+			return
+		}
+		index := path.Join(name, opts.Index)
+		if fi, err := fs.Stat(fsys, index); err == nil && !fi.IsDir() {
+			ServeFile(w, req, fsys, index)
+			return
+		}
+		serveListing(w, req, fsys, name, opts.Listing)
+	}
+}
+
+// ServeFile serves the named file from fsys with response.ServeContent,
+// so Range requests are supported when the file can seek.
+func ServeFile(w *response.Writer, req *request.Request, fsys fs.FS, name string) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		response.WriteError(w, statusForError(err), nil)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		response.WriteError(w, response.StatusNotFound, nil)
+		return
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			response.WriteError(w, response.StatusInternalServerError, nil)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+	h := headers.NewHeaders()
+	h.Set("ETag", response.FileETag(info.ModTime(), info.Size()))
+	response.ServeContent(w, req, name, info.ModTime(), content, h)
+}
+
+// resolve turns a URL path into a name valid for fs.FS, rejecting anything
+// that could step outside the root.
+func resolve(urlPath string) (string, bool) {
+	p, err := url.PathUnescape(urlPath)
+	if err != nil || strings.ContainsAny(p, "\x00\\") {
+		return "", false
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return "", false
+		}
+	}
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", false
+	}
+	return name, true
+}
+
+func serveListing(w *response.Writer, req *request.Request, fsys fs.FS, dir string, mode ListingMode) {
+	if mode == ListingNone {
+		response.WriteError(w, response.StatusForbidden, nil)
+		return
+	}
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		response.WriteError(w, statusForError(err), nil)
+		return
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	if mode == ListingAuto {
+		mode = ListingHTML
+		if strings.Contains(req.Headers.Get("Accept"), "application/json") {
+			mode = ListingJSON
+		}
+	}
+
+	var body []byte
+	var ctype string
+	if mode == ListingJSON {
+		list := make([]listEntry, 0, len(entries))
+		for _, e := range entries {
+			le := listEntry{Name: e.Name(), IsDir: e.IsDir()}
+			if info, err := e.Info(); err == nil {
+				le.Size = info.Size()
+				le.ModTime = info.ModTime().UTC()
+			}
+			list = append(list, le)
+		}
+		body, _ = json.Marshal(list)
+		ctype = "application/json"
+	} else {
+		var b strings.Builder
+		title := html.EscapeString(req.Path())
+		fmt.Fprintf(&b, "<!doctype html>\n<html>\n<head><title>Index of %s</title></head>\n<body>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() {
+				name += "/"
+			}
+			fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString((&url.URL{Path: name}).EscapedPath()), html.EscapeString(name))
+		}
+		b.WriteString("</ul>\n</body>\n</html>\n")
+		body = []byte(b.String())
+		ctype = "text/html; charset=utf-8"
+	}
+
+	h := response.GetDefaultHeaders(len(body))
+	h.SetNew("Content-Type", ctype)
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(body)
+	}
+}
+
+func statusForError(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid):
+		return response.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return response.StatusForbidden
+	default:
+		// os.Root reports paths escaping the root, e.g. through a
+		// symlink, with an error of its own; don't reveal that they exist.
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			return response.StatusNotFound
+		}
+		return response.StatusInternalServerError
+	}
+}
+
+func redirect(w *response.Writer, location string) {
+	h := response.GetDefaultHeaders(0)
+	h.SetNew("Location", location)
+	if err := w.WriteStatusLine(response.StatusMovedPermanently); err != nil {
+		return
+	}
+	w.WriteHeaders(h)
+}
@@ -0,0 +1,156 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, h server.Handler, target string, hdrs ...string) (status, head, body string) {
+	t.Helper()
+	raw := "GET " + target + " HTTP/1.1\r\n" + strings.Join(hdrs, "") + "\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	h(w, req)
+	require.NoError(t, w.Close())
+
+	head, body, _ = strings.Cut(buf.String(), "\r\n\r\n")
+	status, _, _ = strings.Cut(head, "\r\n")
+	return status, head, body
+}
+
+func header(head, name string) string {
+	for line := range strings.SplitSeq(head, "\r\n") {
+		if k, v, ok := strings.Cut(line, ": "); ok && k == name {
+			return v
+		}
+	}
+	return ""
+}
+
+func newTestDir(t *testing.T) string {
+	t.Helper()
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	files := map[string]string{
+		"root/hello.txt":       "hello world",
+		"root/site/index.html": "<h1>site</h1>",
+		"root/docs/a.md":       "# a",
+		"root/docs/b & c.json": "{}",
+		"root/blob":            "\x89PNG\r\n\x1a\nrest",
+		"secret.txt":           "top secret",
+		"root/docs/sub/.keep":  "",
+	}
+	for name, data := range files {
+		p := filepath.Join(parent, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(data), 0o644))
+	}
+	require.NoError(t, os.Symlink("../secret.txt", filepath.Join(root, "escape")))
+	require.NoError(t, os.Symlink("hello.txt", filepath.Join(root, "inside")))
+	return root
+}
+
+func TestServeFiles(t *testing.T) {
+	fsys, err := Dir(newTestDir(t))
+	require.NoError(t, err)
+	h := New(fsys, Options{Prefix: "/static/"})
+
+	status, head, body := get(t, h, "/static/hello.txt")
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Contains(t, head, "content-type: text/plain; charset=utf-8")
+	assert.Contains(t, head, "content-length: 11")
+	assert.Equal(t, "hello world", body)
+
+	// Test: Validators and ranges
+	etag := header(head, "etag")
+	require.NotEmpty(t, etag)
+	status, _, body = get(t, h, "/static/hello.txt", "If-None-Match: "+etag+"\r\n")
+	assert.Equal(t, "HTTP/1.1 304 Not Modified", status)
+	assert.Empty(t, body)
+	status, _, body = get(t, h, "/static/hello.txt", "Range: bytes=6-\r\n")
+	assert.Equal(t, "HTTP/1.1 206 Partial Content", status)
+	assert.Equal(t, "world", body)
+
+	// Test: Content sniffing without an extension
+	_, head, body = get(t, h, "/static/blob")
+	assert.Contains(t, head, "content-type: image/png")
+	assert.Equal(t, "\x89PNG\r\n\x1a\nrest", body)
+
+	// Test: Index file and directory redirect
+	status, head, _ = get(t, h, "/static/site")
+	assert.Equal(t, "HTTP/1.1 301 Moved Permanently", status)
+	assert.Contains(t, head, "location: /static/site/")
+	_, _, body = get(t, h, "/static/site/")
+	assert.Equal(t, "<h1>site</h1>", body)
+
+	// Test: Symlinks inside the root work, escaping ones don't
+	_, _, body = get(t, h, "/static/inside")
+	assert.Equal(t, "hello world", body)
+	status, _, body = get(t, h, "/static/escape")
+	assert.Equal(t, "HTTP/1.1 404 Not Found", status)
+	assert.NotContains(t, body, "secret")
+
+	// Test: Traversal
+	for _, target := range []string{"/static/../secret.txt", "/static/%2e%2e/secret.txt", "/static/docs/..%2f..%2fsecret.txt", "/static/a%00b"} {
+		status, _, body = get(t, h, target)
+		assert.Equal(t, "HTTP/1.1 404 Not Found", status, target)
+		assert.NotContains(t, body, "secret", target)
+	}
+
+	// Test: Listing disabled
+	status, _, _ = get(t, h, "/static/docs/")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", status)
+}
+
+func TestListings(t *testing.T) {
+	fsys, err := Dir(newTestDir(t))
+	require.NoError(t, err)
+	h := New(fsys, Options{Listing: ListingAuto})
+
+	_, head, body := get(t, h, "/docs/")
+	assert.Contains(t, head, "content-type: text/html")
+	assert.Contains(t, body, `<a href="a.md">a.md</a>`)
+	assert.Contains(t, body, `<a href="b%20&amp;%20c.json">b &amp; c.json</a>`)
+	assert.Contains(t, body, `<a href="sub/">sub/</a>`)
+
+	_, head, body = get(t, h, "/docs/", "Accept: application/json\r\n")
+	assert.Contains(t, head, "content-type: application/json")
+	var list []listEntry
+	require.NoError(t, json.Unmarshal([]byte(body), &list))
+	require.Len(t, list, 3)
+	assert.Equal(t, "a.md", list[0].Name)
+	assert.Equal(t, int64(3), list[0].Size)
+	assert.True(t, list[2].IsDir)
+}
+
+func TestServeFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app.js":          {Data: []byte("console.log(1)")},
+		"big.bin":         {Data: bytes.Repeat([]byte("x"), 100*1024+1)},
+		"assets/logo.svg": {Data: []byte("<svg/>")},
+	}
+	h := New(fsys, Options{})
+
+	_, head, body := get(t, h, "/app.js")
+	assert.Contains(t, head, "content-type: text/javascript")
+	assert.Equal(t, "console.log(1)", body)
+
+	_, _, body = get(t, h, "/big.bin")
+	assert.Len(t, body, 100*1024+1)
+
+	status, _, _ := get(t, h, "/missing")
+	assert.Equal(t, "HTTP/1.1 404 Not Found", status)
+}
@@ -8,6 +8,7 @@ import (
 
 const (
 	crlf                = "\r\n"
+	setCookie           = "set-cookie"
 	validFieldNameChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789!#$%&'*+-.^_`|~"
 )
 
@@ -64,15 +65,36 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	return n, false, nil
 }
 
+// Set adds value to key. Repeated fields are joined with ", ", except
+// Set-Cookie, whose values may contain commas and must stay separate lines
+// (RFC 9110 section 5.3); Values splits them again.
 func (h Headers) Set(key, value string) {
 	key = strings.ToLower(key)
 	if _, ok := h[strings.ToLower(key)]; ok {
-		h[key] += ", " + value
+		sep := ", "
+		if key == setCookie {
+			sep = "\n"
+		}
+		h[key] += sep + value
 		return
 	}
 	h[key] = value
 }
 
+// Values returns the field lines to send for key: one per Set-Cookie
+// value, and the combined value for any other field.
+func (h Headers) Values(key string) []string {
+	key = strings.ToLower(key)
+	v, ok := h[key]
+	if !ok {
+		return nil
+	}
+	if key == setCookie {
+		return strings.Split(v, "\n")
+	}
+	return []string{v}
+}
+
 func (h Headers) SetNew(key, value string) {
 	key = strings.ToLower(key)
 	h[key] = value
@@ -128,4 +128,14 @@ func TestRequestLineParse(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", headers["set-person"])
 	assert.True(t, done)
+
+	// Set-Cookie values are kept apart
+	headers = NewHeaders()
+	headers.Set("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+	headers.Set("set-cookie", "b=2")
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, headers.Values("Set-Cookie"))
+	headers.Set("Vary", "Accept")
+	headers.Set("Vary", "Origin")
+	assert.Equal(t, []string{"Accept, Origin"}, headers.Values("vary"))
+	assert.Nil(t, headers.Values("missing"))
 }
@@ -0,0 +1,173 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const frameHeaderLen = 9
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+type setting uint16
+
+const (
+	settingHeaderTableSize      setting = 0x1
+	settingEnablePush           setting = 0x2
+	settingMaxConcurrentStreams setting = 0x3
+	settingInitialWindowSize    setting = 0x4
+	settingMaxFrameSize         setting = 0x5
+	settingMaxHeaderListSize    setting = 0x6
+)
+
+// ErrCode is an error code sent in RST_STREAM and GOAWAY frames.
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(c))
+}
+
+// ConnError is a connection error: the connection is ended with a GOAWAY
+// frame carrying Code.
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error: %v: %s", e.Code, e.Reason)
+}
+
+// streamError ends a single stream with RST_STREAM.
+type streamError struct {
+	streamID uint32
+	code     ErrCode
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error: %v", e.streamID, e.code)
+}
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads the next frame, rejecting ones longer than maxSize.
+func readFrame(r io.Reader, maxSize uint32) (frame, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	length := uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+	f := frame{
+		typ:      frameType(hdr[3]),
+		flags:    hdr[4],
+		streamID: binary.BigEndian.Uint32(hdr[5:]) & (1<<31 - 1),
+	}
+	if length > maxSize {
+		return f, ConnError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes exceeds %d", length, maxSize)}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func appendFrame(dst []byte, typ frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID)
+	return append(dst, payload...)
+}
+
+// unpad strips the padding of a DATA or HEADERS frame payload.
+func unpad(f frame) ([]byte, error) {
+	p := f.payload
+	if !f.has(flagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 || int(p[0]) >= len(p) {
+		return nil, ConnError{ErrCodeProtocol, "padding exceeds payload"}
+	}
+	return p[1 : len(p)-int(p[0])], nil
+}
+
+// parseSettings calls set for each parameter in a SETTINGS payload.
+func parseSettings(p []byte, set func(id setting, v uint32) error) error {
+	if len(p)%6 != 0 {
+		return ConnError{ErrCodeFrameSize, "SETTINGS length not a multiple of 6"}
+	}
+	for ; len(p) > 0; p = p[6:] {
+		if err := set(setting(binary.BigEndian.Uint16(p)), binary.BigEndian.Uint32(p[2:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errCompression is returned for header blocks that can't be decoded. The
+// decoding context is then lost, so it is a connection error.
+var errCompression = errors.New("http2: malformed header block")
+
+type headerField struct {
+	name, value string
+}
+
+// size is the field's size as counted by HPACK and SETTINGS_MAX_HEADER_LIST_SIZE.
+func (f headerField) size() int {
+	return len(f.name) + len(f.value) + 32
+}
+
+// hpackDecoder decodes header blocks (RFC 7541), keeping the dynamic table
+// between them.
+type hpackDecoder struct {
+	dynamic []headerField // newest first
+	size    int
+	maxSize int
+	// limit is the table size advertised with SETTINGS_HEADER_TABLE_SIZE,
+	// which size updates may not exceed.
+	limit int
+}
+
+func newHPACKDecoder(limit int) *hpackDecoder {
+	return &hpackDecoder{maxSize: limit, limit: limit}
+}
+
+// decode calls emit for each field of block in order.
+func (d *hpackDecoder) decode(block []byte, emit func(headerField)) error {
+	first := true
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0:
+			// Indexed field.
+			i, n, err := readInt(block, 7)
+			if err != nil {
+				return err
+			}
+			block = block[n:]
+			f, err := d.at(i)
+			if err != nil {
+				return err
+			}
+			emit(f)
+		case b&0xe0 == 0x20:
+			// Dynamic table size update, only allowed before the first field.
+			size, n, err := readInt(block, 5)
+			if err != nil {
+				return err
+			}
+			block = block[n:]
+			if !first || size > uint64(d.limit) {
+				return fmt.Errorf("%w: table size update to %d", errCompression, size)
+			}
+			d.maxSize = int(size)
+			d.evict()
+			continue
+		default:
+			// Literal field, with incremental indexing (01), without
+			// indexing (0000) or never indexed (0001).
+			prefix := 4
+			if b&0xc0 == 0x40 {
+				prefix = 6
+			}
+			i, n, err := readInt(block, prefix)
+			if err != nil {
+				return err
+			}
+			block = block[n:]
+			var f headerField
+			if i > 0 {
+				named, err := d.at(i)
+				if err != nil {
+					return err
+				}
+				f.name = named.name
+			} else {
+				if f.name, n, err = readString(block); err != nil {
+					return err
+				}
+				block = block[n:]
+			}
+			if f.value, n, err = readString(block); err != nil {
+				return err
+			}
+			block = block[n:]
+			if prefix == 6 {
+				d.add(f)
+			}
+			emit(f)
+		}
+		first = false
+	}
+	return nil
+}
+
+func (d *hpackDecoder) at(i uint64) (headerField, error) {
+	switch {
+	case i == 0:
+		return headerField{}, fmt.Errorf("%w: index 0", errCompression)
+	case i <= uint64(len(staticTable)):
+		return staticTable[i-1], nil
+	case i-uint64(len(staticTable)) <= uint64(len(d.dynamic)):
+		return d.dynamic[i-uint64(len(staticTable))-1], nil
+	}
+	return headerField{}, fmt.Errorf("%w: index %d out of range", errCompression, i)
+}
+
+func (d *hpackDecoder) add(f headerField) {
+	if f.size() > d.maxSize {
+		// A field larger than the table empties it.
+		d.dynamic = d.dynamic[:0]
+		d.size = 0
+		return
+	}
+	d.dynamic = append([]headerField{f}, d.dynamic...)
+	d.size += f.size()
+	d.evict()
+}
+
+func (d *hpackDecoder) evict() {
+	for d.size > d.maxSize {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= last.size()
+	}
+}
+
+// readInt decodes an integer with an n-bit prefix from the start of b,
+// returning it and the number of bytes read.
+func readInt(b []byte, n int) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, fmt.Errorf("%w: truncated integer", errCompression)
+	}
+	max := uint64(1)<<n - 1
+	v := uint64(b[0]) & max
+	if v < max {
+		return v, 1, nil
+	}
+	var shift uint
+	for i := 1; i < len(b); i++ {
+		if shift > 56 {
+			return 0, 0, fmt.Errorf("%w: integer overflow", errCompression)
+		}
+		v += uint64(b[i]&0x7f) << shift
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, fmt.Errorf("%w: truncated integer", errCompression)
+}
+
+func readString(b []byte) (string, int, error) {
+	if len(b) == 0 {
+		return "", 0, fmt.Errorf("%w: truncated string", errCompression)
+	}
+	huffman := b[0]&0x80 != 0
+	length, n, err := readInt(b, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(b)-n) < length {
+		return "", 0, fmt.Errorf("%w: truncated string", errCompression)
+	}
+	s := b[n : n+int(length)]
+	if !huffman {
+		return string(s), n + int(length), nil
+	}
+	decoded, err := huffmanDecode(s)
+	if err != nil {
+		return "", 0, err
+	}
+	return decoded, n + int(length), nil
+}
+
+// appendField encodes f as a literal that is not added to the dynamic
+// table, or as an index if the static table holds it. Not indexing keeps
+// the encoder stateless, so the peer's table size settings don't matter.
+func appendField(dst []byte, f headerField) []byte {
+	nameIndex := 0
+	for i, s := range staticTable {
+		if s.name != f.name {
+			continue
+		}
+		if s.value == f.value {
+			return appendInt(dst, 0x80, 7, uint64(i+1))
+		}
+		if nameIndex == 0 {
+			nameIndex = i + 1
+		}
+	}
+	flag := byte(0x00)
+	if sensitive(f.name) {
+		flag = 0x10
+	}
+	dst = appendInt(dst, flag, 4, uint64(nameIndex))
+	if nameIndex == 0 {
+		dst = appendString(dst, f.name)
+	}
+	return appendString(dst, f.value)
+}
+
+// sensitive reports whether intermediaries must never index a field.
+func sensitive(name string) bool {
+	return name == "authorization" || name == "proxy-authorization" || name == "set-cookie"
+}
+
+func appendInt(dst []byte, flags byte, n int, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(dst, flags|byte(v))
+	}
+	dst = append(dst, flags|byte(max))
+	v -= max
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return huffmanAppend(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// huffmanNode is a node of the Huffman decoding tree. Leaves have no
+// children and hold a symbol.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		n := root
+		for i := int(huffmanCodeLen[sym]) - 1; i >= 0; i-- {
+			bit := code >> i & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = byte(sym)
+	}
+	return root
+}
+
+func huffmanDecode(b []byte) (string, error) {
+	var sb strings.Builder
+	n := huffmanRoot
+	// depth and ones track the bits read since the last symbol, which must
+	// be fewer than 8 and all ones: a prefix of EOS used as padding.
+	depth, ones := 0, true
+	for _, c := range b {
+		for i := 7; i >= 0; i-- {
+			bit := c >> i & 1
+			n = n.children[bit]
+			if n == nil {
+				// Only EOS, which may not appear, leads out of the tree.
+				return "", fmt.Errorf("%w: invalid Huffman code", errCompression)
+			}
+			depth++
+			ones = ones && bit == 1
+			if n.children[0] == nil && n.children[1] == nil {
+				sb.WriteByte(n.sym)
+				n, depth, ones = huffmanRoot, 0, true
+			}
+		}
+	}
+	if depth >= 8 || !ones {
+		return "", fmt.Errorf("%w: invalid Huffman padding", errCompression)
+	}
+	return sb.String(), nil
+}
+
+func huffmanLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+func huffmanAppend(dst []byte, s string) []byte {
+	var acc uint64
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		n := int(huffmanCodeLen[s[i]])
+		acc = acc<<n | uint64(huffmanCodes[s[i]])
+		bits += n
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+	if bits > 0 {
+		// Pad with the most significant bits of EOS, all ones.
+		dst = append(dst, byte(acc<<(8-bits))|byte(0xff>>bits))
+	}
+	return dst
+}
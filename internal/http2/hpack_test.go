@@ -0,0 +1,99 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestHPACKDecodeRFCExamples(t *testing.T) {
+	// RFC 7541, Appendix C.4: requests with Huffman coding, sharing the
+	// dynamic table.
+	d := newHPACKDecoder(headerTableSize)
+	blocks := []struct {
+		hex  string
+		want []headerField
+	}{
+		{"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", []headerField{
+			{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+		}},
+		{"8286 84be 5886 a8eb 1064 9cbf", []headerField{
+			{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+			{"cache-control", "no-cache"},
+		}},
+		{"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", []headerField{
+			{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"},
+			{"custom-key", "custom-value"},
+		}},
+	}
+	for i, b := range blocks {
+		var got []headerField
+		require.NoError(t, d.decode(decodeHex(t, b.hex), func(f headerField) { got = append(got, f) }), i)
+		assert.Equal(t, b.want, got, i)
+	}
+	assert.Equal(t, []headerField{
+		{"custom-key", "custom-value"}, {"cache-control", "no-cache"}, {":authority", "www.example.com"},
+	}, d.dynamic)
+	assert.Equal(t, 164, d.size)
+
+	// Test: Shrinking the table evicts the oldest entries
+	require.NoError(t, d.decode([]byte{0x3f, 0x20}, func(headerField) {}))
+	assert.Equal(t, []headerField{{"custom-key", "custom-value"}}, d.dynamic)
+}
+
+func TestHPACKDecodeErrors(t *testing.T) {
+	cases := map[string]string{
+		"index 0":                 "80",
+		"index out of range":      "ff 00",
+		"truncated string":        "00 03 61",
+		"size update too large":   "3f e2 1f",
+		"size update after field": "82 20",
+		"EOS in string":           "00 01 61 84 ff ff ff ff",
+		"long padding":            "00 01 61 81 ff",
+		"integer overflow":        "ff ff ff ff ff ff ff ff ff ff ff 01",
+	}
+	for name, h := range cases {
+		d := newHPACKDecoder(headerTableSize)
+		err := d.decode(decodeHex(t, h), func(headerField) {})
+		assert.ErrorIs(t, err, errCompression, name)
+	}
+}
+
+func TestHPACKRoundTrip(t *testing.T) {
+	fields := []headerField{
+		{":status", "200"},
+		{":status", "418"},
+		{"content-type", "text/plain; charset=utf-8"},
+		{"x-custom", strings.Repeat("ä€", 100)},
+		{"set-cookie", "a=b"},
+		{"x-empty", ""},
+	}
+	var block []byte
+	for _, f := range fields {
+		block = appendField(block, f)
+	}
+	assert.Equal(t, byte(0x88), block[0], ":status 200 is in the static table")
+
+	d := newHPACKDecoder(headerTableSize)
+	var got []headerField
+	require.NoError(t, d.decode(block, func(f headerField) { got = append(got, f) }))
+	assert.Equal(t, fields, got)
+	assert.Empty(t, d.dynamic, "the encoder doesn't index")
+
+	for i := range 256 {
+		s := strings.Repeat(string(rune(i)), 3)
+		decoded, err := huffmanDecode(huffmanAppend(nil, s))
+		require.NoError(t, err)
+		assert.Equal(t, s, decoded)
+	}
+}
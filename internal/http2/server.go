@@ -0,0 +1,883 @@
+// Package http2 serves HTTP/2 over cleartext TCP (h2c, RFC 9113), entered
+// with prior knowledge or by upgrading an HTTP/1.1 request. Each stream is
+// handed to the handler as an ordinary request and response.Writer.
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+)
+
+// Preface is the connection preface a client sends first.
+const Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// DefaultMaxConcurrentStreams is advertised when
+// Config.MaxConcurrentStreams is 0.
+const DefaultMaxConcurrentStreams = 100
+
+const (
+	initialWindowSize = 65535
+	maxWindowSize     = 1<<31 - 1
+	minMaxFrameSize   = 1 << 14
+	maxMaxFrameSize   = 1<<24 - 1
+	headerTableSize   = 4096
+	// maxHeaderBlock bounds an encoded header block when MaxHeaderBytes
+	// is not set, since it has to be held until its last frame arrives.
+	maxHeaderBlock = 1 << 20
+)
+
+// errStreamClosed is returned by writes to a stream that was reset or whose
+// connection is gone.
+var errStreamClosed = errors.New("http2: stream closed")
+
+// Config is what ServeConn needs to serve a connection.
+type Config struct {
+	// Handler serves the request of each stream, on its own goroutine. It
+	// reports whether the response is complete; if not, e.g. because the
+	// handler panicked after sending headers, the stream is reset instead
+	// of ended.
+	Handler func(w *response.Writer, req *request.Request) bool
+	// ErrorHandler answers requests refused with request.ErrHeaderTooLarge
+	// or request.ErrBodyTooLarge.
+	ErrorHandler func(w *response.Writer, req *request.Request, err error)
+
+	MaxHeaderBytes       int
+	MaxBodyBytes         int64
+	MaxConcurrentStreams uint32
+
+	// IdleTimeout closes the connection once it has had no open streams
+	// for that long. WriteTimeout bounds writing each frame.
+	// HandlerTimeout, if set, bounds each request's context.
+	IdleTimeout    time.Duration
+	WriteTimeout   time.Duration
+	HandlerTimeout time.Duration
+
+	// Context is the parent of the requests' contexts. When it is done the
+	// connection is closed after a GOAWAY frame.
+	Context context.Context
+	// ConnID is copied to every request.
+	ConnID uint64
+}
+
+// IsUpgrade reports whether req asks to switch to h2c with a valid
+// HTTP2-Settings header.
+func IsUpgrade(req *request.Request) bool {
+	if !hasToken(req.Headers.Get("Upgrade"), "h2c") {
+		return false
+	}
+	conn := req.Headers.Get("Connection")
+	if !hasToken(conn, "upgrade") || !hasToken(conn, "http2-settings") {
+		return false
+	}
+	_, err := upgradeSettings(req)
+	return err == nil
+}
+
+func upgradeSettings(req *request.Request) ([]byte, error) {
+	v, ok := req.Headers["http2-settings"]
+	if !ok {
+		return nil, fmt.Errorf("http2: no HTTP2-Settings header")
+	}
+	if strings.Contains(v, ",") {
+		return nil, fmt.Errorf("http2: more than one HTTP2-Settings header")
+	}
+	p, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return nil, fmt.Errorf("http2: malformed HTTP2-Settings: %w", err)
+	}
+	if len(p)%6 != 0 {
+		return nil, fmt.Errorf("http2: malformed HTTP2-Settings")
+	}
+	return p, nil
+}
+
+// ServeConn serves HTTP/2 on c until the client or cfg.Context ends it,
+// then closes c and waits for the handlers to return. c must deliver the
+// client's connection preface first. If upgrade is set, it is the HTTP/1.1
+// request that switched the connection to h2c, after the 101 response was
+// sent; it is served as stream 1.
+func ServeConn(c net.Conn, cfg Config, upgrade *request.Request) error {
+	if cfg.MaxConcurrentStreams == 0 {
+		cfg.MaxConcurrentStreams = DefaultMaxConcurrentStreams
+	}
+	if cfg.Context == nil {
+		cfg.Context = context.Background()
+	}
+	ctx, cancel := context.WithCancel(cfg.Context)
+	sc := &serverConn{
+		c:                 c,
+		cfg:               cfg,
+		br:                bufio.NewReader(c),
+		bw:                bufio.NewWriter(c),
+		ctx:               ctx,
+		cancel:            cancel,
+		dec:               newHPACKDecoder(headerTableSize),
+		streams:           make(map[uint32]*stream),
+		sendWindow:        initialWindowSize,
+		peerInitialWindow: initialWindowSize,
+		peerMaxFrameSize:  minMaxFrameSize,
+		recvWindow:        initialWindowSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc.serve(upgrade)
+}
+
+type serverConn struct {
+	c      net.Conn
+	cfg    Config
+	br     *bufio.Reader
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// wmu serializes frame writes, so header blocks are never interleaved.
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	// mu guards the fields below and the send state of the streams. cond
+	// is signalled when send windows grow or streams close.
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	closed            bool
+
+	// Used by the read loop only.
+	dec        *hpackDecoder
+	recvWindow int64
+	seq        int
+	// headerBlock collects a header block continued in CONTINUATION frames.
+	headerBlock *headerBlock
+}
+
+type headerBlock struct {
+	streamID  uint32
+	endStream bool
+	buf       []byte
+}
+
+type stream struct {
+	id     uint32
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Used by the read loop only.
+	req        *request.Request
+	body       []byte
+	recvWindow int64
+	declared   int64 // Content-Length, or -1
+	dispatched bool
+
+	// Guarded by serverConn.mu.
+	sendWindow   int64
+	remoteClosed bool
+	localClosed  bool
+	reset        bool
+}
+
+func (sc *serverConn) serve(upgrade *request.Request) error {
+	defer func() {
+		sc.mu.Lock()
+		sc.closed = true
+		sc.cond.Broadcast()
+		sc.mu.Unlock()
+		sc.cancel()
+		sc.c.Close()
+		sc.wg.Wait()
+	}()
+	stop := context.AfterFunc(sc.cfg.Context, func() {
+		sc.goAway(ErrCodeNo)
+		sc.c.Close()
+	})
+	defer stop()
+	sc.c.SetDeadline(time.Time{})
+
+	settings := []byte{}
+	settings = appendSetting(settings, settingMaxConcurrentStreams, sc.cfg.MaxConcurrentStreams)
+	if sc.cfg.MaxHeaderBytes > 0 {
+		settings = appendSetting(settings, settingMaxHeaderListSize, uint32(sc.cfg.MaxHeaderBytes))
+	}
+	if err := sc.writeFrame(frameSettings, 0, 0, settings); err != nil {
+		return err
+	}
+	if upgrade != nil {
+		if err := sc.startUpgrade(upgrade); err != nil {
+			return sc.fail(err)
+		}
+	}
+
+	preface := make([]byte, len(Preface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil {
+		return err
+	}
+	if string(preface) != Preface {
+		return sc.fail(ConnError{ErrCodeProtocol, "invalid connection preface"})
+	}
+	sc.updateIdle()
+
+	first := true
+	for {
+		f, err := readFrame(sc.br, minMaxFrameSize)
+		if err != nil {
+			if sc.ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && sc.idle() {
+				sc.goAway(ErrCodeNo)
+				return nil
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return sc.fail(err)
+		}
+		if first && f.typ != frameSettings {
+			return sc.fail(ConnError{ErrCodeProtocol, "connection preface without SETTINGS"})
+		}
+		first = false
+		if err := sc.processFrame(f); err != nil {
+			var se streamError
+			if errors.As(err, &se) {
+				sc.resetStream(se.streamID, se.code)
+				continue
+			}
+			return sc.fail(err)
+		}
+	}
+}
+
+// fail ends the connection after err, telling the client why if it is a
+// connection error.
+func (sc *serverConn) fail(err error) error {
+	var ce ConnError
+	if errors.As(err, &ce) {
+		sc.goAway(ce.Code)
+	}
+	return err
+}
+
+func (sc *serverConn) processFrame(f frame) error {
+	if hb := sc.headerBlock; hb != nil {
+		if f.typ != frameContinuation || f.streamID != hb.streamID {
+			return ConnError{ErrCodeProtocol, "expected CONTINUATION"}
+		}
+	}
+
+	switch f.typ {
+	case frameData:
+		return sc.processData(f)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case framePriority:
+		if f.streamID == 0 {
+			return ConnError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return streamError{f.streamID, ErrCodeFrameSize}
+		}
+		// Prioritization is deprecated; streams are served as they come.
+		return nil
+	case frameRSTStream:
+		return sc.processRSTStream(f)
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePushPromise:
+		return ConnError{ErrCodeProtocol, "PUSH_PROMISE from client"}
+	case framePing:
+		if f.streamID != 0 {
+			return ConnError{ErrCodeProtocol, "PING on a stream"}
+		}
+		if len(f.payload) != 8 {
+			return ConnError{ErrCodeFrameSize, "PING length"}
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return ConnError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		// The client opens no more streams; those open are finished and
+		// the client closes the connection.
+		return nil
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case frameContinuation:
+		return sc.processContinuation(f)
+	}
+	// Unknown frame types are ignored.
+	return nil
+}
+
+func (sc *serverConn) processData(f frame) error {
+	if f.streamID == 0 {
+		return ConnError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	// The whole frame counts against flow control, padding included, and
+	// is credited back at once since bodies are buffered in full.
+	n := int64(len(f.payload))
+	if sc.recvWindow -= n; sc.recvWindow < 0 {
+		return ConnError{ErrCodeFlowControl, "connection window exceeded"}
+	}
+	if n > 0 {
+		if err := sc.windowUpdate(0, uint32(n)); err != nil {
+			return err
+		}
+		sc.recvWindow += n
+	}
+	data, err := unpad(f)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	remoteClosed := st != nil && st.remoteClosed
+	sc.mu.Unlock()
+	if st == nil {
+		if f.streamID > sc.lastID() {
+			return ConnError{ErrCodeProtocol, "DATA on idle stream"}
+		}
+		return streamError{f.streamID, ErrCodeStreamClosed}
+	}
+	if remoteClosed {
+		return streamError{f.streamID, ErrCodeStreamClosed}
+	}
+	if st.recvWindow -= n; st.recvWindow < 0 {
+		return streamError{f.streamID, ErrCodeFlowControl}
+	}
+
+	if !st.dispatched {
+		if max := sc.cfg.MaxBodyBytes; max > 0 && int64(len(st.body)+len(data)) > max {
+			sc.dispatch(st, request.ErrBodyTooLarge)
+		} else {
+			st.body = append(st.body, data...)
+		}
+	}
+	if f.has(flagEndStream) {
+		return sc.endRemote(st)
+	}
+	if n > 0 && !st.dispatched {
+		if err := sc.windowUpdate(st.id, uint32(n)); err != nil {
+			return err
+		}
+		st.recvWindow += n
+	}
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f frame) error {
+	if f.streamID == 0 || f.streamID%2 == 0 {
+		return ConnError{ErrCodeProtocol, fmt.Sprintf("HEADERS on stream %d", f.streamID)}
+	}
+	p, err := unpad(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagPriority) {
+		if len(p) < 5 {
+			return ConnError{ErrCodeFrameSize, "HEADERS priority"}
+		}
+		p = p[5:]
+	}
+	hb := &headerBlock{streamID: f.streamID, endStream: f.has(flagEndStream), buf: p}
+	if !f.has(flagEndHeaders) {
+		sc.headerBlock = hb
+		return nil
+	}
+	return sc.processHeaderBlock(hb)
+}
+
+func (sc *serverConn) processContinuation(f frame) error {
+	hb := sc.headerBlock
+	if hb == nil {
+		return ConnError{ErrCodeProtocol, "CONTINUATION without HEADERS"}
+	}
+	limit := maxHeaderBlock
+	if sc.cfg.MaxHeaderBytes > 0 {
+		limit = 2 * sc.cfg.MaxHeaderBytes
+	}
+	if len(hb.buf)+len(f.payload) > limit {
+		return ConnError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	hb.buf = append(hb.buf, f.payload...)
+	if !f.has(flagEndHeaders) {
+		return nil
+	}
+	sc.headerBlock = nil
+	return sc.processHeaderBlock(hb)
+}
+
+func (sc *serverConn) processHeaderBlock(hb *headerBlock) error {
+	receivedAt := time.Now()
+	var fields []headerField
+	listSize := 0
+	err := sc.dec.decode(hb.buf, func(f headerField) {
+		fields = append(fields, f)
+		listSize += f.size()
+	})
+	if err != nil {
+		return ConnError{ErrCodeCompression, err.Error()}
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[hb.streamID]
+	open := len(sc.streams)
+	lastID := sc.lastStreamID
+	sc.mu.Unlock()
+
+	if st != nil {
+		// Trailers, which must end the stream. Their fields aren't passed
+		// on: requests have nowhere to keep them.
+		if st.remoteClosed {
+			return streamError{st.id, ErrCodeStreamClosed}
+		}
+		if !hb.endStream {
+			return streamError{st.id, ErrCodeProtocol}
+		}
+		for _, f := range fields {
+			if strings.HasPrefix(f.name, ":") {
+				return streamError{st.id, ErrCodeProtocol}
+			}
+		}
+		return sc.endRemote(st)
+	}
+	if hb.streamID <= lastID {
+		return ConnError{ErrCodeStreamClosed, fmt.Sprintf("HEADERS on closed stream %d", hb.streamID)}
+	}
+
+	sc.mu.Lock()
+	sc.lastStreamID = hb.streamID
+	sc.mu.Unlock()
+	if uint32(open) >= sc.cfg.MaxConcurrentStreams {
+		return streamError{hb.streamID, ErrCodeRefusedStream}
+	}
+	req, err := newRequest(fields)
+	if err != nil {
+		return streamError{hb.streamID, ErrCodeProtocol}
+	}
+	sc.seq++
+	req.RemoteAddr = sc.c.RemoteAddr()
+	req.LocalAddr = sc.c.LocalAddr()
+	req.ConnID = sc.cfg.ConnID
+	req.Sequence = sc.seq
+	req.ReceivedAt = receivedAt
+
+	st = sc.openStream(hb.streamID, req)
+	switch {
+	case sc.cfg.MaxHeaderBytes > 0 && listSize > sc.cfg.MaxHeaderBytes:
+		sc.dispatch(st, request.ErrHeaderTooLarge)
+	case sc.cfg.MaxBodyBytes > 0 && st.declared > sc.cfg.MaxBodyBytes:
+		sc.dispatch(st, request.ErrBodyTooLarge)
+	}
+	if hb.endStream {
+		return sc.endRemote(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f frame) error {
+	if f.streamID == 0 {
+		return ConnError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "RST_STREAM length"}
+	}
+	if f.streamID > sc.lastID() {
+		return ConnError{ErrCodeProtocol, "RST_STREAM on idle stream"}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st := sc.streams[f.streamID]; st != nil {
+		sc.closeStreamLocked(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processSettings(f frame) error {
+	if f.streamID != 0 {
+		return ConnError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return ConnError{ErrCodeFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	if err := sc.applySettings(f.payload); err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+// applySettings applies the client's settings. Only those affecting what
+// the server sends matter; the header table size can be ignored because
+// the encoder doesn't use the dynamic table.
+func (sc *serverConn) applySettings(p []byte) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return parseSettings(p, func(id setting, v uint32) error {
+		switch id {
+		case settingEnablePush:
+			if v > 1 {
+				return ConnError{ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case settingInitialWindowSize:
+			if v > maxWindowSize {
+				return ConnError{ErrCodeFlowControl, "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+			delta := int64(v) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				if st.sendWindow += delta; st.sendWindow > maxWindowSize {
+					return ConnError{ErrCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.peerInitialWindow = int64(v)
+			sc.cond.Broadcast()
+		case settingMaxFrameSize:
+			if v < minMaxFrameSize || v > maxMaxFrameSize {
+				return ConnError{ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			sc.peerMaxFrameSize = v
+		}
+		return nil
+	})
+}
+
+func (sc *serverConn) processWindowUpdate(f frame) error {
+	if len(f.payload) != 4 {
+		return ConnError{ErrCodeFrameSize, "WINDOW_UPDATE length"}
+	}
+	incr := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+	if f.streamID == 0 {
+		if incr == 0 {
+			return ConnError{ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+		}
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		if sc.sendWindow += incr; sc.sendWindow > maxWindowSize {
+			return ConnError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	if f.streamID > sc.lastID() {
+		return ConnError{ErrCodeProtocol, "WINDOW_UPDATE on idle stream"}
+	}
+	if incr == 0 {
+		return streamError{f.streamID, ErrCodeProtocol}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := sc.streams[f.streamID]
+	if st == nil {
+		// Updates may cross the end of the stream.
+		return nil
+	}
+	if st.sendWindow += incr; st.sendWindow > maxWindowSize {
+		return streamError{f.streamID, ErrCodeFlowControl}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// startUpgrade opens stream 1 for the request that switched the connection
+// to h2c. Its body has been read already, so the stream is half-closed.
+func (sc *serverConn) startUpgrade(req *request.Request) error {
+	settings, err := upgradeSettings(req)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	for _, name := range []string{"Connection", "Upgrade", "HTTP2-Settings", "Keep-Alive", "Proxy-Connection", "TE", "Transfer-Encoding"} {
+		req.Headers.Del(name)
+	}
+	req.RequestLine.HttpVersion = "2.0"
+	sc.seq = req.Sequence
+
+	sc.mu.Lock()
+	sc.lastStreamID = 1
+	sc.mu.Unlock()
+	st := sc.openStream(1, req)
+	st.body = req.Body
+	return sc.endRemote(st)
+}
+
+func (sc *serverConn) openStream(id uint32, req *request.Request) *stream {
+	st := &stream{
+		id:         id,
+		req:        req,
+		recvWindow: initialWindowSize,
+		declared:   -1,
+	}
+	if cl := req.Headers.Get("Content-Length"); cl != "" {
+		fmt.Sscan(cl, &st.declared)
+	}
+	if sc.cfg.HandlerTimeout > 0 {
+		st.ctx, st.cancel = context.WithTimeout(sc.ctx, sc.cfg.HandlerTimeout)
+	} else {
+		st.ctx, st.cancel = context.WithCancel(sc.ctx)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	sc.c.SetReadDeadline(time.Time{})
+	return st
+}
+
+// endRemote handles the end of the client's side of st, dispatching its
+// request once the whole body is in.
+func (sc *serverConn) endRemote(st *stream) error {
+	sc.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	if done {
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+	if st.dispatched {
+		return nil
+	}
+	if st.declared >= 0 && st.declared != int64(len(st.body)) {
+		return streamError{st.id, ErrCodeProtocol}
+	}
+	sc.dispatch(st, nil)
+	return nil
+}
+
+// dispatch runs the handler for st, or the error handler if err is set.
+func (sc *serverConn) dispatch(st *stream, err error) {
+	st.dispatched = true
+	req := st.req
+	if err == nil {
+		req.Body = st.body
+		if len(req.Body) > 0 && req.Headers.Get("Content-Length") == "" {
+			req.Headers.Set("Content-Length", fmt.Sprint(len(req.Body)))
+		}
+	}
+	req.ReadAt = time.Now()
+	req = req.WithContext(st.ctx)
+	st.req, st.body = nil, nil
+
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		t := &streamTransport{sc: sc, st: st, head: req.RequestLine.Method == "HEAD"}
+		w := response.NewTransportWriter(t)
+		ok := true
+		if err != nil {
+			sc.cfg.ErrorHandler(w, req, err)
+		} else {
+			ok = sc.cfg.Handler(w, req)
+		}
+		if !ok {
+			// Ending the stream would pass a broken response off as
+			// complete.
+			sc.resetOpenStream(st, ErrCodeInternal)
+			return
+		}
+		w.Close()
+		if !w.HeadersWritten() {
+			// There is no response to send; tell the client so.
+			sc.resetOpenStream(st, ErrCodeInternal)
+		}
+	}()
+}
+
+// resetStream ends a stream with RST_STREAM.
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	st := sc.streams[id]
+	if st != nil {
+		if st.reset || st.localClosed && st.remoteClosed {
+			sc.mu.Unlock()
+			return
+		}
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+// resetOpenStream resets st unless it is closed already.
+func (sc *serverConn) resetOpenStream(st *stream, code ErrCode) {
+	sc.mu.Lock()
+	open := sc.streams[st.id] == st
+	sc.mu.Unlock()
+	if open {
+		sc.resetStream(st.id, code)
+	}
+}
+
+// closeStreamLocked forgets st, failing pending writes and cancelling its
+// context. sc.mu must be held.
+func (sc *serverConn) closeStreamLocked(st *stream) {
+	st.reset = !(st.localClosed && st.remoteClosed)
+	delete(sc.streams, st.id)
+	st.cancel()
+	sc.cond.Broadcast()
+	if len(sc.streams) == 0 && sc.cfg.IdleTimeout > 0 {
+		sc.c.SetReadDeadline(time.Now().Add(sc.cfg.IdleTimeout))
+	}
+}
+
+// updateIdle starts the idle timeout if no stream is open.
+func (sc *serverConn) updateIdle() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if len(sc.streams) == 0 && sc.cfg.IdleTimeout > 0 {
+		sc.c.SetReadDeadline(time.Now().Add(sc.cfg.IdleTimeout))
+	}
+}
+
+func (sc *serverConn) idle() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.streams) == 0
+}
+
+func (sc *serverConn) lastID() uint32 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.lastStreamID
+}
+
+func (sc *serverConn) goAway(code ErrCode) {
+	p := binary.BigEndian.AppendUint32(nil, sc.lastID())
+	p = binary.BigEndian.AppendUint32(p, uint32(code))
+	sc.writeFrame(frameGoAway, 0, 0, p)
+}
+
+func (sc *serverConn) windowUpdate(id uint32, n uint32) error {
+	return sc.writeFrame(frameWindowUpdate, 0, id, binary.BigEndian.AppendUint32(nil, n))
+}
+
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, id uint32, payload []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	return sc.writeFramesLocked(appendFrame(nil, typ, flags, id, payload))
+}
+
+func (sc *serverConn) writeFramesLocked(b []byte) error {
+	if sc.cfg.WriteTimeout > 0 {
+		sc.c.SetWriteDeadline(time.Now().Add(sc.cfg.WriteTimeout))
+	}
+	if _, err := sc.bw.Write(b); err != nil {
+		return err
+	}
+	if err := sc.bw.Flush(); err != nil {
+		// A half-written frame leaves the connection unusable.
+		sc.c.Close()
+		return err
+	}
+	return nil
+}
+
+// writeHeaders sends a header block in a HEADERS frame and as many
+// CONTINUATION frames as the peer's frame size requires.
+func (sc *serverConn) writeHeaders(st *stream, fields []headerField, endStream bool) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	sc.mu.Lock()
+	reset, maxFrame := st.reset || sc.closed, int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+	if reset {
+		return errStreamClosed
+	}
+
+	var block []byte
+	for _, f := range fields {
+		block = appendField(block, f)
+	}
+	var out []byte
+	typ, flags := frameHeaders, uint8(0)
+	if endStream {
+		flags = flagEndStream
+	}
+	for {
+		chunk := block[:min(len(block), maxFrame)]
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= flagEndHeaders
+		}
+		out = appendFrame(out, typ, flags, st.id, chunk)
+		if len(block) == 0 {
+			break
+		}
+		typ, flags = frameContinuation, 0
+	}
+	return sc.writeFramesLocked(out)
+}
+
+// reserve waits until st may send up to n bytes of DATA and takes them
+// from the flow control windows, returning how many it took.
+func (sc *serverConn) reserve(st *stream, n int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if st.reset || sc.closed {
+			return 0, errStreamClosed
+		}
+		avail := min(int64(n), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize))
+		if avail > 0 {
+			st.sendWindow -= avail
+			sc.sendWindow -= avail
+			return int(avail), nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+// endLocal marks the server's side of st finished. A client still sending
+// a body nobody will read is told to stop.
+func (sc *serverConn) endLocal(st *stream) {
+	sc.mu.Lock()
+	st.localClosed = true
+	remoteClosed := st.remoteClosed
+	if remoteClosed {
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+	if !remoteClosed {
+		sc.resetOpenStream(st, ErrCodeNo)
+	}
+}
+
+func appendSetting(dst []byte, id setting, v uint32) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(id))
+	return binary.BigEndian.AppendUint32(dst, v)
+}
+
+// hasToken reports whether the comma-separated header value v contains
+// token, ignoring case.
+func hasToken(v, token string) bool {
+	for t := range strings.SplitSeq(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,465 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves HTTP/2 with cfg on every connection to the returned
+// address.
+func startServer(t *testing.T, cfg Config) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg.Context = ctx
+	if cfg.ErrorHandler == nil {
+		cfg.ErrorHandler = func(w *response.Writer, req *request.Request, err error) {
+			code := response.StatusBadRequest
+			switch err {
+			case request.ErrHeaderTooLarge:
+				code = response.StatusRequestHeaderFieldsTooLarge
+			case request.ErrBodyTooLarge:
+				code = response.StatusRequestEntityTooLarge
+			}
+			w.WriteStatusLine(code)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		}
+	}
+	var wg sync.WaitGroup
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ServeConn(c, cfg, nil)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		cancel()
+		wg.Wait()
+	})
+	return l.Addr().String()
+}
+
+func newClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{
+		Transport: &http.Transport{Protocols: &protocols},
+		Timeout:   10 * time.Second,
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	addr := startServer(t, Config{Handler: func(w *response.Writer, req *request.Request) bool {
+		h := headers.NewHeaders()
+		switch req.Path() {
+		case "/echo":
+			h.Set("Content-Type", "application/octet-stream")
+			h.Set("Content-Length", fmt.Sprint(len(req.Body)))
+			h.Set("X-Method", req.RequestLine.Method)
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(h)
+			w.WriteBody(req.Body)
+		case "/stream":
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Sum")
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(h)
+			for range 3 {
+				w.WriteChunkedBody(bytes.Repeat([]byte("x"), 100000))
+			}
+			w.WriteChunkedBodyDone(headers.Headers{"x-sum": "300000"})
+		default:
+			body := []byte(req.RequestLine.HttpVersion + " " + req.Headers.Get("Host") + " " + req.Headers.Get("Cookie"))
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody(body)
+		}
+		return true
+	}})
+	client := newClient()
+	base := "http://" + addr
+
+	req, _ := http.NewRequest("GET", base+"/", nil)
+	req.AddCookie(&http.Cookie{Name: "a", Value: "1"})
+	req.AddCookie(&http.Cookie{Name: "b", Value: "2"})
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "2.0 "+addr+" a=1; b=2", string(body))
+
+	// Test: Bodies larger than the flow control windows, both ways, on
+	// concurrent streams
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload := bytes.Repeat([]byte{byte(i)}, 300000+i)
+			resp, err := client.Post(base+"/echo", "application/octet-stream", bytes.NewReader(payload))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, payload, got)
+			assert.Equal(t, "POST", resp.Header.Get("X-Method"))
+		}()
+	}
+	wg.Wait()
+
+	resp, err = client.Get(base + "/stream")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Len(t, body, 300000)
+	assert.Empty(t, resp.Header.Get("Transfer-Encoding"))
+	assert.Equal(t, "300000", resp.Trailer.Get("X-Sum"))
+
+	resp, err = client.Head(base + "/echo")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "HEAD", resp.Header.Get("X-Method"))
+}
+
+// testConn is a raw HTTP/2 client connection.
+type testConn struct {
+	t   *testing.T
+	c   net.Conn
+	dec *hpackDecoder
+}
+
+func dialRaw(t *testing.T, addr string) *testConn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	tc := &testConn{t: t, c: c, dec: newHPACKDecoder(headerTableSize)}
+	_, err = io.WriteString(c, Preface)
+	require.NoError(t, err)
+	tc.write(frameSettings, 0, 0, nil)
+
+	f := tc.read()
+	require.Equal(t, frameSettings, f.typ)
+	f = tc.read()
+	require.Equal(t, frameSettings, f.typ)
+	require.True(t, f.has(flagAck))
+	return tc
+}
+
+func (tc *testConn) write(typ frameType, flags uint8, id uint32, payload []byte) {
+	tc.t.Helper()
+	_, err := tc.c.Write(appendFrame(nil, typ, flags, id, payload))
+	require.NoError(tc.t, err)
+}
+
+// read returns the next frame other than WINDOW_UPDATE.
+func (tc *testConn) read() frame {
+	tc.t.Helper()
+	for {
+		f, err := readFrame(tc.c, maxMaxFrameSize)
+		require.NoError(tc.t, err)
+		if f.typ != frameWindowUpdate {
+			return f
+		}
+	}
+}
+
+func (tc *testConn) request(id uint32, endStream bool, fields ...headerField) {
+	tc.t.Helper()
+	block := appendField(nil, headerField{":method", "GET"})
+	block = appendField(block, headerField{":scheme", "http"})
+	block = appendField(block, headerField{":path", "/"})
+	for _, f := range fields {
+		block = appendField(block, f)
+	}
+	flags := uint8(flagEndHeaders)
+	if endStream {
+		flags |= flagEndStream
+	}
+	tc.write(frameHeaders, flags, id, block)
+}
+
+// status reads a HEADERS frame and returns its :status.
+func (tc *testConn) status() (uint32, string) {
+	tc.t.Helper()
+	f := tc.read()
+	require.Equal(tc.t, frameHeaders, f.typ, "frame %+v", f)
+	var status string
+	require.NoError(tc.t, tc.dec.decode(f.payload, func(hf headerField) {
+		if hf.name == ":status" {
+			status = hf.value
+		}
+	}))
+	return f.streamID, status
+}
+
+// expectGoAway reads frames until a GOAWAY and returns its error code.
+func (tc *testConn) expectGoAway() ErrCode {
+	tc.t.Helper()
+	for {
+		f := tc.read()
+		if f.typ == frameGoAway {
+			return ErrCode(binary.BigEndian.Uint32(f.payload[4:]))
+		}
+	}
+}
+
+func (tc *testConn) expectReset(id uint32) ErrCode {
+	tc.t.Helper()
+	f := tc.read()
+	require.Equal(tc.t, frameRSTStream, f.typ, "frame %+v", f)
+	require.Equal(tc.t, id, f.streamID)
+	return ErrCode(binary.BigEndian.Uint32(f.payload))
+}
+
+func okHandler(w *response.Writer, req *request.Request) bool {
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+	return true
+}
+
+func TestConnectionErrors(t *testing.T) {
+	addr := startServer(t, Config{Handler: okHandler})
+	cases := []struct {
+		name string
+		send func(tc *testConn)
+		code ErrCode
+	}{
+		{"DATA on idle stream", func(tc *testConn) { tc.write(frameData, 0, 1, []byte("x")) }, ErrCodeProtocol},
+		{"HEADERS on even stream", func(tc *testConn) { tc.request(2, true) }, ErrCodeProtocol},
+		{"stream IDs going down", func(tc *testConn) {
+			tc.request(5, true)
+			tc.status()
+			tc.read()
+			tc.request(3, true)
+		}, ErrCodeStreamClosed},
+		{"interrupted header block", func(tc *testConn) {
+			tc.write(frameHeaders, 0, 1, appendField(nil, headerField{":method", "GET"}))
+			tc.write(framePing, 0, 0, make([]byte, 8))
+		}, ErrCodeProtocol},
+		{"bad header block", func(tc *testConn) { tc.write(frameHeaders, flagEndHeaders, 1, []byte{0x80}) }, ErrCodeCompression},
+		{"oversized frame", func(tc *testConn) { tc.write(frameData, 0, 1, make([]byte, minMaxFrameSize+1)) }, ErrCodeFrameSize},
+		{"bad SETTINGS", func(tc *testConn) {
+			tc.write(frameSettings, 0, 0, appendSetting(nil, settingInitialWindowSize, 1<<31))
+		}, ErrCodeFlowControl},
+		{"PUSH_PROMISE", func(tc *testConn) { tc.write(framePushPromise, flagEndHeaders, 1, make([]byte, 4)) }, ErrCodeProtocol},
+		{"window overflow", func(tc *testConn) {
+			tc.write(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+		}, ErrCodeFlowControl},
+	}
+	for _, c := range cases {
+		tc := dialRaw(t, addr)
+		c.send(tc)
+		assert.Equal(t, c.code, tc.expectGoAway(), c.name)
+	}
+
+	// Test: A bad preface gets a GOAWAY before anything else is read
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\nxxxxxxx")
+	tc := &testConn{t: t, c: conn}
+	assert.Equal(t, ErrCodeProtocol, tc.expectGoAway())
+}
+
+func TestStreams(t *testing.T) {
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	addr := startServer(t, Config{
+		MaxConcurrentStreams: 1,
+		MaxHeaderBytes:       200,
+		MaxBodyBytes:         10,
+		Handler: func(w *response.Writer, req *request.Request) bool {
+			switch req.Path() {
+			case "/block":
+				select {
+				case <-release:
+				case <-req.Context().Done():
+					close(cancelled)
+					return true
+				}
+			case "/silent":
+				return true
+			case "/broken":
+				w.WriteStatusLine(response.StatusOK)
+				w.WriteHeaders(headers.NewHeaders())
+				w.Write([]byte("part"))
+				return false
+			}
+			return okHandler(w, req)
+		},
+	})
+
+	// Test: PING is answered
+	tc := dialRaw(t, addr)
+	tc.write(framePing, 0, 0, []byte("12345678"))
+	f := tc.read()
+	assert.Equal(t, frame{typ: framePing, flags: flagAck, payload: []byte("12345678")}, f)
+
+	// Test: Streams over the limit are refused; resetting one cancels its
+	// request
+	tc.request(1, true, headerField{":authority", "x"}, headerField{"x-path", ""})
+	tc.write(frameHeaders, 0, 0, nil)
+	assert.Equal(t, ErrCodeProtocol, tc.expectGoAway())
+
+	tc = dialRaw(t, addr)
+	block := appendField(nil, headerField{":method", "GET"})
+	block = appendField(block, headerField{":scheme", "http"})
+	block = appendField(block, headerField{":path", "/block"})
+	tc.write(frameHeaders, flagEndHeaders|flagEndStream, 1, block)
+	tc.request(3, true)
+	assert.Equal(t, ErrCodeRefusedStream, tc.expectReset(3))
+	tc.write(frameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request context not cancelled by RST_STREAM")
+	}
+
+	// Test: Malformed requests are reset
+	tc.request(5, true, headerField{"Upper", "x"})
+	assert.Equal(t, ErrCodeProtocol, tc.expectReset(5))
+	tc.request(7, true, headerField{"connection", "close"})
+	assert.Equal(t, ErrCodeProtocol, tc.expectReset(7))
+	tc.write(frameHeaders, flagEndHeaders|flagEndStream, 9, appendField(nil, headerField{":method", "GET"}))
+	assert.Equal(t, ErrCodeProtocol, tc.expectReset(9))
+
+	// Test: A body that doesn't match Content-Length
+	tc.request(11, false, headerField{"content-length", "5"})
+	tc.write(frameData, flagEndStream, 11, []byte("abc"))
+	assert.Equal(t, ErrCodeProtocol, tc.expectReset(11))
+
+	// Test: Too large header lists and bodies are answered by the error
+	// handler; a client still sending is then told to stop
+	tc.request(13, true, headerField{"x-big", strings.Repeat("a", 200)})
+	id, status := tc.status()
+	assert.Equal(t, uint32(13), id)
+	assert.Equal(t, "431", status)
+	tc.read()
+	tc.request(15, false)
+	tc.write(frameData, 0, 15, []byte("0123456789abc"))
+	_, status = tc.status()
+	assert.Equal(t, "413", status)
+	f = tc.read()
+	assert.True(t, f.typ == frameData && f.has(flagEndStream))
+	assert.Equal(t, ErrCodeNo, tc.expectReset(15))
+
+	// Test: Handlers that write nothing get their stream reset
+	block = appendField(nil, headerField{":method", "GET"})
+	block = appendField(block, headerField{":scheme", "http"})
+	block = appendField(block, headerField{":path", "/silent"})
+	tc.write(frameHeaders, flagEndHeaders|flagEndStream, 17, block)
+	assert.Equal(t, ErrCodeInternal, tc.expectReset(17))
+
+	// Test: Zero window updates on a stream are stream errors
+	tc.write(frameWindowUpdate, 0, 17, binary.BigEndian.AppendUint32(nil, 0))
+	assert.Equal(t, ErrCodeProtocol, tc.expectReset(17))
+
+	// Test: Incomplete responses are reset rather than ended
+	block = appendField(nil, headerField{":method", "GET"})
+	block = appendField(block, headerField{":scheme", "http"})
+	block = appendField(block, headerField{":path", "/broken"})
+	tc.write(frameHeaders, flagEndHeaders|flagEndStream, 19, block)
+	_, status = tc.status()
+	assert.Equal(t, "200", status)
+	f = tc.read()
+	assert.True(t, f.typ == frameData && !f.has(flagEndStream), "frame %+v", f)
+	assert.Equal(t, ErrCodeInternal, tc.expectReset(19))
+}
+
+func TestFlowControl(t *testing.T) {
+	body := bytes.Repeat([]byte("z"), 100)
+	addr := startServer(t, Config{Handler: func(w *response.Writer, req *request.Request) bool {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return true
+	}})
+	tc := dialRaw(t, addr)
+	// A stream window of 30 bytes lets the body out in pieces.
+	tc.write(frameSettings, 0, 0, appendSetting(nil, settingInitialWindowSize, 30))
+	assert.True(t, tc.read().has(flagAck))
+	tc.request(1, true)
+	tc.status()
+
+	f := tc.read()
+	assert.Equal(t, body[:30], f.payload)
+	for _, n := range []uint32{50, 20} {
+		tc.write(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, n))
+		f = tc.read()
+		assert.Len(t, f.payload, int(n))
+	}
+	f = tc.read()
+	assert.Equal(t, frame{typ: frameData, flags: flagEndStream, streamID: 1, payload: []byte{}}, f)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := startServer(t, Config{Handler: okHandler, IdleTimeout: 50 * time.Millisecond})
+	tc := dialRaw(t, addr)
+	tc.request(1, true)
+	tc.status()
+	tc.read()
+	assert.Equal(t, ErrCodeNo, tc.expectGoAway())
+	_, err := readFrame(tc.c, maxMaxFrameSize)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestNewRequest(t *testing.T) {
+	req, err := newRequest([]headerField{
+		{":method", "CONNECT"}, {":authority", "example.com:443"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:443", req.RequestLine.RequestTarget)
+	assert.Equal(t, "example.com:443", req.Headers.Get("Host"))
+
+	req, err = newRequest([]headerField{
+		{":method", "OPTIONS"}, {":scheme", "http"}, {":path", "*"}, {"te", "trailers"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "*", req.RequestLine.RequestTarget)
+
+	bad := [][]headerField{
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "*"}},
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "x"}},
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":path", "/"}},
+		{{":method", "GET"}, {":scheme", "http"}, {"a", "b"}, {":path", "/"}},
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":protocol", "websocket"}},
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {"te", "gzip"}},
+		{{":method", "CONNECT"}, {":authority", "x:1"}, {":path", "/"}},
+		{{":method", "POST"}, {":scheme", "http"}, {":path", "/"}, {"content-length", "-1"}},
+	}
+	for _, fields := range bad {
+		_, err := newRequest(fields)
+		assert.Error(t, err, "%v", fields)
+	}
+}
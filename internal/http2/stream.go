@@ -0,0 +1,188 @@
+package http2
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+)
+
+// connectionHeaders are HTTP/1.1 connection-specific fields, which HTTP/2
+// messages must not carry.
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// newRequest builds the request for a stream from its header fields.
+func newRequest(fields []headerField) (*request.Request, error) {
+	var method, scheme, authority, path string
+	seen := map[string]bool{}
+	var cookies []string
+	h := headers.NewHeaders()
+	regular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			if regular || seen[f.name] {
+				return nil, errors.New("misplaced or repeated pseudo-header")
+			}
+			seen[f.name] = true
+			switch f.name {
+			case ":method":
+				method = f.value
+			case ":scheme":
+				scheme = f.value
+			case ":authority":
+				authority = f.value
+			case ":path":
+				path = f.value
+			default:
+				return nil, errors.New("unknown pseudo-header " + f.name)
+			}
+			continue
+		}
+		regular = true
+		if f.name != strings.ToLower(f.name) || connectionHeaders[f.name] {
+			return nil, errors.New("invalid header " + f.name)
+		}
+		switch f.name {
+		case "te":
+			if f.value != "trailers" {
+				return nil, errors.New("invalid te header")
+			}
+		case "cookie":
+			// Cookie may be split across fields, which are joined with
+			// "; " rather than ", ".
+			cookies = append(cookies, f.value)
+			continue
+		}
+		h.Set(f.name, f.value)
+	}
+	if len(cookies) > 0 {
+		h.SetNew("cookie", strings.Join(cookies, "; "))
+	}
+
+	target := path
+	switch {
+	case method == "":
+		return nil, errors.New("missing :method")
+	case method == "CONNECT":
+		if authority == "" || seen[":scheme"] || seen[":path"] {
+			return nil, errors.New("malformed CONNECT request")
+		}
+		target = authority
+	case scheme == "" || path == "":
+		return nil, errors.New("missing :scheme or :path")
+	case path == "*" && method != "OPTIONS", path != "*" && !strings.HasPrefix(path, "/"):
+		return nil, errors.New("invalid :path " + path)
+	}
+	if authority != "" && h.Get("Host") == "" {
+		h.SetNew("host", authority)
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err != nil || n < 0 {
+			return nil, errors.New("invalid content-length")
+		}
+	}
+
+	return &request.Request{
+		RequestLine: request.RequestLine{
+			Method:        method,
+			RequestTarget: target,
+			HttpVersion:   "2.0",
+		},
+		Headers: h,
+		Body:    []byte{},
+	}, nil
+}
+
+// streamTransport sends a response on a stream.
+type streamTransport struct {
+	sc      *serverConn
+	st      *stream
+	head    bool
+	trailer string
+	ended   bool
+}
+
+func (t *streamTransport) WriteHead(statusCode response.StatusCode, h headers.Headers) error {
+	fields := []headerField{{":status", strconv.Itoa(int(statusCode))}}
+	for k, v := range h {
+		k = strings.ToLower(k)
+		if v == "" || connectionHeaders[k] {
+			continue
+		}
+		for _, v := range h.Values(k) {
+			fields = append(fields, headerField{k, v})
+		}
+	}
+	t.trailer = h.Get("Trailer")
+	if t.head {
+		// HEAD responses have no body; the stream ends here.
+		t.ended = true
+		err := t.sc.writeHeaders(t.st, fields, true)
+		t.sc.endLocal(t.st)
+		return err
+	}
+	return t.sc.writeHeaders(t.st, fields, false)
+}
+
+func (t *streamTransport) WriteBody(p []byte) (int, error) {
+	if t.head {
+		return len(p), nil
+	}
+	written := 0
+	for len(p) > 0 {
+		n, err := t.sc.reserve(t.st, len(p))
+		if err != nil {
+			return written, err
+		}
+		if err := t.sc.writeFrame(frameData, 0, t.st.id, p[:n]); err != nil {
+			return written, err
+		}
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// WriteEnd ends the stream, with a HEADERS frame if there are trailers
+// declared by the Trailer header and an empty DATA frame otherwise.
+func (t *streamTransport) WriteEnd(trailers headers.Headers) error {
+	if t.ended {
+		return nil
+	}
+	t.ended = true
+	defer t.sc.endLocal(t.st)
+
+	var fields []headerField
+	if trailers != nil {
+		declared := trailers.Get("Trailer")
+		if declared == "" {
+			declared = t.trailer
+		}
+		for k := range strings.SplitSeq(declared, ",") {
+			k = strings.ToLower(strings.TrimSpace(k))
+			if v := trailers.Get(k); k != "" && v != "" {
+				fields = append(fields, headerField{k, v})
+			}
+		}
+	}
+	if len(fields) > 0 {
+		return t.sc.writeHeaders(t.st, fields, true)
+	}
+
+	t.sc.mu.Lock()
+	reset := t.st.reset || t.sc.closed
+	t.sc.mu.Unlock()
+	if reset {
+		return errStreamClosed
+	}
+	return t.sc.writeFrame(frameData, flagEndStream, t.st.id, nil)
+}
@@ -0,0 +1,396 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+// DefaultBuckets are histogram buckets in seconds suited to request
+// latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and renders them in the Prometheus text exposition
+// format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	describe() (name, help, kind string)
+	writeSamples(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+func (r *Registry) register(m metric) {
+	name, _, _ := m.describe()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes every metric in the Prometheus text format, version
+// 0.0.4, sorted by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool {
+		a, _, _ := metrics[i].describe()
+		b, _, _ := metrics[j].describe()
+		return a < b
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		name, help, kind := m.describe()
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, kind)
+		m.writeSamples(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry's metrics.
+func (r *Registry) Handler() server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		var b strings.Builder
+		r.WriteText(&b)
+		h := response.GetDefaultHeaders(b.Len())
+		h.SetNew("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := w.WriteStatusLine(response.StatusOK); err != nil {
+			return
+		}
+		if err := w.WriteHeaders(h); err != nil {
+			return
+		}
+		w.WriteBody([]byte(b.String()))
+	}
+}
+
+// atomicFloat is a float64 updated atomically.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+type desc struct {
+	name string
+	help string
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	desc
+	v atomicFloat
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{desc: desc{name, help}}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add increases the counter by v, which must not be negative.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.v.add(v)
+}
+
+func (c *Counter) Value() float64 {
+	return c.v.load()
+}
+
+func (c *Counter) describe() (string, string, string) {
+	return c.name, c.help, "counter"
+}
+
+func (c *Counter) writeSamples(w *bufio.Writer) {
+	writeSample(w, c.name, "", c.v.load())
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	desc
+	v atomicFloat
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name, help}}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Inc()           { g.v.add(1) }
+func (g *Gauge) Dec()           { g.v.add(-1) }
+func (g *Gauge) Add(v float64)  { g.v.add(v) }
+func (g *Gauge) Set(v float64)  { g.v.set(v) }
+func (g *Gauge) Value() float64 { return g.v.load() }
+
+func (g *Gauge) describe() (string, string, string) {
+	return g.name, g.help, "gauge"
+}
+
+func (g *Gauge) writeSamples(w *bufio.Writer) {
+	writeSample(w, g.name, "", g.v.load())
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	desc
+	labels  string
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomicFloat
+}
+
+func newHistogram(name, help string, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &Histogram{
+		desc:    desc{name, help},
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+// NewHistogram registers a histogram with the given upper bounds, or
+// DefaultBuckets if nil. The +Inf bucket is implicit.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(name, help, buckets)
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.add(v)
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+func (h *Histogram) describe() (string, string, string) {
+	return h.name, h.help, "histogram"
+}
+
+func (h *Histogram) writeSamples(w *bufio.Writer) {
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += h.counts[i].Load()
+		writeSample(w, h.name+"_bucket", joinLabels(h.labels, `le="`+formatFloat(b)+`"`), float64(cumulative))
+	}
+	writeSample(w, h.name+"_bucket", joinLabels(h.labels, `le="+Inf"`), float64(h.count.Load()))
+	writeSample(w, h.name+"_sum", h.labels, h.sum.load())
+	writeSample(w, h.name+"_count", h.labels, float64(h.count.Load()))
+}
+
+// vec holds one child metric per combination of label values.
+type vec[T any] struct {
+	desc
+	labelNames []string
+	newChild   func(labels string) T
+
+	mu       sync.Mutex
+	children map[string]T
+}
+
+func (v *vec[T]) with(values []string) T {
+	if len(values) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labelNames), len(values)))
+	}
+	pairs := make([]string, len(values))
+	for i, val := range values {
+		pairs[i] = v.labelNames[i] + `="` + escapeLabel(val) + `"`
+	}
+	key := strings.Join(pairs, ",")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.children[key]
+	if !ok {
+		c = v.newChild(key)
+		v.children[key] = c
+	}
+	return c
+}
+
+func (v *vec[T]) sortedChildren() []T {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	children := make([]T, len(keys))
+	for i, k := range keys {
+		children[i] = v.children[k]
+	}
+	return children
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	vec[*labeledCounter]
+}
+
+type labeledCounter struct {
+	Counter
+	labels string
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	cv := &CounterVec{vec[*labeledCounter]{
+		desc:       desc{name, help},
+		labelNames: labelNames,
+		children:   map[string]*labeledCounter{},
+		newChild: func(labels string) *labeledCounter {
+			return &labeledCounter{Counter: Counter{desc: desc{name, help}}, labels: labels}
+		},
+	}}
+	r.register(cv)
+	return cv
+}
+
+// WithLabelValues returns the counter for values, given in the order of
+// the label names.
+func (cv *CounterVec) WithLabelValues(values ...string) *Counter {
+	return &cv.with(values).Counter
+}
+
+func (cv *CounterVec) describe() (string, string, string) {
+	return cv.name, cv.help, "counter"
+}
+
+func (cv *CounterVec) writeSamples(w *bufio.Writer) {
+	for _, c := range cv.sortedChildren() {
+		writeSample(w, cv.name, c.labels, c.v.load())
+	}
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	vec[*Histogram]
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	hv := &HistogramVec{vec[*Histogram]{
+		desc:       desc{name, help},
+		labelNames: labelNames,
+		children:   map[string]*Histogram{},
+		newChild: func(labels string) *Histogram {
+			h := newHistogram(name, help, buckets)
+			h.labels = labels
+			return h
+		},
+	}}
+	r.register(hv)
+	return hv
+}
+
+func (hv *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return hv.with(values)
+}
+
+func (hv *HistogramVec) describe() (string, string, string) {
+	return hv.name, hv.help, "histogram"
+}
+
+func (hv *HistogramVec) writeSamples(w *bufio.Writer) {
+	for _, h := range hv.sortedChildren() {
+		h.writeSamples(w)
+	}
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
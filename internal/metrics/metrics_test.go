@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("jobs_total", "Jobs done.\nEver.")
+	g := r.NewGauge("queue_depth", "Items queued.")
+	h := r.NewHistogram("job_seconds", "Job time.", []float64{1, 0.5})
+	cv := r.NewCounterVec("errors_total", "Errors.", "kind")
+
+	c.Add(3)
+	g.Set(5)
+	g.Dec()
+	h.Observe(0.2)
+	h.Observe(0.5)
+	h.Observe(2)
+	cv.WithLabelValues(`a"b\c`).Inc()
+	cv.WithLabelValues("plain").Add(2)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	assert.Equal(t, `# HELP errors_total Errors.
+# TYPE errors_total counter
+errors_total{kind="a\"b\\c"} 1
+errors_total{kind="plain"} 2
+# HELP job_seconds Job time.
+# TYPE job_seconds histogram
+job_seconds_bucket{le="0.5"} 2
+job_seconds_bucket{le="1"} 2
+job_seconds_bucket{le="+Inf"} 3
+job_seconds_sum 2.7
+job_seconds_count 3
+# HELP jobs_total Jobs done.\nEver.
+# TYPE jobs_total counter
+jobs_total 3
+# HELP queue_depth Items queued.
+# TYPE queue_depth gauge
+queue_depth 4
+`, buf.String())
+
+	assert.Panics(t, func() { r.NewCounter("jobs_total", "again") })
+	assert.Panics(t, func() { c.Add(-1) })
+}
+
+func TestServerMetrics(t *testing.T) {
+	r := NewRegistry()
+	m := NewServerMetrics(r)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	m.ConnState(c1, server.StateNew)
+	m.ConnState(c2, server.StateNew)
+	m.ConnState(c2, server.StateClosed)
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+	m.ConnState(c3, server.StateNew)
+	m.ConnState(c3, server.StateHijacked)
+
+	h := m.Middleware()(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusNotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(4))
+		w.WriteBody([]byte("nope"))
+	})
+	req, err := request.RequestFromReader(strings.NewReader("POST /x HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc"))
+	require.NoError(t, err)
+	h(response.NewWriter(&bytes.Buffer{}), req)
+
+	eh := m.ErrorHandler(nil)
+	eh(response.NewWriter(&bytes.Buffer{}), req, request.ErrHeaderTooLarge)
+	eh(response.NewWriter(&bytes.Buffer{}), req, errors.New("mystery"))
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	out := buf.String()
+	assert.Contains(t, out, "http_connections_accepted_total 3\n")
+	assert.Contains(t, out, "http_connections_active 1\n")
+	assert.Contains(t, out, `http_requests_total{method="POST",status="404"} 1`+"\n")
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="POST"} 1`+"\n")
+	assert.Contains(t, out, "http_request_body_bytes_total 3\n")
+	assert.Contains(t, out, "http_response_body_bytes_total 4\n")
+	assert.Contains(t, out, `http_parse_errors_total{kind="header_too_large"} 1`+"\n")
+	assert.Contains(t, out, `http_parse_errors_total{kind="other"} 1`+"\n")
+}
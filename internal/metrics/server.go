@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+// ServerMetrics are the standard metrics of a server. Attach them with
+// the ConnState hook, the Middleware and the ErrorHandler wrapper.
+type ServerMetrics struct {
+	ConnectionsAccepted *Counter
+	ConnectionsActive   *Gauge
+	Requests            *CounterVec
+	RequestDuration     *HistogramVec
+	RequestBytes        *Counter
+	ResponseBytes       *Counter
+	ParseErrors         *CounterVec
+	UpstreamDuration    *HistogramVec
+}
+
+func NewServerMetrics(r *Registry) *ServerMetrics {
+	return &ServerMetrics{
+		ConnectionsAccepted: r.NewCounter("http_connections_accepted_total", "Connections accepted."),
+		ConnectionsActive:   r.NewGauge("http_connections_active", "Connections currently open."),
+		Requests:            r.NewCounterVec("http_requests_total", "Requests handled, by method and status.", "method", "status"),
+		RequestDuration:     r.NewHistogramVec("http_request_duration_seconds", "Time from receiving a request to its handler returning.", nil, "method"),
+		RequestBytes:        r.NewCounter("http_request_body_bytes_total", "Request body bytes received."),
+		ResponseBytes:       r.NewCounter("http_response_body_bytes_total", "Response body bytes written by handlers."),
+		ParseErrors:         r.NewCounterVec("http_parse_errors_total", "Requests rejected by the parser, by kind.", "kind"),
+		UpstreamDuration:    r.NewHistogramVec("http_proxy_upstream_duration_seconds", "Time until proxied upstream responses arrive.", nil, "upstream"),
+	}
+}
+
+// ConnState has the signature of server.ConnStateHook.
+func (m *ServerMetrics) ConnState(c net.Conn, state server.ConnState) {
+	switch state {
+	case server.StateNew:
+		m.ConnectionsAccepted.Inc()
+		m.ConnectionsActive.Inc()
+	case server.StateClosed, server.StateHijacked:
+		m.ConnectionsActive.Dec()
+	}
+}
+
+// ObserveUpstream records how long a proxied upstream took to respond. It
+// has the signature of proxy.ReverseProxy.OnUpstream.
+func (m *ServerMetrics) ObserveUpstream(upstream string, d time.Duration) {
+	m.UpstreamDuration.WithLabelValues(upstream).Observe(d.Seconds())
+}
+
+func (m *ServerMetrics) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := req.ReceivedAt
+			if start.IsZero() {
+				start = time.Now()
+			}
+			next(w, req)
+
+			method := methodLabel(req.RequestLine.Method)
+			m.Requests.WithLabelValues(method, strconv.Itoa(int(w.StatusCode()))).Inc()
+			m.RequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+			m.RequestBytes.Add(float64(len(req.Body)))
+			m.ResponseBytes.Add(float64(w.BytesWritten()))
+		}
+	}
+}
+
+// ErrorHandler wraps next, counting parse errors by kind. A nil next means
+// server.DefaultErrorHandler.
+func (m *ServerMetrics) ErrorHandler(next server.ErrorHandler) server.ErrorHandler {
+	if next == nil {
+		next = server.DefaultErrorHandler
+	}
+	return func(w *response.Writer, req *request.Request, err error) {
+		m.ParseErrors.WithLabelValues(ErrorKind(err)).Inc()
+		next(w, req, err)
+	}
+}
+
+// ErrorKind classifies a request parse error for use as a label.
+func ErrorKind(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		return "header_too_large"
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return "body_too_large"
+	case errors.Is(err, request.ErrMalformedRequestLine):
+		return "malformed_request_line"
+	case errors.Is(err, request.ErrMalformedHeader):
+		return "malformed_header"
+	case errors.Is(err, request.ErrMalformedBody):
+		return "malformed_body"
+	case errors.Is(err, request.ErrTruncated):
+		return "truncated"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	default:
+		return "other"
+	}
+}
+
+// methodLabel bounds label cardinality to the standard methods.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE":
+		return method
+	}
+	return "OTHER"
+}
@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+type LogFormat int
+
+const (
+	// FormatCommon is the NCSA Common Log Format.
+	FormatCommon LogFormat = iota
+	// FormatCombined is Common Log Format plus referer and user agent.
+	FormatCombined
+	// FormatJSON is one slog JSON object per request.
+	FormatJSON
+)
+
+// Attribute keys of access log records.
+const (
+	KeyRemoteAddr = "remote_addr"
+	KeyMethod     = "method"
+	KeyTarget     = "target"
+	KeyProto      = "proto"
+	KeyStatus     = "status"
+	KeyBytes      = "bytes"
+	KeyDuration   = "duration"
+	KeyUserAgent  = "user_agent"
+	KeyReferer    = "referer"
+	KeyConnID     = "conn_id"
+	KeyError      = "error"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// NewAccessLogger returns a logger that writes access log records to w in
+// the given format.
+func NewAccessLogger(w io.Writer, format LogFormat) *slog.Logger {
+	if format == FormatJSON {
+		return slog.New(slog.NewJSONHandler(w, nil))
+	}
+	return slog.New(&clfHandler{
+		mu:       &sync.Mutex{},
+		w:        w,
+		combined: format == FormatCombined,
+	})
+}
+
+// AccessLog logs every request handled by next to logger.
+func AccessLog(logger *slog.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			logRequest(logger, w, req, start, nil)
+		}
+	}
+}
+
+// LogRejected wraps an ErrorHandler so requests rejected by the parser are
+// logged with the reason. A nil next means server.DefaultErrorHandler.
+func LogRejected(logger *slog.Logger, next server.ErrorHandler) server.ErrorHandler {
+	if next == nil {
+		next = server.DefaultErrorHandler
+	}
+	return func(w *response.Writer, req *request.Request, err error) {
+		start := time.Now()
+		next(w, req, err)
+		logRequest(logger, w, req, start, err)
+	}
+}
+
+func logRequest(logger *slog.Logger, w *response.Writer, req *request.Request, start time.Time, err error) {
+	if !req.ReceivedAt.IsZero() {
+		start = req.ReceivedAt
+	}
+	attrs := []slog.Attr{
+		slog.String(KeyRemoteAddr, addrString(req.RemoteAddr)),
+		slog.String(KeyMethod, req.RequestLine.Method),
+		slog.String(KeyTarget, req.RequestLine.RequestTarget),
+		slog.String(KeyProto, protoString(req)),
+		slog.Int(KeyStatus, int(w.StatusCode())),
+		slog.Int64(KeyBytes, w.BytesWritten()),
+		slog.Duration(KeyDuration, time.Since(start)),
+		slog.String(KeyUserAgent, req.Headers.Get("User-Agent")),
+		slog.String(KeyReferer, req.Headers.Get("Referer")),
+		slog.Uint64(KeyConnID, req.ConnID),
+	}
+	msg := "request"
+	level := slog.LevelInfo
+	if err != nil {
+		msg = "rejected request"
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String(KeyError, err.Error()))
+	}
+	logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+func protoString(req *request.Request) string {
+	if req.RequestLine.HttpVersion == "" {
+		return ""
+	}
+	return "HTTP/" + req.RequestLine.HttpVersion
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+// clfHandler formats access log records as Common or Combined Log Format
+// lines. Records carrying an error get it appended as a quoted field.
+type clfHandler struct {
+	mu       *sync.Mutex
+	w        io.Writer
+	combined bool
+	attrs    []slog.Attr
+}
+
+func (h *clfHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *clfHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &h2
+}
+
+func (h *clfHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func (h *clfHandler) Handle(_ context.Context, r slog.Record) error {
+	vals := make(map[string]slog.Value, len(h.attrs)+r.NumAttrs())
+	for _, a := range h.attrs {
+		vals[a.Key] = a.Value
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		vals[a.Key] = a.Value
+		return true
+	})
+	str := func(key string) string {
+		v, ok := vals[key]
+		if !ok || v.String() == "" {
+			return "-"
+		}
+		return v.String()
+	}
+
+	host := str(KeyRemoteAddr)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	line := "-"
+	if m := str(KeyMethod); m != "-" {
+		line = strings.TrimSpace(m + " " + str(KeyTarget) + " " + str(KeyProto))
+	}
+	status := str(KeyStatus)
+	if status == "0" {
+		status = "-"
+	}
+	size := str(KeyBytes)
+	if size == "0" {
+		size = "-"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] %s %s %s", host, r.Time.Format(clfTimeFormat), strconv.Quote(line), status, size)
+	if h.combined {
+		fmt.Fprintf(&b, " %s %s", strconv.Quote(str(KeyReferer)), strconv.Quote(str(KeyUserAgent)))
+	}
+	if e, ok := vals[KeyError]; ok {
+		fmt.Fprintf(&b, " %s", strconv.Quote(e.String()))
+	}
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(t *testing.T, raw string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(bytes.NewBufferString(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5555}
+	req.ConnID = 7
+	return req
+}
+
+func okHandler(body string) func(*response.Writer, *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	raw := "GET /index.html?x=1 HTTP/1.1\r\nUser-Agent: curl/8.0\r\nReferer: http://example.com/\r\n\r\n"
+
+	var buf bytes.Buffer
+	h := AccessLog(NewAccessLogger(&buf, FormatCommon))(okHandler("hello"))
+	h(response.NewWriter(&bytes.Buffer{}), newRequest(t, raw))
+	assert.Regexp(t, regexp.MustCompile(`^10\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "GET /index.html\?x=1 HTTP/1.1" 200 5\n$`), buf.String())
+
+	buf.Reset()
+	h = AccessLog(NewAccessLogger(&buf, FormatCombined))(okHandler("hello"))
+	h(response.NewWriter(&bytes.Buffer{}), newRequest(t, raw))
+	assert.Regexp(t, `"GET /index.html\?x=1 HTTP/1.1" 200 5 "http://example.com/" "curl/8.0"\n$`, buf.String())
+
+	buf.Reset()
+	h = AccessLog(NewAccessLogger(&buf, FormatJSON))(okHandler("hello"))
+	h(response.NewWriter(&bytes.Buffer{}), newRequest(t, raw))
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal(t, "request", rec["msg"])
+	assert.Equal(t, "GET", rec[KeyMethod])
+	assert.Equal(t, "/index.html?x=1", rec[KeyTarget])
+	assert.Equal(t, float64(200), rec[KeyStatus])
+	assert.Equal(t, float64(5), rec[KeyBytes])
+	assert.Equal(t, "10.0.0.1:5555", rec[KeyRemoteAddr])
+	assert.Equal(t, "curl/8.0", rec[KeyUserAgent])
+	assert.Equal(t, float64(7), rec[KeyConnID])
+	assert.Contains(t, rec, KeyDuration)
+}
+
+func TestLogRejected(t *testing.T) {
+	var buf bytes.Buffer
+	eh := LogRejected(NewAccessLogger(&buf, FormatCommon), nil)
+	req := &request.Request{
+		Headers:    headers.NewHeaders(),
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1},
+	}
+	var out bytes.Buffer
+	eh(response.NewWriter(&out), req, errors.New("invalid request line: GARBAGE"))
+
+	assert.Contains(t, out.String(), "HTTP/1.1 400 Bad Request")
+	assert.Regexp(t, `^10\.0\.0\.2 - - \[.*\] "-" 400 \d+ "invalid request line: GARBAGE"\n$`, buf.String())
+}
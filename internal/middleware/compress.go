@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+// DefaultCompressMinSize is the smallest body, in bytes, that Compress
+// compresses when CompressOptions.MinSize is 0.
+const DefaultCompressMinSize = 1024
+
+// supportedEncodings lists the content codings Compress can apply, in order
+// of preference when the client rates them equally.
+var supportedEncodings = []string{"gzip", "deflate"}
+
+// compressibleTypes are media types worth compressing besides text/*.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/wasm":       true,
+	"image/svg+xml":          true,
+}
+
+type CompressOptions struct {
+	// Level is the compression level, from 1 to 9; 0 means the default.
+	Level int
+	// MinSize is the smallest Content-Length that is compressed. Bodies of
+	// unknown length are always compressed.
+	MinSize int64
+}
+
+// Compress compresses response bodies with gzip or deflate, as negotiated
+// through Accept-Encoding. Only compressible content types are compressed,
+// and responses that are already encoded, partial or bodiless are left
+// alone. Compressed responses are sent chunked.
+func Compress(opts CompressOptions) server.Middleware {
+	if opts.Level == 0 {
+		opts.Level = gzip.DefaultCompression
+	}
+	if _, err := gzip.NewWriterLevel(io.Discard, opts.Level); err != nil {
+		panic(fmt.Sprintf("middleware: %v", err))
+	}
+	if opts.MinSize == 0 {
+		opts.MinSize = DefaultCompressMinSize
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			// HTTP/1.0 has no chunked encoding; HTTP/2 frames the body
+			// itself.
+			if req.RequestLine.Method == "HEAD" || (req.RequestLine.HttpVersion != "1.1" && req.RequestLine.HttpVersion != "2.0") {
+				next(w, req)
+				return
+			}
+			w.OnHeaders(func(code response.StatusCode, h headers.Headers) {
+				compress(w, req, code, h, opts)
+			})
+			next(w, req)
+		}
+	}
+}
+
+func compress(w *response.Writer, req *request.Request, code response.StatusCode, h headers.Headers, opts CompressOptions) {
+	if code < 200 || code == response.StatusNoContent || code == response.StatusPartialContent || code == response.StatusNotModified {
+		return
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || !compressible(h.Get("Content-Type")) {
+		return
+	}
+	if !strings.Contains(strings.ToLower(h.Get("Vary")), "accept-encoding") {
+		h.Set("Vary", "Accept-Encoding")
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n < opts.MinSize {
+			return
+		}
+	}
+
+	encoding := NegotiateEncoding(req.Headers.Get("Accept-Encoding"), supportedEncodings...)
+	if encoding == "" {
+		return
+	}
+	h.SetNew("Content-Encoding", encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.SetNew("Transfer-Encoding", "chunked")
+	// The compressed bytes differ from the identity representation, so a
+	// strong validator would be wrong.
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.SetNew("ETag", "W/"+etag)
+	}
+
+	w.WrapBody(func(inner io.Writer) io.Writer {
+		var zw io.WriteCloser
+		if encoding == "gzip" {
+			zw, _ = gzip.NewWriterLevel(inner, opts.Level)
+		} else {
+			zw, _ = zlib.NewWriterLevel(inner, opts.Level)
+		}
+		return zw
+	})
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType == "text/event-stream" {
+		// Events must reach the client as they are written.
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// NegotiateEncoding picks the content coding from supported that the
+// Accept-Encoding value accept rates highest, preferring earlier entries
+// of supported on ties. It returns "" if none is acceptable.
+func NegotiateEncoding(accept string, supported ...string) string {
+	qs := map[string]float64{}
+	for part := range strings.SplitSeq(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && f >= 0 && f <= 1 {
+					q = f
+				} else {
+					q = 0
+				}
+			}
+		}
+		qs[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range supported {
+		q, ok := qs[enc]
+		if !ok && enc == "gzip" {
+			q, ok = qs["x-gzip"]
+		}
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
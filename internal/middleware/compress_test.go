@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"GZIP ; Q=0.8, br", "gzip"},
+		{"x-gzip", "gzip"},
+		{"*", "gzip"},
+		{"*;q=0.1, gzip;q=0", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"gzip;q=bogus", ""},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, NegotiateEncoding(tt.accept, supportedEncodings...), tt.accept)
+	}
+}
+
+func typedHandler(contentType, body string, code response.StatusCode) func(*response.Writer, *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		h.SetNew("Content-Type", contentType)
+		h.SetNew("ETag", `"abc"`)
+		w.WriteStatusLine(code)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func compressed(t *testing.T, h func(*response.Writer, *request.Request), raw string) (*http.Response, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	Compress(CompressOptions{})(h)(w, newRequest(t, raw))
+	require.NoError(t, w.Close())
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func TestCompress(t *testing.T) {
+	page := strings.Repeat("<p>hello, compression</p>\n", 100)
+	h := typedHandler("text/html; charset=utf-8", page, response.StatusOK)
+
+	resp, body := compressed(t, h, "GET / HTTP/1.1\r\nAccept-Encoding: gzip, deflate\r\n\r\n")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Equal(t, `W/"abc"`, resp.Header.Get("ETag"))
+	assert.Less(t, len(body), len(page))
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(plain))
+
+	resp, body = compressed(t, h, "GET / HTTP/1.1\r\nAccept-Encoding: deflate\r\n\r\n")
+	assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	fr, err := zlib.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	plain, err = io.ReadAll(fr)
+	require.NoError(t, err)
+	assert.Equal(t, page, string(plain))
+
+	// Test: Client doesn't accept any coding
+	resp, body = compressed(t, h, "GET / HTTP/1.1\r\n\r\n")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Equal(t, page, string(body))
+}
+
+func TestCompressSkips(t *testing.T) {
+	big := strings.Repeat("x", 4096)
+	accept := "GET / HTTP/1.1\r\nAccept-Encoding: gzip\r\n\r\n"
+
+	tests := []struct {
+		name string
+		h    func(*response.Writer, *request.Request)
+		raw  string
+	}{
+		{"below threshold", typedHandler("text/plain", "tiny", response.StatusOK), accept},
+		{"incompressible type", typedHandler("image/png", big, response.StatusOK), accept},
+		{"partial content", typedHandler("text/plain", big, response.StatusPartialContent), accept},
+		{"head", typedHandler("text/plain", big, response.StatusOK), "HEAD / HTTP/1.1\r\nAccept-Encoding: gzip\r\n\r\n"},
+		{"already encoded", func(w *response.Writer, req *request.Request) {
+			h := response.GetDefaultHeaders(len(big))
+			h.SetNew("Content-Encoding", "br")
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(h)
+			w.WriteBody([]byte(big))
+		}, accept},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		Compress(CompressOptions{})(tt.h)(w, newRequest(t, tt.raw))
+		require.NoError(t, w.Close())
+		assert.NotEqual(t, "gzip", w.Headers().Get("Content-Encoding"), tt.name)
+		assert.NotEmpty(t, w.Headers().Get("Content-Length"), tt.name)
+	}
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+// DefaultDecompressMaxBytes is the decoded body limit Decompress applies
+// when given 0.
+const DefaultDecompressMaxBytes = 10 << 20
+
+// Decompress decodes gzip and deflate request bodies before handing the
+// request to next, which sees the decoded Body, an updated Content-Length
+// and no Content-Encoding; the original bytes and coding are kept in
+// RawBody and RawContentEncoding. Bodies that decode to more than maxBytes
+// are rejected with 413, unsupported codings with 415 and corrupt data
+// with 400.
+func Decompress(maxBytes int64) server.Middleware {
+	if maxBytes == 0 {
+		maxBytes = DefaultDecompressMaxBytes
+	}
+
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			ce := req.Headers.Get("Content-Encoding")
+			if strings.TrimSpace(ce) == "" {
+				next(w, req)
+				return
+			}
+
+			body, code := decodeBody(req.Body, ce, maxBytes)
+			if code != 0 {
+				h := response.GetDefaultHeaders(0)
+				if code == response.StatusUnsupportedMediaType {
+					h.SetNew("Accept-Encoding", strings.Join(supportedEncodings, ", "))
+				}
+				response.WriteError(w, code, h)
+				return
+			}
+
+			decoded := req.WithContext(req.Context())
+			decoded.Headers = maps.Clone(req.Headers)
+			decoded.Headers.Del("Content-Encoding")
+			decoded.Headers.SetNew("Content-Length", strconv.Itoa(len(body)))
+			decoded.Body = body
+			decoded.RawBody = req.Body
+			decoded.RawContentEncoding = ce
+			next(w, decoded)
+		}
+	}
+}
+
+// decodeBody undoes the codings listed in ce, which were applied in order,
+// returning a status code instead if that is not possible.
+func decodeBody(body []byte, ce string, maxBytes int64) ([]byte, response.StatusCode) {
+	codings := strings.Split(ce, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		var zr io.ReadCloser
+		var err error
+		switch strings.ToLower(strings.TrimSpace(codings[i])) {
+		case "identity":
+			continue
+		case "gzip", "x-gzip":
+			zr, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			zr, err = zlib.NewReader(bytes.NewReader(body))
+		default:
+			return nil, response.StatusUnsupportedMediaType
+		}
+		if err != nil {
+			return nil, response.StatusBadRequest
+		}
+
+		body, err = io.ReadAll(io.LimitReader(zr, maxBytes+1))
+		zr.Close()
+		if err != nil {
+			return nil, response.StatusBadRequest
+		}
+		if int64(len(body)) > maxBytes {
+			return nil, response.StatusRequestEntityTooLarge
+		}
+	}
+	return body, 0
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func deflateBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func uploadRequest(t *testing.T, encoding string, body []byte) *request.Request {
+	t.Helper()
+	raw := "POST /upload HTTP/1.1\r\nContent-Encoding: " + encoding + "\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"
+	return newRequest(t, raw+string(body))
+}
+
+func TestDecompress(t *testing.T) {
+	const payload = `{"hello":"world"}`
+	var got *request.Request
+	h := Decompress(1024)(func(w *response.Writer, req *request.Request) {
+		got = req
+		okHandler("ok")(w, req)
+	})
+	serve := func(req *request.Request) *response.Writer {
+		got = nil
+		w := response.NewWriter(&bytes.Buffer{})
+		h(w, req)
+		return w
+	}
+
+	gz := gzipBytes(t, payload)
+	req := uploadRequest(t, "gzip", gz)
+	w := serve(req)
+	assert.Equal(t, response.StatusOK, w.StatusCode())
+	require.NotNil(t, got)
+	assert.Equal(t, payload, string(got.Body))
+	assert.Equal(t, strconv.Itoa(len(payload)), got.Headers.Get("Content-Length"))
+	assert.Empty(t, got.Headers.Get("Content-Encoding"))
+	assert.Equal(t, gz, got.RawBody)
+	assert.Equal(t, "gzip", got.RawContentEncoding)
+	assert.Equal(t, "gzip", req.Headers.Get("Content-Encoding"), "original request is untouched")
+
+	// Test: Stacked codings are undone in reverse order
+	serve(uploadRequest(t, "gzip, deflate", deflateBytes(t, gz)))
+	require.NotNil(t, got)
+	assert.Equal(t, payload, string(got.Body))
+
+	// Test: Unencoded bodies pass through
+	serve(newRequest(t, "POST / HTTP/1.1\r\nContent-Length: 2\r\n\r\nhi"))
+	require.NotNil(t, got)
+	assert.Equal(t, "hi", string(got.Body))
+	assert.Nil(t, got.RawBody)
+
+	// Test: Zip bomb
+	w = serve(uploadRequest(t, "gzip", gzipBytes(t, strings.Repeat("a", 1025))))
+	assert.Nil(t, got)
+	assert.Equal(t, response.StatusRequestEntityTooLarge, w.StatusCode())
+
+	// Test: Unsupported coding
+	w = serve(uploadRequest(t, "br", []byte("xx")))
+	assert.Nil(t, got)
+	assert.Equal(t, response.StatusUnsupportedMediaType, w.StatusCode())
+	assert.Equal(t, "gzip, deflate", w.Headers().Get("Accept-Encoding"))
+
+	// Test: Corrupt data
+	w = serve(uploadRequest(t, "gzip", []byte("not gzip")))
+	assert.Nil(t, got)
+	assert.Equal(t, response.StatusBadRequest, w.StatusCode())
+	w = serve(uploadRequest(t, "gzip", gz[:len(gz)-4]))
+	assert.Equal(t, response.StatusBadRequest, w.StatusCode())
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+// ETag buffers the whole response to GET requests and, for 200 responses
+// that don't carry an ETag already, adds one hashed from the body. The
+// request's preconditions are then evaluated, so unchanged bodies are
+// answered with 304. Because the body is held in memory it is meant for
+// small dynamic pages, not for large or streamed responses.
+func ETag() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.Method != "GET" {
+				next(w, req)
+				return
+			}
+
+			rec, rw := response.NewRecorder()
+			next(rw, req)
+			rw.Close()
+			if rec.Headers == nil {
+				return
+			}
+			if rec.StatusCode == response.StatusOK && rec.Headers.Get("ETag") == "" {
+				rec.Headers.SetNew("ETag", response.ContentETag(rec.Body.Bytes()))
+				if response.CheckConditional(w, req, rec.Headers) {
+					return
+				}
+			}
+			rec.WriteTo(w)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestETag(t *testing.T) {
+	h := ETag()(okHandler("hello"))
+	serve := func(raw string) (string, *response.Writer) {
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		h(w, newRequest(t, raw))
+		require.NoError(t, w.Close())
+		return buf.String(), w
+	}
+
+	out, w := serve("GET / HTTP/1.1\r\n\r\n")
+	etag := w.Headers().Get("ETag")
+	assert.Equal(t, response.ContentETag([]byte("hello")), etag)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+
+	// Test: Matching If-None-Match
+	out, w = serve("GET / HTTP/1.1\r\nIf-None-Match: W/" + etag + "\r\n\r\n")
+	assert.Equal(t, response.StatusNotModified, w.StatusCode())
+	assert.Equal(t, etag, w.Headers().Get("ETag"))
+	assert.Empty(t, w.Headers().Get("Content-Length"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: Failing If-Match
+	_, w = serve("GET / HTTP/1.1\r\nIf-Match: \"other\"\r\n\r\n")
+	assert.Equal(t, response.StatusPreconditionFailed, w.StatusCode())
+
+	// Test: Other methods pass through untouched
+	_, w = serve("POST / HTTP/1.1\r\nIf-None-Match: *\r\n\r\n")
+	assert.Equal(t, response.StatusOK, w.StatusCode())
+	assert.Empty(t, w.Headers().Get("ETag"))
+
+	// Test: Errors are replayed without an ETag
+	h = ETag()(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusNotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	_, w = serve("GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, response.StatusNotFound, w.StatusCode())
+	assert.Empty(t, w.Headers().Get("ETag"))
+}
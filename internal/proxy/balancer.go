@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+)
+
+// ErrNoBackend is returned by Balancer.Pick when every backend is down.
+var ErrNoBackend = errors.New("no backend available")
+
+type Strategy int
+
+const (
+	// RoundRobin cycles through the backends.
+	RoundRobin Strategy = iota
+	// LeastConnections picks the backend with the fewest requests in flight.
+	LeastConnections
+	// ConsistentHash maps each client to a backend by hashing a header or,
+	// without one, the client's IP, so the mapping survives other backends
+	// coming and going.
+	ConsistentHash
+)
+
+const (
+	defaultCheckInterval      = 10 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+	defaultEjectTime          = 30 * time.Second
+	hashReplicas              = 100
+)
+
+// HealthCheck configures active health checks: a GET of Path on every
+// backend each Interval, where any 2xx or 3xx status counts as success.
+type HealthCheck struct {
+	Path string
+	// Interval defaults to 10 seconds and Timeout to Interval.
+	Interval time.Duration
+	Timeout  time.Duration
+	// HealthyThreshold consecutive successes bring a backend back and
+	// UnhealthyThreshold consecutive failures take it out; they default
+	// to 2 and 3.
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// Backend is an upstream server behind a Balancer.
+type Backend struct {
+	URL *url.URL
+
+	active atomic.Int64
+
+	// Guarded by Balancer.mu.
+	healthy      bool
+	successes    int
+	failures     int
+	passiveFails int
+	ejectedUntil time.Time
+	recoveredAt  time.Time
+	current      float64
+}
+
+// Active returns the number of requests in flight to the backend.
+func (b *Backend) Active() int64 {
+	return b.active.Load()
+}
+
+// Balancer spreads requests over backends. Set its fields before the first
+// call to Pick or Start.
+type Balancer struct {
+	Strategy Strategy
+	// HashHeader names the request header hashed by ConsistentHash; the
+	// client IP is used when it is empty or the header is missing.
+	HashHeader string
+	// HealthCheck enables active health checks once Start is called.
+	HealthCheck *HealthCheck
+	// MaxFails consecutive failed requests eject a backend for EjectTime
+	// (default 30 seconds). 0 disables passive ejection.
+	MaxFails  int
+	EjectTime time.Duration
+	// SlowStart ramps the share of traffic sent to a backend that has just
+	// come back up from nothing to its full share over this duration.
+	// It applies to RoundRobin and LeastConnections.
+	SlowStart time.Duration
+	// Transport performs health checks; nil means http.DefaultTransport.
+	Transport http.RoundTripper
+
+	backends []*Backend
+	ring     []ringEntry
+
+	mu     sync.Mutex
+	now    func() time.Time
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type ringEntry struct {
+	hash    uint64
+	backend *Backend
+}
+
+// NewBalancer returns a Balancer over the upstream base URLs, all of which
+// start out healthy.
+func NewBalancer(upstreams ...string) (*Balancer, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("balancer needs at least one upstream")
+	}
+	b := &Balancer{now: time.Now}
+	for _, s := range upstreams {
+		p, err := New(s)
+		if err != nil {
+			return nil, err
+		}
+		backend := &Backend{URL: p.Upstream, healthy: true}
+		b.backends = append(b.backends, backend)
+		for i := range hashReplicas {
+			b.ring = append(b.ring, ringEntry{hashString(s + "#" + strconv.Itoa(i)), backend})
+		}
+	}
+	slices.SortFunc(b.ring, func(x, y ringEntry) int {
+		switch {
+		case x.hash < y.hash:
+			return -1
+		case x.hash > y.hash:
+			return 1
+		}
+		return 0
+	})
+	return b, nil
+}
+
+// Backends returns the balancer's backends in the order given.
+func (b *Balancer) Backends() []*Backend {
+	return slices.Clone(b.backends)
+}
+
+// Healthy reports whether backend is receiving traffic: it passes active
+// health checks and is not ejected.
+func (b *Balancer) Healthy(backend *Backend) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.available(backend, b.now())
+}
+
+// Pick chooses the backend for req.
+func (b *Balancer) Pick(req *request.Request) (*Backend, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+
+	if b.Strategy == ConsistentHash {
+		return b.pickHash(req, now)
+	}
+
+	var best *Backend
+	var bestScore, total float64
+	for _, backend := range b.backends {
+		if !b.available(backend, now) {
+			continue
+		}
+		weight := b.weight(backend, now)
+		var score float64
+		if b.Strategy == LeastConnections {
+			score = -float64(backend.Active()+1) / weight
+		} else {
+			// Smooth weighted round robin, as in nginx: equal weights
+			// give plain rotation.
+			backend.current += weight
+			total += weight
+			score = backend.current
+		}
+		if best == nil || score > bestScore {
+			best, bestScore = backend, score
+		}
+	}
+	if best == nil {
+		return nil, ErrNoBackend
+	}
+	best.current -= total
+	return best, nil
+}
+
+func (b *Balancer) pickHash(req *request.Request, now time.Time) (*Backend, error) {
+	key := ""
+	if b.HashHeader != "" {
+		key = req.Headers.Get(b.HashHeader)
+	}
+	if key == "" && req.RemoteAddr != nil {
+		key = req.RemoteAddr.String()
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			key = host
+		}
+	}
+
+	h := hashString(key)
+	i, _ := slices.BinarySearchFunc(b.ring, h, func(e ringEntry, h uint64) int {
+		switch {
+		case e.hash < h:
+			return -1
+		case e.hash > h:
+			return 1
+		}
+		return 0
+	})
+	for n := range b.ring {
+		e := b.ring[(i+n)%len(b.ring)]
+		if b.available(e.backend, now) {
+			return e.backend, nil
+		}
+	}
+	return nil, ErrNoBackend
+}
+
+// available must be called with mu held. It ends ejections that are over,
+// starting the backend's slow start.
+func (b *Balancer) available(backend *Backend, now time.Time) bool {
+	if !backend.ejectedUntil.IsZero() && !now.Before(backend.ejectedUntil) {
+		backend.recoveredAt = backend.ejectedUntil
+		backend.ejectedUntil = time.Time{}
+	}
+	return backend.healthy && backend.ejectedUntil.IsZero()
+}
+
+// weight is the share of traffic backend gets relative to a fully warmed
+// up one, between 0 and 1.
+func (b *Balancer) weight(backend *Backend, now time.Time) float64 {
+	if b.SlowStart <= 0 || backend.recoveredAt.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(backend.recoveredAt)
+	if elapsed >= b.SlowStart {
+		return 1
+	}
+	// Never quite zero, so a lone recovering backend still gets traffic.
+	return max(float64(elapsed)/float64(b.SlowStart), 0.01)
+}
+
+// Done reports the outcome of a request sent to backend, feeding passive
+// ejection. err is nil if the backend responded.
+func (b *Balancer) Done(backend *Backend, err error) {
+	if b.MaxFails <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		backend.passiveFails = 0
+		return
+	}
+	backend.passiveFails++
+	if backend.passiveFails >= b.MaxFails && backend.ejectedUntil.IsZero() {
+		eject := b.EjectTime
+		if eject == 0 {
+			eject = defaultEjectTime
+		}
+		backend.ejectedUntil = b.now().Add(eject)
+		backend.passiveFails = 0
+	}
+}
+
+// Start begins active health checks if HealthCheck is set. They run until
+// Close.
+func (b *Balancer) Start() {
+	if b.HealthCheck == nil || b.cancel != nil {
+		return
+	}
+	interval := b.HealthCheck.Interval
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	b.done = make(chan struct{})
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			b.CheckHealth(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops the health checks started by Start.
+func (b *Balancer) Close() {
+	if b.cancel == nil {
+		return
+	}
+	b.cancel()
+	<-b.done
+}
+
+// CheckHealth runs one round of active health checks on all backends.
+func (b *Balancer) CheckHealth(ctx context.Context) {
+	hc := b.HealthCheck
+	if hc == nil {
+		return
+	}
+	healthy, unhealthy := hc.HealthyThreshold, hc.UnhealthyThreshold
+	if healthy <= 0 {
+		healthy = defaultHealthyThreshold
+	}
+	if unhealthy <= 0 {
+		unhealthy = defaultUnhealthyThreshold
+	}
+
+	var wg sync.WaitGroup
+	for _, backend := range b.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := b.probe(ctx, backend)
+			if ctx.Err() != nil {
+				return
+			}
+
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if err != nil {
+				backend.successes = 0
+				backend.failures++
+				if backend.healthy && backend.failures >= unhealthy {
+					backend.healthy = false
+				}
+				return
+			}
+			backend.failures = 0
+			backend.successes++
+			if !backend.healthy && backend.successes >= healthy {
+				backend.healthy = true
+				backend.recoveredAt = b.now()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *Balancer) probe(ctx context.Context, backend *Backend) error {
+	hc := b.HealthCheck
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = hc.Interval
+	}
+	if timeout <= 0 {
+		timeout = defaultCheckInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	target := *backend.URL
+	target.Path = joinPath(backend.URL.Path, hc.Path)
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return err
+	}
+	transport := b.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("health check status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV alone spreads similar keys such as ring replica names poorly;
+	// finish with the splitmix64 mixer.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
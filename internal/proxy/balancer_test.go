@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackend is a local upstream that names itself in responses and can
+// be told to fail its health checks.
+type testBackend struct {
+	*httptest.Server
+	name   string
+	sick   atomic.Bool
+	hits   atomic.Int64
+	checks atomic.Int64
+}
+
+func newTestBackend(t *testing.T, name string) *testBackend {
+	t.Helper()
+	b := &testBackend{name: name}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			b.checks.Add(1)
+			if b.sick.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		b.hits.Add(1)
+		io.WriteString(w, b.name)
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func newTestBalancer(t *testing.T, backends ...*testBackend) *Balancer {
+	t.Helper()
+	var urls []string
+	for _, b := range backends {
+		urls = append(urls, b.URL)
+	}
+	lb, err := NewBalancer(urls...)
+	require.NoError(t, err)
+	return lb
+}
+
+func pickN(t *testing.T, lb *Balancer, n int, req *request.Request) map[string]int {
+	t.Helper()
+	counts := map[string]int{}
+	for range n {
+		b, err := lb.Pick(req)
+		require.NoError(t, err)
+		counts[b.URL.String()]++
+	}
+	return counts
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	a, b, c := newTestBackend(t, "a"), newTestBackend(t, "b"), newTestBackend(t, "c")
+	lb := newTestBalancer(t, a, b, c)
+	p := NewBalanced(lb)
+
+	var order []string
+	for range 6 {
+		_, body := do(t, p.Serve, "GET / HTTP/1.1\r\n\r\n")
+		order = append(order, body)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, order)
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	lb := newTestBalancer(t, a, b)
+	lb.Strategy = LeastConnections
+	busy := lb.Backends()[0]
+	busy.active.Add(3)
+
+	counts := pickN(t, lb, 5, newRequest(t, "GET / HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, 5, counts[b.URL])
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	backends := []*testBackend{newTestBackend(t, "a"), newTestBackend(t, "b"), newTestBackend(t, "c"), newTestBackend(t, "d")}
+	lb := newTestBalancer(t, backends...)
+	lb.Strategy = ConsistentHash
+	lb.HashHeader = "X-User"
+
+	pick := func(user string) string {
+		raw := "GET / HTTP/1.1\r\n"
+		if user != "" {
+			raw += "X-User: " + user + "\r\n"
+		}
+		b, err := lb.Pick(newRequest(t, raw+"\r\n"))
+		require.NoError(t, err)
+		return b.URL.String()
+	}
+
+	before := map[string]string{}
+	spread := map[string]int{}
+	for i := range 200 {
+		user := fmt.Sprintf("user-%d", i)
+		before[user] = pick(user)
+		assert.Equal(t, before[user], pick(user), "mapping is stable")
+		spread[before[user]]++
+	}
+	assert.Len(t, spread, 4, "every backend gets some keys")
+
+	// Test: Only keys of a backend that goes down move
+	down := lb.Backends()[1]
+	down.healthy = false
+	for user, was := range before {
+		now := pick(user)
+		if was == down.URL.String() {
+			assert.NotEqual(t, was, now)
+		} else {
+			assert.Equal(t, was, now, user)
+		}
+	}
+
+	// Test: Client IP without the header
+	assert.Equal(t, pick(""), pick(""))
+}
+
+func TestBalancerActiveHealthChecks(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	lb := newTestBalancer(t, a, b)
+	lb.HealthCheck = &HealthCheck{Path: "/healthz", HealthyThreshold: 2, UnhealthyThreshold: 2}
+	backendA := lb.Backends()[0]
+	ctx := context.Background()
+
+	a.sick.Store(true)
+	lb.CheckHealth(ctx)
+	assert.True(t, lb.Healthy(backendA), "one failure is below the threshold")
+	lb.CheckHealth(ctx)
+	assert.False(t, lb.Healthy(backendA))
+	assert.Equal(t, map[string]int{b.URL: 4}, pickN(t, lb, 4, newRequest(t, "GET / HTTP/1.1\r\n\r\n")))
+
+	a.sick.Store(false)
+	lb.CheckHealth(ctx)
+	assert.False(t, lb.Healthy(backendA))
+	lb.CheckHealth(ctx)
+	assert.True(t, lb.Healthy(backendA))
+
+	// Test: Unreachable backends fail checks too
+	b.Close()
+	lb.CheckHealth(ctx)
+	lb.CheckHealth(ctx)
+	assert.False(t, lb.Healthy(lb.Backends()[1]))
+
+	// Test: Start runs checks in the background until Close
+	lb.HealthCheck.Interval = 10 * time.Millisecond
+	lb.Start()
+	require.Eventually(t, func() bool { return a.checks.Load() > 6 }, time.Second, 5*time.Millisecond)
+	lb.Close()
+	n := a.checks.Load()
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, n, a.checks.Load())
+}
+
+func TestBalancerPassiveEjection(t *testing.T) {
+	a := newTestBackend(t, "a")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := "http://" + l.Addr().String()
+	l.Close()
+
+	lb, err := NewBalancer(a.URL, dead)
+	require.NoError(t, err)
+	lb.MaxFails = 2
+	lb.EjectTime = time.Minute
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+	p := NewBalanced(lb)
+	p.Logger = newProxy(t, a.URL).Logger
+
+	var statuses []int
+	for range 6 {
+		resp, _ := do(t, p.Serve, "GET / HTTP/1.1\r\n\r\n")
+		statuses = append(statuses, resp.StatusCode)
+	}
+	// The dead backend fails twice in rotation, then is ejected.
+	assert.Equal(t, []int{200, 502, 200, 502, 200, 200}, statuses)
+	assert.False(t, lb.Healthy(lb.Backends()[1]))
+
+	now = now.Add(time.Minute)
+	assert.True(t, lb.Healthy(lb.Backends()[1]), "ejection ends")
+
+	// Test: Everything down
+	lb.Backends()[0].healthy = false
+	lb.Backends()[1].healthy = false
+	resp, _ := do(t, p.Serve, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	_, err = lb.Pick(newRequest(t, "GET / HTTP/1.1\r\n\r\n"))
+	assert.True(t, errors.Is(err, ErrNoBackend))
+}
+
+func TestBalancerSlowStart(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	lb := newTestBalancer(t, a, b)
+	lb.SlowStart = 10 * time.Second
+	now := time.Now()
+	lb.now = func() time.Time { return now }
+	recovering := lb.Backends()[1]
+	recovering.recoveredAt = now.Add(-2500 * time.Millisecond)
+
+	req := newRequest(t, "GET / HTTP/1.1\r\n\r\n")
+	counts := pickN(t, lb, 100, req)
+	assert.InDelta(t, 20, counts[b.URL], 1, "a quarter of the weight of a warm backend")
+
+	now = now.Add(10 * time.Second)
+	counts = pickN(t, lb, 100, req)
+	assert.InDelta(t, 50, counts[b.URL], 1)
+}
@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+const (
+	dialTimeout  = 30 * time.Second
+	defaultRealm = "proxy"
+)
+
+// errDenied fails connections to addresses ForwardProxy.Deny rules out.
+var errDenied = errors.New("destination denied by proxy rules")
+
+// ForwardProxy lets clients use the server as their HTTP proxy. Requests
+// with absolute-form targets are forwarded to the origin they name and
+// CONNECT requests get a TCP tunnel to it. Set its fields before the first
+// request.
+type ForwardProxy struct {
+	// Allow, if not empty, lists the only destinations clients may reach.
+	// Deny lists destinations they may not and takes precedence. Entries
+	// are hostnames, "*.example.com" for the subdomains of a domain, IP
+	// addresses or CIDR ranges. Names match the host as the client gave it
+	// and IP entries match IP hosts. Deny's IP entries are also checked
+	// against every address the proxy connects to, so names resolving into
+	// a denied range are refused too.
+	Allow []string
+	Deny  []string
+	// Credentials, if set, maps user names to passwords that clients must
+	// present with Basic auth in Proxy-Authorization.
+	Credentials map[string]string
+	// Realm is announced in Proxy-Authenticate challenges; "proxy" if
+	// empty.
+	Realm string
+	// Timeout bounds the wait for response headers of forwarded requests;
+	// 0 means no limit. Tunnels last until either side closes them.
+	Timeout time.Duration
+	// Logger logs upstream failures; nil means the log package's default.
+	Logger *log.Logger
+
+	once    sync.Once
+	allow   []hostRule
+	deny    []hostRule
+	dialer  *net.Dialer
+	forward *ReverseProxy
+}
+
+// hostRule is a parsed Allow or Deny entry: a name, a ".example.com"
+// suffix or an address prefix.
+type hostRule struct {
+	name   string
+	prefix netip.Prefix
+}
+
+func (p *ForwardProxy) init() {
+	for _, s := range p.Allow {
+		p.allow = append(p.allow, parseHostRule(s))
+	}
+	for _, s := range p.Deny {
+		p.deny = append(p.deny, parseHostRule(s))
+	}
+	p.dialer = &net.Dialer{
+		Timeout: dialTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if matchesAny(p.deny, host) {
+				return errDenied
+			}
+			return nil
+		},
+	}
+
+	t := defaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = p.dialer.DialContext
+	p.forward = &ReverseProxy{Timeout: p.Timeout, Transport: t, Logger: p.Logger}
+}
+
+// Serve has the signature of server.Handler. Requests that are neither
+// CONNECT nor in absolute form get 400.
+func (p *ForwardProxy) Serve(w *response.Writer, req *request.Request) {
+	p.once.Do(p.init)
+	if !p.authorized(req) {
+		realm := p.Realm
+		if realm == "" {
+			realm = defaultRealm
+		}
+		h := response.GetDefaultHeaders(0)
+		h.SetNew("Proxy-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+		response.WriteError(w, response.StatusProxyAuthRequired, h)
+		return
+	}
+	if req.RequestLine.Method == "CONNECT" {
+		p.tunnel(w, req)
+		return
+	}
+
+	target := req.RequestLine.RequestTarget
+	u, err := url.Parse(target)
+	if !request.IsAbsoluteForm(target) || err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		response.WriteError(w, response.StatusBadRequest, nil)
+		return
+	}
+	if !p.permitted(u.Hostname()) {
+		response.WriteError(w, response.StatusForbidden, nil)
+		return
+	}
+	p.forward.serve(w, req, &url.URL{Scheme: u.Scheme, Host: u.Host})
+}
+
+// Middleware sends CONNECT and absolute-form requests to the proxy and
+// everything else to next.
+func (p *ForwardProxy) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.Method == "CONNECT" || request.IsAbsoluteForm(req.RequestLine.RequestTarget) {
+				p.Serve(w, req)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
+
+// tunnel connects to the CONNECT target, takes over the client connection
+// and copies bytes both ways until both sides are done. The request's
+// context only bounds the dial: once the connection is taken over, the
+// tunnel outlives the handler timeout and server shutdown.
+func (p *ForwardProxy) tunnel(w *response.Writer, req *request.Request) {
+	target := req.RequestLine.RequestTarget
+	host, _, _ := net.SplitHostPort(target)
+	if !p.permitted(host) {
+		response.WriteError(w, response.StatusForbidden, nil)
+		return
+	}
+
+	ctx := req.Context()
+	upstream, err := p.dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		p.forward.logf("proxy: CONNECT %s: %v", target, err)
+		switch {
+		case errors.Is(err, errDenied):
+			response.WriteError(w, response.StatusForbidden, nil)
+		case isTimeout(err):
+			response.WriteError(w, response.StatusGatewayTimeout, nil)
+		default:
+			response.WriteError(w, response.StatusBadGateway, nil)
+		}
+		return
+	}
+	defer upstream.Close()
+
+	client, buffered, err := w.Hijack()
+	if err != nil {
+		p.forward.logf("proxy: CONNECT %s: %v", target, err)
+		response.WriteError(w, response.StatusInternalServerError, nil)
+		return
+	}
+	defer client.Close()
+
+	// A 2xx answer to CONNECT has no body and no framing headers.
+	ack := response.NewWriter(client)
+	if err := ack.WriteStatusLine(response.StatusOK); err != nil {
+		return
+	}
+	if err := ack.WriteHeaders(headers.NewHeaders()); err != nil {
+		return
+	}
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+	splice(context.WithoutCancel(ctx), client, upstream)
+}
+
+// authorized checks the client's Proxy-Authorization against Credentials.
+func (p *ForwardProxy) authorized(req *request.Request) bool {
+	if p.Credentials == nil {
+		return true
+	}
+	scheme, encoded, ok := strings.Cut(req.Headers.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	want, known := p.Credentials[user]
+	return ok && known && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// permitted applies the Allow and Deny lists to host as the client named
+// it.
+func (p *ForwardProxy) permitted(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if matchesAny(p.deny, host) {
+		return false
+	}
+	return len(p.allow) == 0 || matchesAny(p.allow, host)
+}
+
+func parseHostRule(s string) hostRule {
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return hostRule{prefix: prefix.Masked()}
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return hostRule{prefix: netip.PrefixFrom(addr, addr.BitLen())}
+	}
+	return hostRule{name: strings.TrimPrefix(s, "*")}
+}
+
+func (r hostRule) matches(host string) bool {
+	if r.prefix.IsValid() {
+		addr, err := netip.ParseAddr(host)
+		return err == nil && r.prefix.Contains(addr.Unmap())
+	}
+	if strings.HasPrefix(r.name, ".") {
+		return strings.HasSuffix(host, r.name)
+	}
+	return host == r.name
+}
+
+func matchesAny(rules []hostRule, host string) bool {
+	for _, r := range rules {
+		if r.matches(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// splice copies between a and b in both directions. When one side is done
+// sending, the end of its stream is passed on by closing the other's write
+// half; an error on either side, or ctx ending, closes both.
+func splice(ctx context.Context, a, b net.Conn) {
+	stop := context.AfterFunc(ctx, func() {
+		a.Close()
+		b.Close()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for _, dir := range [][2]net.Conn{{a, b}, {b, a}} {
+		go func() {
+			defer wg.Done()
+			dst, src := dir[0], dir[1]
+			if _, err := io.Copy(dst, src); err != nil {
+				a.Close()
+				b.Close()
+				return
+			}
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			} else {
+				dst.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
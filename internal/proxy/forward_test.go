@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newForwardProxy() *ForwardProxy {
+	return &ForwardProxy{Logger: log.New(io.Discard, "", 0)}
+}
+
+// startEcho runs a TCP server that echoes what it reads until the client
+// closes its write half.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startProxyServer serves p on a local server and returns its address.
+func startProxyServer(t *testing.T, p *ForwardProxy) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &server.Server{Handler: p.Serve}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+func TestForwardProxyAbsoluteForm(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		io.WriteString(w, "origin")
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	p := newForwardProxy()
+	resp, body := do(t, p.Serve, "GET "+upstream.URL+"/a/b?x=1 HTTP/1.1\r\n"+
+		"Host: "+host+"\r\n"+
+		"Proxy-Connection: keep-alive\r\n"+
+		"\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "origin", body)
+	require.NotNil(t, got)
+	assert.Equal(t, "/a/b", got.URL.Path)
+	assert.Equal(t, "x=1", got.URL.RawQuery)
+	assert.Equal(t, host, got.Host)
+	assert.Empty(t, got.Header.Get("Proxy-Connection"))
+
+	// Test: Origin-form requests aren't proxy requests
+	resp, _ = do(t, p.Serve, "GET /a HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Test: Middleware passes them on
+	next := func(w *response.Writer, req *request.Request) { response.WriteError(w, response.StatusNoContent, nil) }
+	resp, _ = do(t, p.Middleware()(next), "GET /a HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, body = do(t, p.Middleware()(next), "GET "+upstream.URL+"/ HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "origin", body)
+}
+
+func TestForwardProxyAuth(t *testing.T) {
+	var gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Proxy-Authorization")
+	}))
+	defer upstream.Close()
+
+	p := newForwardProxy()
+	p.Credentials = map[string]string{"alice": "secret"}
+	p.Realm = "test"
+	req := "GET " + upstream.URL + "/ HTTP/1.1\r\n"
+
+	resp, _ := do(t, p.Serve, req+"\r\n")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, `Basic realm="test", charset="UTF-8"`, resp.Header.Get("Proxy-Authenticate"))
+
+	basic := func(userPass string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(userPass)) + "\r\n"
+	}
+	resp, _ = do(t, p.Serve, req+basic("alice:wrong")+"\r\n")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	resp, _ = do(t, p.Serve, req+basic("bob:secret")+"\r\n")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	resp, _ = do(t, p.Serve, req+basic("alice:secret")+"\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, gotAuth, "credentials are not forwarded")
+}
+
+func TestForwardProxyRules(t *testing.T) {
+	cases := []struct {
+		allow, deny []string
+		host        string
+		want        bool
+	}{
+		{nil, nil, "example.com", true},
+		{nil, []string{"example.com"}, "EXAMPLE.com.", false},
+		{nil, []string{"*.example.com"}, "www.example.com", false},
+		{nil, []string{"*.example.com"}, "example.com", true},
+		{nil, []string{"10.0.0.0/8"}, "10.1.2.3", false},
+		{nil, []string{"::1"}, "::1", false},
+		{[]string{"example.com"}, nil, "example.org", false},
+		{[]string{"*.example.com"}, []string{"bad.example.com"}, "ok.example.com", true},
+		{[]string{"*.example.com"}, []string{"bad.example.com"}, "bad.example.com", false},
+		{[]string{"192.168.0.0/16"}, nil, "192.168.1.1", true},
+	}
+	for _, c := range cases {
+		p := &ForwardProxy{Allow: c.allow, Deny: c.deny}
+		p.once.Do(p.init)
+		assert.Equal(t, c.want, p.permitted(c.host), "%v %v %s", c.allow, c.deny, c.host)
+	}
+
+	// Test: Names resolving into a denied range are refused when dialing
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	p := newForwardProxy()
+	p.Deny = []string{"127.0.0.0/8", "::1"}
+	resp, _ := do(t, p.Serve, "GET http://localhost:"+port+"/ HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = do(t, p.Serve, "CONNECT localhost:"+port+" HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = do(t, p.Serve, "CONNECT 127.0.0.1:"+port+" HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	echo := startEcho(t)
+	addr := startProxyServer(t, newForwardProxy())
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Bytes sent right behind the request go through the tunnel too.
+	_, err = io.WriteString(c, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\nearly ")
+	require.NoError(t, err)
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = io.WriteString(c, "late")
+	require.NoError(t, err)
+	c.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "early late", string(got))
+
+	// Test: Tunnels outlive the handler timeout and server shutdown
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &server.Server{Handler: newForwardProxy().Serve, HandlerTimeout: 50 * time.Millisecond}
+	go s.Serve(l)
+	defer s.Close()
+	c2, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c2.Close()
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(c2, "CONNECT "+echo+" HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	r = bufio.NewReader(c2)
+	resp, err = http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	echoes := func(msg string) {
+		_, err := io.WriteString(c2, msg)
+		require.NoError(t, err)
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(r, got)
+		require.NoError(t, err, msg)
+		assert.Equal(t, msg, string(got))
+	}
+	time.Sleep(150 * time.Millisecond)
+	echoes("after timeout")
+	s.Close()
+	echoes("after close")
+
+	// Test: Unreachable targets
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := l.Addr().String()
+	l.Close()
+	resp2, _ := do(t, newForwardProxy().Serve, "CONNECT "+dead+" HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusBadGateway, resp2.StatusCode)
+
+	// Test: Writers that can't be hijacked
+	resp2, _ = do(t, newForwardProxy().Serve, "CONNECT "+echo+" HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusInternalServerError, resp2.StatusCode)
+}
@@ -0,0 +1,389 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+)
+
+const copyBuffer = 32 * 1024
+
+// hopHeaders are connection-specific fields that a proxy must not forward
+// (RFC 9110 section 7.6.1). Fields named in Connection are dropped too.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// defaultTransport forwards Accept-Encoding as sent by the client instead
+// of negotiating and decoding compression on its own.
+var defaultTransport http.RoundTripper = func() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DisableCompression = true
+	return t
+}()
+
+// ReverseProxy forwards requests to an upstream server and relays its
+// responses.
+type ReverseProxy struct {
+	// Upstream is the base URL requests are forwarded to. Its path is
+	// prepended to the path of each request.
+	Upstream *url.URL
+	// Balancer, if set, picks the upstream for each request from its
+	// backends instead, and is told how each attempt went.
+	Balancer *Balancer
+	// Rewrite, if set, maps the path of the incoming request to the path
+	// forwarded upstream, before it is joined to Upstream's. Paths are in
+	// their escaped form.
+	Rewrite func(path string) string
+	// PreserveHost forwards the client's Host header instead of the
+	// upstream's host.
+	PreserveHost bool
+	// Timeout bounds the wait for the upstream's response headers; 0 means
+	// no limit. The body is streamed for as long as it takes.
+	Timeout time.Duration
+	// Transport performs upstream requests; nil means a transport like
+	// http.DefaultTransport that leaves compression to the client.
+	Transport http.RoundTripper
+	// OnUpstream, if set, is called with the time each upstream exchange
+	// took to produce response headers, or to fail.
+	OnUpstream func(upstream string, d time.Duration)
+	// Logger logs upstream failures; nil means the log package's default.
+	Logger *log.Logger
+}
+
+// New returns a ReverseProxy for the upstream base URL.
+func New(upstream string) (*ReverseProxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("upstream %q is not an absolute http or https URL", upstream)
+	}
+	return &ReverseProxy{Upstream: u}, nil
+}
+
+// StripPrefix returns a Rewrite function that removes prefix from paths.
+func StripPrefix(prefix string) func(string) string {
+	return func(p string) string {
+		p = strings.TrimPrefix(p, prefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		return p
+	}
+}
+
+// NewBalanced returns a ReverseProxy that spreads requests over the
+// backends of b.
+func NewBalanced(b *Balancer) *ReverseProxy {
+	return &ReverseProxy{Balancer: b}
+}
+
+// Serve has the signature of server.Handler.
+func (p *ReverseProxy) Serve(w *response.Writer, req *request.Request) {
+	if p.Balancer == nil {
+		p.serve(w, req, p.Upstream)
+		return
+	}
+
+	backend, err := p.Balancer.Pick(req)
+	if err != nil {
+		response.WriteError(w, response.StatusServiceUnavailable, nil)
+		return
+	}
+	backend.active.Add(1)
+	err = p.serve(w, req, backend.URL)
+	backend.active.Add(-1)
+	p.Balancer.Done(backend, err)
+}
+
+// serve proxies req to upstream. It returns an error only if the upstream
+// failed, not if the client went away.
+func (p *ReverseProxy) serve(w *response.Writer, req *request.Request, upstream *url.URL) error {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	outreq, err := p.outgoingRequest(ctx, req, upstream)
+	if err != nil {
+		p.logf("proxy: %v", err)
+		response.WriteError(w, response.StatusBadGateway, nil)
+		return err
+	}
+
+	transport := p.Transport
+	if transport == nil {
+		transport = defaultTransport
+	}
+	var timer *time.Timer
+	var timedOut atomic.Bool
+	if p.Timeout > 0 {
+		timer = time.AfterFunc(p.Timeout, func() {
+			timedOut.Store(true)
+			cancel()
+		})
+	}
+	start := time.Now()
+	resp, err := transport.RoundTrip(outreq)
+	if timer != nil && !timer.Stop() && err == nil {
+		// The timeout fired as the headers arrived and has cancelled
+		// the body already.
+		resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if p.OnUpstream != nil {
+		p.OnUpstream(upstream.String(), time.Since(start))
+	}
+	if err != nil {
+		if req.Context().Err() != nil {
+			// The client is gone; there is nobody to answer.
+			return nil
+		}
+		p.logf("proxy: %s %s: %v", outreq.Method, outreq.URL, err)
+		switch {
+		case errors.Is(err, errDenied):
+			response.WriteError(w, response.StatusForbidden, nil)
+		case timedOut.Load() || isTimeout(err):
+			response.WriteError(w, response.StatusGatewayTimeout, nil)
+		default:
+			response.WriteError(w, response.StatusBadGateway, nil)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	return p.relay(w, req, resp)
+}
+
+// outgoingRequest builds the upstream request for req.
+func (p *ReverseProxy) outgoingRequest(ctx context.Context, req *request.Request, upstream *url.URL) (*http.Request, error) {
+	path := req.Path()
+	if p.Rewrite != nil {
+		path = p.Rewrite(path)
+	}
+	// path is still escaped as it was in the request; keeping that form
+	// in RawPath preserves escapes such as %2F that Path can't express.
+	rawPath := joinPath(upstream.EscapedPath(), path)
+	unescaped, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, err
+	}
+	target := *upstream
+	target.Path = unescaped
+	target.RawPath = rawPath
+	if _, query, ok := strings.Cut(req.RequestLine.RequestTarget, "?"); ok {
+		target.RawQuery = query
+	}
+
+	var body io.Reader = http.NoBody
+	if len(req.Body) > 0 {
+		body = bytes.NewReader(req.Body)
+	}
+	outreq, err := http.NewRequestWithContext(ctx, req.RequestLine.Method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	outreq.ContentLength = int64(len(req.Body))
+
+	for k, v := range req.Headers {
+		switch k {
+		case "host", "content-length":
+			continue
+		}
+		outreq.Header.Set(k, v)
+	}
+	removeHopHeaders(outreq.Header)
+	if te := req.Headers.Get("TE"); strings.Contains(strings.ToLower(te), "trailers") {
+		outreq.Header.Set("Te", "trailers")
+	}
+
+	host := req.Headers.Get("Host")
+	if p.PreserveHost && host != "" {
+		outreq.Host = host
+	}
+	addForwarded(outreq.Header, req, host)
+	return outreq, nil
+}
+
+// addForwarded records the client and the original request in both the
+// standard Forwarded field and the de facto X-Forwarded-* fields.
+func addForwarded(h http.Header, req *request.Request, host string) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	var ip string
+	if req.RemoteAddr != nil {
+		ip = req.RemoteAddr.String()
+		if hostPart, _, err := net.SplitHostPort(ip); err == nil {
+			ip = hostPart
+		}
+	}
+
+	forFor := "unknown"
+	if ip != "" {
+		forFor = ip
+		if strings.Contains(ip, ":") {
+			forFor = `"[` + ip + `]"`
+		}
+	}
+	elem := "for=" + forFor + ";proto=" + proto
+	if host != "" {
+		elem += ";host=" + quoteIfNeeded(host)
+	}
+	appendValue(h, "Forwarded", elem)
+	if ip != "" {
+		appendValue(h, "X-Forwarded-For", ip)
+	}
+	if host != "" {
+		h.Set("X-Forwarded-Host", host)
+	}
+	h.Set("X-Forwarded-Proto", proto)
+}
+
+// relay copies the upstream response to w, streaming the body. Like serve
+// it only reports errors reading from the upstream.
+func (p *ReverseProxy) relay(w *response.Writer, req *request.Request, resp *http.Response) error {
+	removeHopHeaders(resp.Header)
+	h := headers.NewHeaders()
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			h.Set(k, v)
+		}
+	}
+
+	bodiless := req.RequestLine.Method == "HEAD" || resp.StatusCode < 200 ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+	var trailers []string
+	for k := range resp.Trailer {
+		trailers = append(trailers, k)
+	}
+	slices.Sort(trailers)
+	chunked := !bodiless && (resp.ContentLength < 0 || len(trailers) > 0)
+	switch {
+	case chunked:
+		h.Del("Content-Length")
+		h.SetNew("Transfer-Encoding", "chunked")
+		if len(trailers) > 0 {
+			h.SetNew("Trailer", strings.Join(trailers, ", "))
+		}
+	case resp.ContentLength >= 0:
+		h.SetNew("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+		return nil
+	}
+	if err := w.WriteHeaders(h); err != nil || bodiless {
+		return nil
+	}
+
+	buf := make([]byte, copyBuffer)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return nil
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			// Headers are gone already; the truncated body tells the
+			// server not to reuse the connection.
+			if req.Context().Err() != nil {
+				return nil
+			}
+			p.logf("proxy: reading upstream body: %v", rerr)
+			return rerr
+		}
+	}
+
+	if !chunked {
+		return nil
+	}
+	th := headers.NewHeaders()
+	for k, vs := range resp.Trailer {
+		for _, v := range vs {
+			th.Set(k, v)
+		}
+	}
+	w.WriteChunkedBodyDone(th)
+	return nil
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for name := range strings.SplitSeq(f, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func appendValue(h http.Header, key, value string) {
+	if prior := h.Get(key); prior != "" {
+		value = prior + ", " + value
+	}
+	h.Set(key, value)
+}
+
+func quoteIfNeeded(s string) string {
+	if strings.ContainsAny(s, ":[]") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func joinPath(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+	return a + b
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
+
+func (p *ReverseProxy) logf(format string, args ...any) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(t *testing.T, raw string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	req.RemoteAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5555}
+	return req
+}
+
+// do runs h for raw and parses what it wrote.
+func do(t *testing.T, h func(*response.Writer, *request.Request), raw string) (*http.Response, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	h(w, newRequest(t, raw))
+	require.NoError(t, w.Close())
+
+	req, _ := http.NewRequest(strings.Fields(raw)[0], "/", nil)
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func newProxy(t *testing.T, upstream string) *ReverseProxy {
+	t.Helper()
+	p, err := New(upstream)
+	require.NoError(t, err)
+	p.Logger = log.New(io.Discard, "", 0)
+	return p
+}
+
+func TestReverseProxyForwardsRequest(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got, gotBody = r, string(b)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "secret")
+		w.Header().Set("X-Upstream", "yes")
+		w.Header().Add("Set-Cookie", "a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	defer upstream.Close()
+
+	p := newProxy(t, upstream.URL+"/base/")
+	p.Rewrite = StripPrefix("/api")
+	resp, body := do(t, p.Serve, "POST /api/items?x=1&y=2 HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Content-Length: 5\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Connection: keep-alive, X-Client-Hop\r\n"+
+		"X-Client-Hop: drop me\r\n"+
+		"Proxy-Authorization: Basic Zm9vOmJhcg==\r\n"+
+		"X-Forwarded-For: 192.0.2.1\r\n"+
+		"X-Custom: kept\r\n"+
+		"\r\nhello")
+
+	require.NotNil(t, got)
+	assert.Equal(t, "POST", got.Method)
+	assert.Equal(t, "/base/items", got.URL.Path)
+	assert.Equal(t, "x=1&y=2", got.URL.RawQuery)
+	assert.Equal(t, "hello", gotBody)
+	assert.Equal(t, "text/plain", got.Header.Get("Content-Type"))
+	assert.Equal(t, "kept", got.Header.Get("X-Custom"))
+	assert.Empty(t, got.Header.Get("X-Client-Hop"))
+	assert.Empty(t, got.Header.Get("Proxy-Authorization"))
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), got.Host)
+	assert.Equal(t, "for=10.0.0.1;proto=http;host=example.com", got.Header.Get("Forwarded"))
+	assert.Equal(t, "192.0.2.1, 10.0.0.1", got.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "example.com", got.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", got.Header.Get("X-Forwarded-Proto"))
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "yes", resp.Header.Get("X-Upstream"))
+	assert.Empty(t, resp.Header.Get("X-Upstream-Hop"))
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2"}, resp.Header.Values("Set-Cookie"))
+	assert.Equal(t, int64(11), resp.ContentLength)
+	assert.Equal(t, `{"ok":true}`, body)
+
+	// Test: PreserveHost
+	p.PreserveHost = true
+	do(t, p.Serve, "GET /api/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, "example.com", got.Host)
+
+	// Test: Escapes in the path reach the upstream as sent
+	do(t, p.Serve, "GET /api/a%20b/c%2Fd?q=%20 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, "/base/a%20b/c%2Fd?q=%20", got.RequestURI)
+	assert.Equal(t, "/base/a b/c/d", got.URL.Path)
+}
+
+func TestReverseProxyStreamsWithTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		for i := range 3 {
+			io.WriteString(w, strings.Repeat(string(rune('a'+i)), 10))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+	defer upstream.Close()
+
+	resp, body := do(t, newProxy(t, upstream.URL).Serve, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, strings.Repeat("a", 10)+strings.Repeat("b", 10)+strings.Repeat("c", 10), body)
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestReverseProxyBodilessResponses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cached" {
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "full body")
+	}))
+	defer upstream.Close()
+	p := newProxy(t, upstream.URL)
+
+	resp, body := do(t, p.Serve, "HEAD / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(9), resp.ContentLength)
+	assert.Empty(t, body)
+
+	resp, _ = do(t, p.Serve, "GET /cached HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+}
+
+func TestReverseProxyUpstreamFailures(t *testing.T) {
+	// Test: Nothing listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	resp, _ := do(t, newProxy(t, "http://"+addr).Serve, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// Test: Slow upstream
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	p := newProxy(t, slow.URL)
+	p.Timeout = 50 * time.Millisecond
+	var observed time.Duration
+	p.OnUpstream = func(upstream string, d time.Duration) {
+		assert.Equal(t, slow.URL, upstream)
+		observed = d
+	}
+	resp, _ = do(t, p.Serve, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.GreaterOrEqual(t, observed, 50*time.Millisecond)
+}
+
+func TestNew(t *testing.T) {
+	for _, bad := range []string{"", "/relative", "ftp://example.com", "http://"} {
+		_, err := New(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -2,11 +2,15 @@ package request
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	h "github.com/nhdewitt/http-from-tcp/internal/headers"
 )
@@ -19,14 +23,64 @@ const (
 	stateInitialized requestState = iota
 	stateParsingHeaders
 	stateParsingBody
+	stateParsingChunks
 	stateDone
 )
 
+type chunkState int
+
+const (
+	chunkSize chunkState = iota
+	chunkData
+	chunkDataEnd
+	chunkTrailer
+)
+
+// maxChunkLine limits a chunk-size or trailer line of a chunked body.
+const maxChunkLine = 4096
+
+var (
+	ErrHeaderTooLarge       = errors.New("request header too large")
+	ErrBodyTooLarge         = errors.New("request body too large")
+	ErrMalformedRequestLine = errors.New("malformed request line")
+	ErrMalformedHeader      = errors.New("malformed header")
+	ErrMalformedBody        = errors.New("malformed body")
+	ErrTruncated            = errors.New("request truncated")
+	// ErrUnsupportedTransferEncoding is returned for a Transfer-Encoding
+	// other than chunked.
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer encoding")
+)
+
 type Request struct {
 	RequestLine RequestLine
 	Headers     h.Headers
 	state       requestState
 	Body        []byte
+	// RawBody and RawContentEncoding keep the body and Content-Encoding as
+	// received once Body has been decoded, e.g. by middleware.Decompress.
+	// Both are empty otherwise.
+	RawBody            []byte
+	RawContentEncoding string
+	// Connection metadata, set by the server. ConnID identifies the
+	// connection within the server's lifetime and Sequence counts requests
+	// on it from 1. ReceivedAt is when the first byte of the request
+	// arrived and ReadAt when the request was fully read. TLS is set for
+	// requests received over TLS.
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	ConnID     uint64
+	Sequence   int
+	ReceivedAt time.Time
+	ReadAt     time.Time
+	TLS        *TLSInfo
+
+	ctx            context.Context
+	pathValues     map[string]string
+	headerBytes    int
+	maxHeaderBytes int
+	maxBodyBytes   int64
+	chunk          chunkState
+	chunkLeft      int64
 }
 
 type RequestLine struct {
@@ -35,50 +89,104 @@ type RequestLine struct {
 	Method        string
 }
 
+// Limits bounds how much of a request the parser will accept. Zero values
+// mean no limit.
+type Limits struct {
+	MaxHeaderBytes int
+	MaxBodyBytes   int64
+}
+
+// Reader parses consecutive requests from a single stream, keeping any bytes
+// read past the end of one request for the next.
+type Reader struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+	limits      Limits
+}
+
+func NewReader(reader io.Reader, limits Limits) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+		limits: limits,
+	}
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
+	r, err := NewReader(reader, Limits{}).ReadRequest()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
+// Buffered returns the bytes read from the underlying reader that have not
+// been consumed by a request yet.
+func (rr *Reader) Buffered() []byte {
+	return rr.buf[:rr.readToIndex]
+}
+
+// ReadRequest parses the next request. It returns io.EOF if the stream ends
+// cleanly before any byte of a new request has been read. On other errors
+// it also returns whatever part of the request was parsed, which may be
+// useful for logging.
+func (rr *Reader) ReadRequest() (*Request, error) {
 	r := Request{
-		Headers: h.Headers{},
-		Body:    []byte{},
-		state:   stateInitialized,
+		Headers:        h.Headers{},
+		Body:           []byte{},
+		state:          stateInitialized,
+		maxHeaderBytes: rr.limits.MaxHeaderBytes,
+		maxBodyBytes:   rr.limits.MaxBodyBytes,
 	}
 
 	for r.state != stateDone {
-		if readToIndex == len(buf) {
-			tmpBuf := make([]byte, len(buf)*2)
-			copy(tmpBuf, buf[:readToIndex])
-			buf = tmpBuf
-		}
-
-		n, err := reader.Read(buf[readToIndex:])
-		if n > 0 {
-			readToIndex += n
-
-			bytesParsed, perr := r.parse(buf[:readToIndex])
+		if rr.readToIndex > 0 {
+			bytesParsed, perr := r.parse(rr.buf[:rr.readToIndex])
 			if perr != nil {
-				return nil, perr
+				return &r, perr
 			}
+			copy(rr.buf, rr.buf[bytesParsed:rr.readToIndex])
+			rr.readToIndex -= bytesParsed
+			if r.state == stateDone {
+				break
+			}
+		}
 
-			copy(buf, buf[bytesParsed:readToIndex])
-			readToIndex -= bytesParsed
+		if rr.readToIndex == len(rr.buf) {
+			tmpBuf := make([]byte, len(rr.buf)*2)
+			copy(tmpBuf, rr.buf[:rr.readToIndex])
+			rr.buf = tmpBuf
 		}
 
+		n, err := rr.reader.Read(rr.buf[rr.readToIndex:])
+		rr.readToIndex += n
+
 		if err != nil {
+			if n > 0 {
+				bytesParsed, perr := r.parse(rr.buf[:rr.readToIndex])
+				if perr != nil {
+					return &r, perr
+				}
+				copy(rr.buf, rr.buf[bytesParsed:rr.readToIndex])
+				rr.readToIndex -= bytesParsed
+			}
 			if errors.Is(err, io.EOF) {
+				if r.state == stateInitialized && rr.readToIndex == 0 && n == 0 {
+					return nil, io.EOF
+				}
 				if r.state == stateParsingBody {
 					contentLength, _ := strconv.Atoi(r.Headers.Get("content-length"))
 					if len(r.Body) < contentLength {
-						return nil, fmt.Errorf("body shorter than content-length")
+						return &r, fmt.Errorf("%w: body shorter than content-length", ErrTruncated)
 					}
 				}
 				if r.state != stateDone && r.state != stateParsingBody {
-					return nil, fmt.Errorf("error parsing data: early EOF")
+					return &r, fmt.Errorf("%w: error parsing data: early EOF", ErrTruncated)
 				}
 				break
 			}
-			return nil, err
+			return &r, err
 		}
 	}
 
@@ -86,6 +194,25 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 }
 
 func (r *Request) parse(data []byte) (int, error) {
+	totalBytesParsed := 0
+	for r.state != stateDone {
+		n, err := r.parseSingle(data[totalBytesParsed:])
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		totalBytesParsed += n
+	}
+	if r.maxHeaderBytes > 0 && (r.state == stateInitialized || r.state == stateParsingHeaders) &&
+		r.headerBytes+len(data)-totalBytesParsed > r.maxHeaderBytes {
+		return 0, ErrHeaderTooLarge
+	}
+	return totalBytesParsed, nil
+}
+
+func (r *Request) parseSingle(data []byte) (int, error) {
 	var totalBytesParsed int
 	switch r.state {
 	case stateInitialized:
@@ -94,11 +221,12 @@ func (r *Request) parse(data []byte) (int, error) {
 			return 0, nil
 		}
 		if err != nil {
-			return 0, fmt.Errorf("error parsing data: %v", err)
+			return 0, fmt.Errorf("%w: error parsing data: %v", ErrMalformedRequestLine, err)
 		}
 
 		r.RequestLine = parsedRequest
 		r.state = stateParsingHeaders
+		r.headerBytes += parsed
 		totalBytesParsed = parsed
 		return totalBytesParsed, nil
 
@@ -106,21 +234,20 @@ func (r *Request) parse(data []byte) (int, error) {
 		for {
 			n, done, err := h.Headers.Parse(r.Headers, data[totalBytesParsed:])
 			if err != nil {
-				return 0, err
+				return 0, fmt.Errorf("%w: %v", ErrMalformedHeader, err)
 			}
 			if n == 0 && !done {
 				return totalBytesParsed, nil
 			}
 
 			totalBytesParsed += n
+			r.headerBytes += n
+			if r.maxHeaderBytes > 0 && r.headerBytes > r.maxHeaderBytes {
+				return 0, ErrHeaderTooLarge
+			}
 
 			if done {
-				r.state = stateParsingBody
-				contentLength := r.Headers.Get("content-length")
-				if contentLength == "" {
-					r.state = stateDone
-				}
-				return totalBytesParsed, nil
+				return totalBytesParsed, r.startBody()
 			}
 		}
 
@@ -128,11 +255,11 @@ func (r *Request) parse(data []byte) (int, error) {
 		contentLength := r.Headers.Get("content-length")
 		length, err := strconv.Atoi(contentLength)
 		if err != nil {
-			return 0, fmt.Errorf("error: malformed content-length header")
+			return 0, fmt.Errorf("%w: malformed content-length header", ErrMalformedHeader)
 		}
 		remaining := length - len(r.Body)
 		if remaining <= 0 {
-			return 0, fmt.Errorf("error: body exceeds content-length")
+			return 0, fmt.Errorf("%w: body exceeds content-length", ErrMalformedBody)
 		}
 		take := min(len(data), remaining)
 		r.Body = append(r.Body, data[:take]...)
@@ -142,10 +269,12 @@ func (r *Request) parse(data []byte) (int, error) {
 			r.state = stateDone
 			return consumed, nil
 		} else if len(r.Body) > length {
-			return consumed, fmt.Errorf("error: body exceeds content-length")
+			return consumed, fmt.Errorf("%w: body exceeds content-length", ErrMalformedBody)
 		}
 
 		return consumed, nil
+	case stateParsingChunks:
+		return r.parseChunked(data)
 	case stateDone:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
 	default:
@@ -153,6 +282,181 @@ func (r *Request) parse(data []byte) (int, error) {
 	}
 }
 
+func (r *Request) startBody() error {
+	contentLength := r.Headers.Get("content-length")
+	if te := r.Headers.Get("transfer-encoding"); te != "" {
+		// Reading the body by one framing while a proxy in front used the
+		// other would let a client smuggle requests past it.
+		if contentLength != "" {
+			return fmt.Errorf("%w: both transfer-encoding and content-length", ErrMalformedHeader)
+		}
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, te)
+		}
+		r.state = stateParsingChunks
+		return nil
+	}
+	if contentLength == "" {
+		r.state = stateDone
+		return nil
+	}
+	length, err := strconv.Atoi(contentLength)
+	if err != nil || length < 0 {
+		return fmt.Errorf("%w: malformed content-length header", ErrMalformedHeader)
+	}
+	if r.maxBodyBytes > 0 && int64(length) > r.maxBodyBytes {
+		return ErrBodyTooLarge
+	}
+	if length == 0 {
+		r.state = stateDone
+		return nil
+	}
+	r.state = stateParsingBody
+	return nil
+}
+
+// parseChunked decodes a chunked body (RFC 9112, section 7.1). Chunk
+// extensions and trailer fields are read and dropped. Once the body is
+// complete it is described by a Content-Length instead of the
+// Transfer-Encoding.
+func (r *Request) parseChunked(data []byte) (int, error) {
+	switch r.chunk {
+	case chunkSize, chunkTrailer:
+		idx := bytes.Index(data, []byte(crlf))
+		if idx == -1 {
+			if len(data) > maxChunkLine {
+				return 0, fmt.Errorf("%w: chunk line too long", ErrMalformedBody)
+			}
+			return 0, nil
+		}
+		line := string(data[:idx])
+		if r.chunk == chunkTrailer {
+			if line == "" {
+				r.Headers.Del("transfer-encoding")
+				r.Headers.SetNew("content-length", strconv.Itoa(len(r.Body)))
+				r.state = stateDone
+			}
+			return idx + len(crlf), nil
+		}
+		sizeStr, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseUint(strings.TrimSpace(sizeStr), 16, 63)
+		if err != nil {
+			return 0, fmt.Errorf("%w: malformed chunk size", ErrMalformedBody)
+		}
+		size := int64(n)
+		if r.maxBodyBytes > 0 && int64(len(r.Body))+size > r.maxBodyBytes {
+			return 0, ErrBodyTooLarge
+		}
+		if size == 0 {
+			r.chunk = chunkTrailer
+		} else {
+			r.chunk = chunkData
+			r.chunkLeft = size
+		}
+		return idx + len(crlf), nil
+	case chunkData:
+		take := int(min(int64(len(data)), r.chunkLeft))
+		r.Body = append(r.Body, data[:take]...)
+		r.chunkLeft -= int64(take)
+		if r.chunkLeft == 0 {
+			r.chunk = chunkDataEnd
+		}
+		return take, nil
+	case chunkDataEnd:
+		if len(data) < len(crlf) {
+			return 0, nil
+		}
+		if string(data[:len(crlf)]) != crlf {
+			return 0, fmt.Errorf("%w: chunk not followed by CRLF", ErrMalformedBody)
+		}
+		r.chunk = chunkSize
+		return len(crlf), nil
+	}
+	return 0, fmt.Errorf("error: unknown chunk state")
+}
+
+// Context returns the request's context. For requests from the server it is
+// cancelled when the client disconnects, the server closes or the handler
+// timeout expires.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context set to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// PathValue returns the value of the named path parameter set by a router,
+// or "" if there is none.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
+}
+
+// Path returns the request target without its query string. For targets in
+// absolute form, as sent to proxies, it is the path of the URL.
+func (r *Request) Path() string {
+	target := r.RequestLine.RequestTarget
+	if IsAbsoluteForm(target) {
+		_, rest, _ := strings.Cut(target, "://")
+		i := strings.IndexAny(rest, "/?")
+		if i < 0 || rest[i] == '?' {
+			return "/"
+		}
+		target = rest[i:]
+	}
+	path, _, _ := strings.Cut(target, "?")
+	return path
+}
+
+// IsAbsoluteForm reports whether target is a full URL, the form clients use
+// for requests sent through a proxy (RFC 9112 section 3.2.2).
+func IsAbsoluteForm(target string) bool {
+	scheme, rest, ok := strings.Cut(target, "://")
+	return ok && scheme != "" && rest != "" && !strings.ContainsAny(scheme, "/?")
+}
+
+// validateTarget checks that target has a form allowed for method: origin
+// form ("/path?query") or absolute form for any method, authority form
+// ("host:port") for CONNECT only and "*" for OPTIONS only.
+func validateTarget(method, target string) error {
+	switch {
+	case method == "CONNECT":
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" {
+			return fmt.Errorf("invalid CONNECT target: %s", target)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("invalid CONNECT target: %s", target)
+		}
+	case target == "*":
+		if method != "OPTIONS" {
+			return fmt.Errorf("invalid target for %s: %s", method, target)
+		}
+	case strings.HasPrefix(target, "/"):
+	case IsAbsoluteForm(target):
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid request target: %s", target)
+		}
+	default:
+		return fmt.Errorf("invalid request target: %s", target)
+	}
+	return nil
+}
+
 func parseRequestLine(req []byte) (int, RequestLine, error) {
 	idx := bytes.Index(req, []byte(crlf))
 	if idx == -1 {
@@ -183,6 +487,9 @@ func requestLineFromString(s string) (*RequestLine, error) {
 	}
 
 	target := parts[1]
+	if err := validateTarget(method, target); err != nil {
+		return nil, err
+	}
 
 	protocol, version, ok := strings.Cut(parts[2], "/")
 	if !ok || protocol != "HTTP" {
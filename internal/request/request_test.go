@@ -2,6 +2,7 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -244,3 +245,127 @@ func TestParsingBody(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Equal(t, "", string(r.Body))
 }
+
+func TestReaderPipelinedRequests(t *testing.T) {
+	reader := &chunkReader{
+		data: "POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc" +
+			"GET /b HTTP/1.1\r\nHost: x\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	rr := NewReader(reader, Limits{})
+
+	r, err := rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	assert.Equal(t, "abc", string(r.Body))
+
+	r, err = rr.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	assert.Equal(t, "x", r.Headers.Get("host"))
+
+	_, err = rr.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: A chunked body is decoded and the next pipelined request kept
+	for _, n := range []int{1, 3, 7, 100} {
+		reader := &chunkReader{
+			data: "POST /a HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5;ext=1\r\nhello\r\n7\r\n, world\r\n0\r\nX-Trailer: 1\r\n\r\n" +
+				"GET /b HTTP/1.1\r\nHost: x\r\n\r\n",
+			numBytesPerRead: n,
+		}
+		rr := NewReader(reader, Limits{})
+
+		r, err := rr.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "hello, world", string(r.Body))
+		assert.Empty(t, r.Headers.Get("transfer-encoding"))
+		assert.Equal(t, "12", r.Headers.Get("content-length"))
+		assert.Empty(t, r.Headers.Get("x-trailer"))
+
+		r, err = rr.ReadRequest()
+		require.NoError(t, err)
+		assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+	}
+
+	cases := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"with content-length", "Transfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n0\r\n\r\n", ErrMalformedHeader},
+		{"other coding", "Transfer-Encoding: gzip, chunked\r\n\r\n", ErrUnsupportedTransferEncoding},
+		{"bad size", "Transfer-Encoding: chunked\r\n\r\n+5\r\nhello\r\n0\r\n\r\n", ErrMalformedBody},
+		{"missing crlf", "Transfer-Encoding: chunked\r\n\r\n5\r\nhelloX\r\n0\r\n\r\n", ErrMalformedBody},
+		{"truncated", "Transfer-Encoding: chunked\r\n\r\n5\r\nhel", ErrTruncated},
+		{"too large", "Transfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n", ErrBodyTooLarge},
+	}
+	for _, c := range cases {
+		reader := &chunkReader{data: "POST / HTTP/1.1\r\n" + c.data, numBytesPerRead: 4}
+		_, err := NewReader(reader, Limits{MaxBodyBytes: 5}).ReadRequest()
+		assert.ErrorIs(t, err, c.err, c.name)
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	// Test: Header too large
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 100) + "\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	_, err := NewReader(reader, Limits{MaxHeaderBytes: 64}).ReadRequest()
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Body too large
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789",
+		numBytesPerRead: 5,
+	}
+	_, err = NewReader(reader, Limits{MaxBodyBytes: 5}).ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Within limits
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\n01234",
+		numBytesPerRead: 5,
+	}
+	r, err := NewReader(reader, Limits{MaxHeaderBytes: 64, MaxBodyBytes: 5}).ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "01234", string(r.Body))
+}
+
+func TestRequestTargetForms(t *testing.T) {
+	cases := []struct {
+		line     string
+		wantPath string
+	}{
+		{"GET /a/b?x=1 HTTP/1.1", "/a/b"},
+		{"GET http://example.com/a/b?x=1 HTTP/1.1", "/a/b"},
+		{"GET http://example.com HTTP/1.1", "/"},
+		{"GET http://example.com?x=1 HTTP/1.1", "/"},
+		{"CONNECT example.com:443 HTTP/1.1", "example.com:443"},
+		{"CONNECT [::1]:8443 HTTP/1.1", "[::1]:8443"},
+		{"OPTIONS * HTTP/1.1", "*"},
+	}
+	for _, c := range cases {
+		r, err := RequestFromReader(strings.NewReader(c.line + "\r\n\r\n"))
+		require.NoError(t, err, c.line)
+		assert.Equal(t, c.wantPath, r.Path(), c.line)
+	}
+
+	for _, line := range []string{
+		"GET coffee HTTP/1.1",
+		"GET * HTTP/1.1",
+		"GET example.com:443 HTTP/1.1",
+		"CONNECT example.com HTTP/1.1",
+		"CONNECT /path HTTP/1.1",
+		"CONNECT example.com:0 HTTP/1.1",
+		"GET http:///nohost HTTP/1.1",
+	} {
+		_, err := RequestFromReader(strings.NewReader(line + "\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrMalformedRequestLine, line)
+	}
+}
@@ -0,0 +1,79 @@
+package request
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// TLSInfo describes the TLS connection a request arrived on.
+type TLSInfo struct {
+	Version            uint16
+	CipherSuite        uint16
+	ServerName         string
+	NegotiatedProtocol string
+	// PeerCertificates is the chain presented by the client, leaf first.
+	// It is only trustworthy if VerifiedChains is non-empty, which the
+	// server guarantees when client certificates are verified.
+	PeerCertificates []*x509.Certificate
+	VerifiedChains   [][]*x509.Certificate
+}
+
+func NewTLSInfo(cs tls.ConnectionState) *TLSInfo {
+	return &TLSInfo{
+		Version:            cs.Version,
+		CipherSuite:        cs.CipherSuite,
+		ServerName:         cs.ServerName,
+		NegotiatedProtocol: cs.NegotiatedProtocol,
+		PeerCertificates:   cs.PeerCertificates,
+		VerifiedChains:     cs.VerifiedChains,
+	}
+}
+
+func (t *TLSInfo) VersionName() string {
+	return tls.VersionName(t.Version)
+}
+
+func (t *TLSInfo) CipherSuiteName() string {
+	return tls.CipherSuiteName(t.CipherSuite)
+}
+
+// Verified reports whether the client presented a certificate that chains
+// to a trusted CA.
+func (t *TLSInfo) Verified() bool {
+	return len(t.VerifiedChains) > 0
+}
+
+// PeerCertificate returns the client's leaf certificate, or nil.
+func (t *TLSInfo) PeerCertificate() *x509.Certificate {
+	if len(t.PeerCertificates) == 0 {
+		return nil
+	}
+	return t.PeerCertificates[0]
+}
+
+// Subject returns the distinguished name of the client certificate, or ""
+// if there is none.
+func (t *TLSInfo) Subject() string {
+	if c := t.PeerCertificate(); c != nil {
+		return c.Subject.String()
+	}
+	return ""
+}
+
+// SANs returns the DNS names, IP addresses, email addresses and URIs in the
+// client certificate's subject alternative names.
+func (t *TLSInfo) SANs() []string {
+	c := t.PeerCertificate()
+	if c == nil {
+		return nil
+	}
+	sans := append([]string{}, c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, c.EmailAddresses...)
+	for _, u := range c.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
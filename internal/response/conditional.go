@@ -0,0 +1,131 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+)
+
+// StrongETag returns tag as a strong entity tag, e.g. "abc".
+func StrongETag(tag string) string {
+	return `"` + tag + `"`
+}
+
+// WeakETag returns tag as a weak entity tag, e.g. W/"abc".
+func WeakETag(tag string) string {
+	return `W/"` + tag + `"`
+}
+
+// ContentETag returns a strong entity tag derived from a hash of body.
+func ContentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return StrongETag(base64.RawURLEncoding.EncodeToString(sum[:16]))
+}
+
+// FileETag returns a strong entity tag derived from a file's modification
+// time and size, so it changes whenever the file does without reading it.
+func FileETag(modtime time.Time, size int64) string {
+	return StrongETag(fmt.Sprintf("%x-%x", modtime.UnixNano(), size))
+}
+
+// CheckPreconditions evaluates the conditional headers of req against the
+// current representation's entity tag and modification time, either of
+// which may be empty, in the order of RFC 9110 section 13.2.2. It returns
+// StatusNotModified or StatusPreconditionFailed if the request should be
+// answered with that status instead, and 0 otherwise.
+func CheckPreconditions(req *request.Request, etag string, modtime time.Time) StatusCode {
+	method := req.RequestLine.Method
+	safe := method == "GET" || method == "HEAD"
+	modtime = modtime.Truncate(time.Second)
+
+	if im := req.Headers.Get("If-Match"); im != "" {
+		if !etagListMatches(im, etag, true) {
+			return StatusPreconditionFailed
+		}
+	} else if ius := req.Headers.Get("If-Unmodified-Since"); ius != "" && !modtime.IsZero() {
+		if t, err := http.ParseTime(ius); err == nil && modtime.After(t) {
+			return StatusPreconditionFailed
+		}
+	}
+
+	if inm := req.Headers.Get("If-None-Match"); inm != "" {
+		if etagListMatches(inm, etag, false) {
+			if safe {
+				return StatusNotModified
+			}
+			return StatusPreconditionFailed
+		}
+	} else if ims := req.Headers.Get("If-Modified-Since"); ims != "" && safe && !modtime.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !modtime.After(t) {
+			return StatusNotModified
+		}
+	}
+	return 0
+}
+
+// CheckConditional evaluates the preconditions of req against the ETag and
+// Last-Modified fields of h, the headers the full response would carry. If
+// they fail it writes a 304 or 412 response and reports true; the caller
+// must then not write anything else.
+func CheckConditional(w *Writer, req *request.Request, h headers.Headers) bool {
+	var modtime time.Time
+	if lm := h.Get("Last-Modified"); lm != "" {
+		modtime, _ = http.ParseTime(lm)
+	}
+	switch CheckPreconditions(req, h.Get("ETag"), modtime) {
+	case StatusNotModified:
+		writeNotModified(w, h)
+		return true
+	case StatusPreconditionFailed:
+		WriteError(w, StatusPreconditionFailed, nil)
+		return true
+	}
+	return false
+}
+
+// writeNotModified sends a 304 with the validators and caching fields of h
+// but none of the fields describing the omitted body.
+func writeNotModified(w *Writer, h headers.Headers) {
+	out := headers.NewHeaders()
+	for k, v := range h {
+		switch k {
+		case "content-length", "content-type", "content-range", "content-encoding", "transfer-encoding", "trailer", "accept-ranges":
+			continue
+		}
+		out.SetNew(k, v)
+	}
+	if err := w.WriteStatusLine(StatusNotModified); err != nil {
+		return
+	}
+	w.WriteHeaders(out)
+}
+
+// etagListMatches reports whether the If-Match or If-None-Match value list
+// matches etag, comparing strongly or weakly. "*" matches any current
+// representation.
+func etagListMatches(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for candidate := range strings.SplitSeq(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strong && etagStrongMatch(candidate, etag) || !strong && etagWeakMatch(candidate, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+func etagStrongMatch(a, b string) bool {
+	return a != "" && a == b && !strings.HasPrefix(a, "W/")
+}
+
+func etagWeakMatch(a, b string) bool {
+	return a != "" && strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
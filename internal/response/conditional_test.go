@@ -0,0 +1,75 @@
+package response
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	const (
+		etag    = `"v1"`
+		before  = "Wed, 01 May 2024 11:00:00 GMT"
+		current = "Wed, 01 May 2024 12:00:00 GMT"
+	)
+	tests := []struct {
+		method string
+		header string
+		want   StatusCode
+	}{
+		{"GET", "", 0},
+		{"GET", `If-None-Match: "v1"`, StatusNotModified},
+		{"GET", `If-None-Match: "v0", W/"v1"`, StatusNotModified},
+		{"GET", `If-None-Match: *`, StatusNotModified},
+		{"GET", `If-None-Match: "v2"`, 0},
+		{"PUT", `If-None-Match: *`, StatusPreconditionFailed},
+		{"PUT", `If-Match: "v1"`, 0},
+		{"PUT", `If-Match: W/"v1"`, StatusPreconditionFailed},
+		{"PUT", `If-Match: "v2"`, StatusPreconditionFailed},
+		{"GET", "If-Modified-Since: " + current, StatusNotModified},
+		{"GET", "If-Modified-Since: " + before, 0},
+		{"GET", "If-Modified-Since: garbage", 0},
+		{"POST", "If-Modified-Since: " + current, 0},
+		{"PUT", "If-Unmodified-Since: " + before, StatusPreconditionFailed},
+		{"PUT", "If-Unmodified-Since: " + current, 0},
+		// If-None-Match takes precedence over If-Modified-Since, and
+		// If-Match over If-Unmodified-Since.
+		{"GET", `If-None-Match: "v2"` + "\r\nIf-Modified-Since: " + current, 0},
+		{"PUT", `If-Match: "v1"` + "\r\nIf-Unmodified-Since: " + before, 0},
+		{"GET", `If-Match: "v2"` + "\r\nIf-None-Match: \"v1\"", StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		raw := tt.method + " / HTTP/1.1\r\n"
+		if tt.header != "" {
+			raw += tt.header + "\r\n"
+		}
+		req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, CheckPreconditions(req, etag, modtime.Add(500*time.Millisecond)), tt.method+" "+tt.header)
+	}
+}
+
+func TestServeContentConditional(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("ETag", `"v1"`)
+	h.Set("Cache-Control", "max-age=60")
+
+	rec := serveContent(t, "GET", "hello", h, "If-None-Match: \"v1\"\r\n")
+	assert.Equal(t, StatusNotModified, rec.StatusCode)
+	assert.Equal(t, `"v1"`, rec.Headers.Get("ETag"))
+	assert.Equal(t, "max-age=60", rec.Headers.Get("Cache-Control"))
+	assert.Empty(t, rec.Headers.Get("Content-Length"))
+	assert.Empty(t, rec.Body.String())
+
+	rec = serveContent(t, "GET", "hello", nil, "If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n")
+	assert.Equal(t, StatusNotModified, rec.StatusCode)
+
+	// Test: Failed preconditions take precedence over ranges
+	rec = serveContent(t, "GET", "hello", h, "If-Match: \"v0\"\r\n", "Range: bytes=0-1\r\n")
+	assert.Equal(t, StatusPreconditionFailed, rec.StatusCode)
+}
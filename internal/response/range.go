@@ -0,0 +1,331 @@
+package response
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+)
+
+const (
+	sniffLen   = 512
+	copyBuffer = 32 * 1024
+)
+
+var (
+	// ErrInvalidRange is returned by ParseRange for a malformed Range header.
+	ErrInvalidRange = errors.New("invalid range")
+	// ErrNoOverlap is returned by ParseRange when none of the ranges
+	// overlap the content.
+	ErrNoOverlap = errors.New("no satisfiable range")
+)
+
+// Range is a byte range of content, resolved against its size.
+type Range struct {
+	Start  int64
+	Length int64
+}
+
+// ContentRange formats r as a Content-Range value for content of size
+// bytes.
+func (r Range) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange parses a Range header value such as "bytes=0-99,200-,-50"
+// against content of size bytes. Ranges that start past the end are
+// dropped; if none remain it returns ErrNoOverlap.
+func ParseRange(s string, size int64) ([]Range, error) {
+	unit, set, ok := strings.Cut(s, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, ErrInvalidRange
+	}
+
+	var ranges []Range
+	for spec := range strings.SplitSeq(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, ErrInvalidRange
+		}
+
+		var r Range
+		if first == "" {
+			// Suffix range: the last n bytes.
+			n, err := parseOffset(last)
+			if err != nil {
+				return nil, err
+			}
+			r.Start = max(size-n, 0)
+			r.Length = size - r.Start
+			if r.Length == 0 {
+				// Nothing to send for -0 or for empty content.
+				continue
+			}
+		} else {
+			start, err := parseOffset(first)
+			if err != nil {
+				return nil, err
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = parseOffset(last); err != nil {
+					return nil, err
+				}
+				if end < start {
+					return nil, ErrInvalidRange
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r.Start = start
+			r.Length = end - start + 1
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, ErrNoOverlap
+	}
+	return ranges, nil
+}
+
+func parseOffset(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, ErrInvalidRange
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidRange
+	}
+	return n, nil
+}
+
+// ServeContent responds to req with content, honouring conditional
+// requests, Range and If-Range. h holds extra response headers, such as
+// ETag, and may be nil. If h has no Content-Type one is chosen from the
+// extension of name or, failing that, by sniffing the content. A zero
+// modtime omits Last-Modified.
+func ServeContent(w *Writer, req *request.Request, name string, modtime time.Time, content io.ReadSeeker, h headers.Headers) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		WriteError(w, StatusInternalServerError, nil)
+		return
+	}
+
+	out := GetDefaultHeaders(0)
+	out.Del("Content-Type")
+	for k, v := range h {
+		out.SetNew(k, v)
+	}
+	if out.Get("Content-Type") == "" {
+		ctype, err := contentType(name, content)
+		if err != nil {
+			WriteError(w, StatusInternalServerError, nil)
+			return
+		}
+		out.SetNew("Content-Type", ctype)
+	}
+	if !modtime.IsZero() {
+		out.SetNew("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	out.SetNew("Accept-Ranges", "bytes")
+	if CheckConditional(w, req, out) {
+		return
+	}
+
+	method := req.RequestLine.Method
+	var ranges []Range
+	if rh := req.Headers.Get("Range"); rh != "" && (method == "GET" || method == "HEAD") && ifRangeMatches(req, out, modtime) {
+		ranges, err = ParseRange(rh, size)
+		switch {
+		case errors.Is(err, ErrNoOverlap):
+			out.SetNew("Content-Range", fmt.Sprintf("bytes */%d", size))
+			WriteError(w, StatusRangeNotSatisfiable, out)
+			return
+		case err != nil:
+			// A malformed Range is ignored and the full content sent.
+			ranges = nil
+		}
+		if rangesLength(ranges) > size {
+			// Overlapping ranges that ask for more than the whole
+			// content aren't worth the multipart overhead.
+			ranges = nil
+		}
+	}
+
+	status := StatusOK
+	var body func() error
+	switch len(ranges) {
+	case 0:
+		out.SetNew("Content-Length", strconv.FormatInt(size, 10))
+		body = func() error { return copyContent(w, req, content, 0, size) }
+	case 1:
+		status = StatusPartialContent
+		r := ranges[0]
+		out.SetNew("Content-Range", r.ContentRange(size))
+		out.SetNew("Content-Length", strconv.FormatInt(r.Length, 10))
+		body = func() error { return copyContent(w, req, content, r.Start, r.Length) }
+	default:
+		status = StatusPartialContent
+		boundary := randomBoundary()
+		ctype := out.Get("Content-Type")
+		length, err := multipartLength(ranges, size, ctype, boundary)
+		if err != nil {
+			WriteError(w, StatusInternalServerError, nil)
+			return
+		}
+		out.SetNew("Content-Type", "multipart/byteranges; boundary="+boundary)
+		out.SetNew("Content-Length", strconv.FormatInt(length, 10))
+		body = func() error {
+			mw := multipart.NewWriter(w)
+			mw.SetBoundary(boundary)
+			for _, r := range ranges {
+				if _, err := mw.CreatePart(partHeader(r, size, ctype)); err != nil {
+					return err
+				}
+				if err := copyContent(w, req, content, r.Start, r.Length); err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		}
+	}
+
+	if err := w.WriteStatusLine(status); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(out); err != nil {
+		return
+	}
+	if method == "HEAD" {
+		return
+	}
+	body()
+}
+
+// ifRangeMatches reports whether a Range header should be honoured given
+// the request's If-Range precondition, if any. Only a strong ETag or an
+// exact Last-Modified date validates.
+func ifRangeMatches(req *request.Request, h headers.Headers, modtime time.Time) bool {
+	ir := strings.TrimSpace(req.Headers.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return etagStrongMatch(ir, h.Get("ETag"))
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && !modtime.IsZero() && t.Equal(modtime.UTC().Truncate(time.Second))
+}
+
+func contentType(name string, content io.ReadSeeker) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// copyContent writes length bytes of content starting at start, stopping
+// early if the request is cancelled.
+func copyContent(w *Writer, req *request.Request, content io.ReadSeeker, start, length int64) error {
+	if _, err := content.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	ctx := req.Context()
+	buf := make([]byte, min(copyBuffer, max(length, 1)))
+	for length > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, rerr := content.Read(buf[:min(int64(len(buf)), length)])
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			length -= int64(n)
+		}
+		if rerr == io.EOF && length > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+	}
+	return nil
+}
+
+func rangesLength(ranges []Range) int64 {
+	var n int64
+	for _, r := range ranges {
+		n += r.Length
+	}
+	return n
+}
+
+func partHeader(r Range, size int64, ctype string) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {ctype},
+		"Content-Range": {r.ContentRange(size)},
+	}
+}
+
+// multipartLength computes the size of a multipart/byteranges body without
+// reading the content, so it can be sent with a Content-Length.
+func multipartLength(ranges []Range, size int64, ctype, boundary string) (int64, error) {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return 0, err
+	}
+	for _, r := range ranges {
+		if _, err := mw.CreatePart(partHeader(r, size, ctype)); err != nil {
+			return 0, err
+		}
+		cw += countingWriter(r.Length)
+	}
+	if err := mw.Close(); err != nil {
+		return 0, err
+	}
+	return int64(cw), nil
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+func randomBoundary() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
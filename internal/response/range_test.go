@@ -0,0 +1,160 @@
+package response
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Range
+		err  error
+	}{
+		{"bytes=0-9", []Range{{0, 10}}, nil},
+		{"bytes=90-", []Range{{90, 10}}, nil},
+		{"bytes=90-200", []Range{{90, 10}}, nil},
+		{"bytes=-5", []Range{{95, 5}}, nil},
+		{"bytes=-500", []Range{{0, 100}}, nil},
+		{"bytes=0-0, 10-19,-1", []Range{{0, 1}, {10, 10}, {99, 1}}, nil},
+		{"bytes=100-,0-0", []Range{{0, 1}}, nil},
+		{"bytes=100-", nil, ErrNoOverlap},
+		{"bytes=-0", nil, ErrNoOverlap},
+		{"bytes=5-1", nil, ErrInvalidRange},
+		{"bytes=a-b", nil, ErrInvalidRange},
+		{"bytes=+1-2", nil, ErrInvalidRange},
+		{"bytes=1", nil, ErrInvalidRange},
+		{"items=0-1", nil, ErrInvalidRange},
+	}
+	for _, tt := range tests {
+		got, err := ParseRange(tt.in, 100)
+		assert.ErrorIs(t, err, tt.err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+
+	// Test: Nothing of empty content can be satisfied
+	for _, in := range []string{"bytes=-5", "bytes=0-", "bytes=0-0"} {
+		got, err := ParseRange(in, 0)
+		assert.ErrorIs(t, err, ErrNoOverlap, in)
+		assert.Nil(t, got, in)
+	}
+}
+
+var modtime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func serveContent(t *testing.T, method string, content string, h headers.Headers, reqHeaders ...string) *Recorder {
+	t.Helper()
+	raw := method + " /file HTTP/1.1\r\n" + strings.Join(reqHeaders, "") + "\r\n"
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	rec, w := NewRecorder()
+	ServeContent(w, req, "file.txt", modtime, strings.NewReader(content), h)
+	require.NoError(t, w.Close())
+	return rec
+}
+
+func TestServeContentRanges(t *testing.T) {
+	const content = "0123456789abcdefghij"
+
+	rec := serveContent(t, "GET", content, nil)
+	assert.Equal(t, StatusOK, rec.StatusCode)
+	assert.Equal(t, "bytes", rec.Headers.Get("Accept-Ranges"))
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Headers.Get("Content-Type"))
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", rec.Headers.Get("Last-Modified"))
+	assert.Equal(t, content, rec.Body.String())
+
+	// Test: Single range
+	rec = serveContent(t, "GET", content, nil, "Range: bytes=5-9\r\n")
+	assert.Equal(t, StatusPartialContent, rec.StatusCode)
+	assert.Equal(t, "bytes 5-9/20", rec.Headers.Get("Content-Range"))
+	assert.Equal(t, "5", rec.Headers.Get("Content-Length"))
+	assert.Equal(t, "56789", rec.Body.String())
+
+	// Test: Suffix range on HEAD sends no body
+	rec = serveContent(t, "HEAD", content, nil, "Range: bytes=-3\r\n")
+	assert.Equal(t, StatusPartialContent, rec.StatusCode)
+	assert.Equal(t, "bytes 17-19/20", rec.Headers.Get("Content-Range"))
+	assert.Empty(t, rec.Body.String())
+
+	// Test: Unsatisfiable
+	rec = serveContent(t, "GET", content, nil, "Range: bytes=20-\r\n")
+	assert.Equal(t, StatusRangeNotSatisfiable, rec.StatusCode)
+	assert.Equal(t, "bytes */20", rec.Headers.Get("Content-Range"))
+
+	// Test: A suffix range of empty content is unsatisfiable
+	rec = serveContent(t, "GET", "", nil, "Range: bytes=-5\r\n")
+	assert.Equal(t, StatusRangeNotSatisfiable, rec.StatusCode)
+	assert.Equal(t, "bytes */0", rec.Headers.Get("Content-Range"))
+
+	// Test: Malformed ranges are ignored
+	rec = serveContent(t, "GET", content, nil, "Range: bytes=x-y\r\n")
+	assert.Equal(t, StatusOK, rec.StatusCode)
+	assert.Equal(t, content, rec.Body.String())
+
+	// Test: Ranges are ignored for other methods
+	rec = serveContent(t, "POST", content, nil, "Range: bytes=0-1\r\n")
+	assert.Equal(t, StatusOK, rec.StatusCode)
+}
+
+func TestServeContentMultipart(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	rec := serveContent(t, "GET", content, nil, "Range: bytes=0-1,-2\r\n")
+	require.Equal(t, StatusPartialContent, rec.StatusCode)
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Headers.Get("Content-Length"))
+
+	mediaType, params, err := mime.ParseMediaType(rec.Headers.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	mr := multipart.NewReader(&rec.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain; charset=utf-8", p.Header.Get("Content-Type"))
+		body, err := io.ReadAll(p)
+		require.NoError(t, err)
+		parts = append(parts, p.Header.Get("Content-Range")+" "+string(body))
+	}
+	assert.Equal(t, []string{"bytes 0-1/20 01", "bytes 18-19/20 ij"}, parts)
+
+	// Test: Ranges covering more than the content are served whole
+	rec = serveContent(t, "GET", content, nil, "Range: bytes=0-15,5-19\r\n")
+	assert.Equal(t, StatusOK, rec.StatusCode)
+}
+
+func TestServeContentIfRange(t *testing.T) {
+	const content = "0123456789"
+	h := headers.NewHeaders()
+	h.Set("ETag", `"v1"`)
+
+	tests := []struct {
+		ifRange string
+		status  StatusCode
+	}{
+		{`"v1"`, StatusPartialContent},
+		{`"v2"`, StatusOK},
+		{`W/"v1"`, StatusOK},
+		{"Wed, 01 May 2024 12:00:00 GMT", StatusPartialContent},
+		{"Wed, 01 May 2024 11:00:00 GMT", StatusOK},
+		{"garbage", StatusOK},
+	}
+	for _, tt := range tests {
+		rec := serveContent(t, "GET", content, h, "Range: bytes=0-0\r\n", "If-Range: "+tt.ifRange+"\r\n")
+		assert.Equal(t, tt.status, rec.StatusCode, tt.ifRange)
+		assert.Equal(t, `"v1"`, rec.Headers.Get("ETag"))
+	}
+}
@@ -0,0 +1,77 @@
+package response
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+)
+
+// Recorder captures a response in memory instead of sending it, so
+// middleware can inspect or rewrite a complete response before replaying it
+// to the real Writer with WriteTo.
+type Recorder struct {
+	StatusCode StatusCode
+	Headers    headers.Headers
+	Body       bytes.Buffer
+	Trailers   headers.Headers
+	Finished   bool
+}
+
+// NewRecorder returns a Recorder and a Writer whose output it captures.
+func NewRecorder() (*Recorder, *Writer) {
+	rec := &Recorder{}
+	return rec, newWriter(rec)
+}
+
+func (r *Recorder) writeHead(statusCode StatusCode, h headers.Headers) error {
+	r.StatusCode = statusCode
+	r.Headers = h
+	return nil
+}
+
+func (r *Recorder) writeBody(p []byte) (int, error) {
+	return r.Body.Write(p)
+}
+
+func (r *Recorder) writeEnd(trailers headers.Headers) error {
+	r.Trailers = trailers
+	r.Finished = true
+	return nil
+}
+
+// WriteTo replays the recorded response to w. Content-Length is corrected
+// to the recorded body unless the response is chunked.
+func (r *Recorder) WriteTo(w *Writer) error {
+	if r.Headers == nil {
+		return nil
+	}
+	if err := w.WriteStatusLine(r.StatusCode); err != nil {
+		return err
+	}
+
+	h := headers.NewHeaders()
+	for k, v := range r.Headers {
+		h.SetNew(k, v)
+	}
+	chunked := isChunked(h)
+	if !chunked && h.Get("Content-Length") != "" {
+		h.SetNew("Content-Length", strconv.Itoa(r.Body.Len()))
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	if !chunked {
+		if r.Body.Len() == 0 {
+			return w.Close()
+		}
+		_, err := w.WriteBody(r.Body.Bytes())
+		return err
+	}
+	if _, err := w.WriteChunkedBody(r.Body.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.WriteChunkedBodyDone(r.Trailers)
+	return err
+}
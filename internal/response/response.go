@@ -3,6 +3,7 @@ package response
 import (
 	"fmt"
 	"io"
+	"strconv"
 	"time"
 
 	"github.com/nhdewitt/http-from-tcp/internal/headers"
@@ -11,29 +12,19 @@ import (
 )
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	switch statusCode {
-	case StatusOK:
-		_, err := w.Write([]byte("HTTP/1.1 200 OK\r\n"))
-		if err != nil {
-			return err
-		}
-	case StatusBadRequest:
-		_, err := w.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
-		if err != nil {
-			return err
-		}
-	case StatusInternalServerError:
-		_, err := w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n"))
-		if err != nil {
-			return err
-		}
-	default:
-		_, err := w.Write([]byte(""))
-		if err != nil {
-			return err
-		}
+	line, err := statusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(line))
+	return err
+}
+
+func statusLine(statusCode StatusCode) (string, error) {
+	if statusCode < 100 || statusCode > 999 {
+		return "", fmt.Errorf("unknown status code: %d", statusCode)
 	}
-	return nil
+	return fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, StatusText(statusCode)), nil
 }
 
 func GetDefaultHeaders(contentLen int) headers.Headers {
@@ -46,14 +37,39 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 	return h
 }
 
+// WriteError writes a plain text response whose body is the status code
+// and its text, e.g. "404 Not Found". h holds any headers to send with it;
+// nil means GetDefaultHeaders. Nothing is written once the headers have
+// been sent.
+func WriteError(w *Writer, code StatusCode, h headers.Headers) {
+	if w.HeadersWritten() {
+		return
+	}
+	if h == nil {
+		h = GetDefaultHeaders(0)
+	}
+	body := []byte(strconv.Itoa(int(code)) + " " + StatusText(code) + "\n")
+	h.SetNew("Content-Length", strconv.Itoa(len(body)))
+	h.SetNew("Content-Type", "text/plain")
+	if err := w.WriteStatusLine(code); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	w.WriteBody(body)
+}
+
 func WriteHeaders(w io.Writer, headers headers.Headers) error {
-	for k, v := range headers {
+	for k := range headers {
 		caser := cases.Title(language.English)
 
-		line := caser.String(k) + ": " + v
-		_, err := w.Write([]byte(line + "\r\n"))
-		if err != nil {
-			return fmt.Errorf("error writing header: %v", err)
+		for _, v := range headers.Values(k) {
+			line := caser.String(k) + ": " + v
+			_, err := w.Write([]byte(line + "\r\n"))
+			if err != nil {
+				return fmt.Errorf("error writing header: %v", err)
+			}
 		}
 	}
 	_, err := w.Write([]byte("\r\n"))
@@ -3,7 +3,58 @@ package response
 type StatusCode int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusSwitchingProtocols          StatusCode = 101
+	StatusOK                          StatusCode = 200
+	StatusNoContent                   StatusCode = 204
+	StatusPartialContent              StatusCode = 206
+	StatusMovedPermanently            StatusCode = 301
+	StatusNotModified                 StatusCode = 304
+	StatusBadRequest                  StatusCode = 400
+	StatusForbidden                   StatusCode = 403
+	StatusNotFound                    StatusCode = 404
+	StatusMethodNotAllowed            StatusCode = 405
+	StatusProxyAuthRequired           StatusCode = 407
+	StatusRequestTimeout              StatusCode = 408
+	StatusPreconditionFailed          StatusCode = 412
+	StatusRequestEntityTooLarge       StatusCode = 413
+	StatusUnsupportedMediaType        StatusCode = 415
+	StatusRangeNotSatisfiable         StatusCode = 416
+	StatusUpgradeRequired             StatusCode = 426
+	StatusRequestHeaderFieldsTooLarge StatusCode = 431
+	StatusInternalServerError         StatusCode = 500
+	StatusNotImplemented              StatusCode = 501
+	StatusBadGateway                  StatusCode = 502
+	StatusServiceUnavailable          StatusCode = 503
+	StatusGatewayTimeout              StatusCode = 504
 )
+
+var statusText = map[StatusCode]string{
+	StatusSwitchingProtocols:          "Switching Protocols",
+	StatusOK:                          "OK",
+	StatusNoContent:                   "No Content",
+	StatusPartialContent:              "Partial Content",
+	StatusMovedPermanently:            "Moved Permanently",
+	StatusNotModified:                 "Not Modified",
+	StatusBadRequest:                  "Bad Request",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusProxyAuthRequired:           "Proxy Authentication Required",
+	StatusRequestTimeout:              "Request Timeout",
+	StatusPreconditionFailed:          "Precondition Failed",
+	StatusRequestEntityTooLarge:       "Content Too Large",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusRangeNotSatisfiable:         "Range Not Satisfiable",
+	StatusUpgradeRequired:             "Upgrade Required",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusInternalServerError:         "Internal Server Error",
+	StatusNotImplemented:              "Not Implemented",
+	StatusBadGateway:                  "Bad Gateway",
+	StatusServiceUnavailable:          "Service Unavailable",
+	StatusGatewayTimeout:              "Gateway Timeout",
+}
+
+// StatusText returns the reason phrase for code, or "" if it is unknown.
+func StatusText(code StatusCode) string {
+	return statusText[code]
+}
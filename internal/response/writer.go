@@ -1,13 +1,25 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/nhdewitt/http-from-tcp/internal/headers"
 )
 
+// ErrNotHijackable is returned by Writer.Hijack when the response is not
+// written to a connection that can be taken over, e.g. because middleware is
+// recording it.
+var ErrNotHijackable = errors.New("connection cannot be hijacked")
+
+// HijackFunc hands over the connection behind a Writer together with the
+// bytes already read from it that no request has consumed.
+type HijackFunc func() (net.Conn, []byte, error)
+
 type writerState int
 
 const (
@@ -17,38 +29,93 @@ const (
 	StateDone
 )
 
+// Writer writes a response in order: status line, headers, body. The status
+// line is held back and sent together with the headers, so hooks registered
+// with OnHeaders can still adjust the response before anything is sent.
 type Writer struct {
-	writer io.Writer
-	state  writerState
+	transport  transport
+	state      writerState
+	statusCode StatusCode
+	headers    headers.Headers
+
+	headerHooks  []func(StatusCode, headers.Headers)
+	body         io.Writer
+	closers      []io.Closer
+	bytesWritten int64
+	bytesSent    int64
+	wroteHeaders bool
+	finished     bool
+	hijack       HijackFunc
+	hijacked     bool
+}
+
+// transport is where a Writer sends the parts of a response.
+type transport interface {
+	writeHead(statusCode StatusCode, h headers.Headers) error
+	writeBody(p []byte) (int, error)
+	writeEnd(trailers headers.Headers) error
+}
+
+// Transport carries responses over a protocol other than HTTP/1.1. A Writer
+// calls WriteHead once with the final headers, WriteBody with the body after
+// any body wrappers, and WriteEnd when the response is finished.
+type Transport interface {
+	WriteHead(statusCode StatusCode, h headers.Headers) error
+	WriteBody(p []byte) (int, error)
+	WriteEnd(trailers headers.Headers) error
+}
+
+// NewTransportWriter returns a Writer that sends the response through t.
+func NewTransportWriter(t Transport) *Writer {
+	return newWriter(exportedTransport{t})
+}
+
+type exportedTransport struct {
+	t Transport
+}
+
+func (e exportedTransport) writeHead(statusCode StatusCode, h headers.Headers) error {
+	return e.t.WriteHead(statusCode, h)
+}
+
+func (e exportedTransport) writeBody(p []byte) (int, error) {
+	return e.t.WriteBody(p)
+}
+
+func (e exportedTransport) writeEnd(trailers headers.Headers) error {
+	return e.t.WriteEnd(trailers)
 }
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{
-		writer: w,
-		state:  StateWritingStatusLine,
+	return newWriter(&http1Transport{writer: w})
+}
+
+// NewConnWriter returns a Writer for a connection that handlers may take
+// over with Hijack, which calls hijack to do so.
+func NewConnWriter(w io.Writer, hijack HijackFunc) *Writer {
+	rw := NewWriter(w)
+	rw.hijack = hijack
+	return rw
+}
+
+func newWriter(t transport) *Writer {
+	w := &Writer{
+		transport: t,
+		state:     StateWritingStatusLine,
 	}
+	w.body = bodyWriter{w}
+	return w
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	if w.state != StateWritingStatusLine {
 		return fmt.Errorf("writer state out-of-order")
 	}
-
-	var line string
-	switch statusCode {
-	case StatusOK:
-		line = "HTTP/1.1 200 OK\r\n"
-	case StatusBadRequest:
-		line = "HTTP/1.1 400 Bad Request\r\n"
-	case StatusInternalServerError:
-		line = "HTTP/1.1 500 Internal Server Error\r\n"
-	default:
-		return fmt.Errorf("unknown status code: %d", statusCode)
-	}
-	if _, err := w.writer.Write([]byte(line)); err != nil {
+	if _, err := statusLine(statusCode); err != nil {
 		return err
 	}
 
+	w.statusCode = statusCode
 	w.state = StateWritingHeaders
 	return nil
 }
@@ -58,16 +125,12 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 		return fmt.Errorf("writer state out-of-order")
 	}
 
-	for k, v := range headers {
-		if v == "" {
-			continue
-		}
-		h := k + ": " + v + "\r\n"
-		if _, err := w.writer.Write([]byte(h)); err != nil {
-			return err
-		}
+	for _, hook := range w.headerHooks {
+		hook(w.statusCode, headers)
 	}
-	if _, err := w.writer.Write([]byte("\r\n")); err != nil {
+	w.headers = headers
+	w.wroteHeaders = true
+	if err := w.transport.writeHead(w.statusCode, headers); err != nil {
 		return err
 	}
 
@@ -81,7 +144,16 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 	}
 
 	w.state = StateDone
-	return w.writer.Write(p)
+	return w.writeBody(p)
+}
+
+// Write streams part of the body. Unlike WriteBody it may be called any
+// number of times; the response is finished by Close.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.state != StateWritingBody {
+		return 0, fmt.Errorf("writer state out-of-order")
+	}
+	return w.writeBody(p)
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
@@ -89,44 +161,258 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return 0, fmt.Errorf("writer state out-of-order")
 	}
 
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return w.writeBody(p)
+}
+
+func (w *Writer) WriteChunkedBodyDone(h headers.Headers) (int, error) {
+	if w.state != StateWritingBody {
+		return 0, fmt.Errorf("writer state out-of-order")
+	}
+	w.state = StateDone
+	return 0, w.finish(h)
+}
+
+// WriteTrailers ends a chunked response with the fields of h named in its
+// Trailer header, or in the Trailer header sent with the response.
+func (w *Writer) WriteTrailers(h headers.Headers) error {
+	_, err := w.WriteChunkedBodyDone(h)
+	return err
+}
+
+// Close finishes the response: it flushes body wrappers and, for chunked
+// responses, writes the terminating chunk. A status line written without
+// headers is sent with the default headers and an empty body. It is safe
+// to call more than once and is a no-op before the status line has been
+// written.
+func (w *Writer) Close() error {
+	if w.state == StateWritingHeaders {
+		if err := w.WriteHeaders(GetDefaultHeaders(0)); err != nil {
+			return err
+		}
+	}
+	if !w.wroteHeaders {
+		return nil
+	}
+	w.state = StateDone
+	return w.finish(nil)
+}
+
+func (w *Writer) finish(trailers headers.Headers) error {
+	if w.finished {
+		return nil
+	}
+	w.finished = true
+
+	for i := len(w.closers) - 1; i >= 0; i-- {
+		if err := w.closers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return w.transport.writeEnd(trailers)
+}
+
+func (w *Writer) writeBody(p []byte) (int, error) {
+	n, err := w.body.Write(p)
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+// OnHeaders registers f to be called with the status code and headers just
+// before they are sent. f may modify the headers and may call WrapBody.
+func (w *Writer) OnHeaders(f func(statusCode StatusCode, h headers.Headers)) {
+	w.headerHooks = append(w.headerHooks, f)
+}
+
+// WrapBody routes body bytes through the writer returned by f, which must
+// write its output to the writer it is given. Wrappers added later sit
+// closer to the handler. If the wrapper is an io.Closer it is closed when
+// the response finishes, before the final chunk is written.
+func (w *Writer) WrapBody(f func(io.Writer) io.Writer) {
+	w.body = f(w.body)
+	if c, ok := w.body.(io.Closer); ok {
+		w.closers = append(w.closers, c)
+	}
+}
+
+// Hijack lets the caller take over the connection, e.g. to tunnel another
+// protocol over it. Besides the connection it returns any bytes the server
+// had already read past the request, which come before anything read from
+// the connection. The server forgets the connection: it no longer applies
+// timeouts or keep-alive to it, counts it against connection limits or
+// closes it, not even on shutdown, so the caller must close it, possibly
+// after the handler has returned. The request's context is not detached:
+// it is still cancelled by the handler timeout, by the server closing and
+// once the handler returns, so code serving the connection should use
+// context.WithoutCancel(req.Context()) instead. The Writer can't be used
+// afterwards. Hijack fails once the headers have been written.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijack == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	if w.wroteHeaders || w.hijacked {
+		return nil, nil, fmt.Errorf("hijack after the response has started")
+	}
+	c, buffered, err := w.hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	w.state = StateDone
+	return c, buffered, nil
+}
+
+// Reset discards a response whose headers have not been sent, along with
+// the hooks and body wrappers registered for it, so another response can be
+// written in its place.
+func (w *Writer) Reset() error {
+	if w.wroteHeaders || w.hijacked {
+		return fmt.Errorf("reset after the response has started")
+	}
+	w.state = StateWritingStatusLine
+	w.statusCode = 0
+	w.headerHooks = nil
+	w.body = bodyWriter{w}
+	w.closers = nil
+	w.bytesWritten = 0
+	return nil
+}
+
+// Hijacked reports whether the connection was taken over with Hijack.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// StatusCode returns the status code written, or 0 if the status line has
+// not been written yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// Headers returns the headers written, or nil if they have not been written
+// yet.
+func (w *Writer) Headers() headers.Headers {
+	return w.headers
+}
+
+// BytesWritten returns the number of body bytes accepted from the handler,
+// before any body wrappers are applied.
+func (w *Writer) BytesWritten() int64 {
+	return w.bytesWritten
+}
+
+// HeadersWritten reports whether the status line and headers have been sent.
+func (w *Writer) HeadersWritten() bool {
+	return w.wroteHeaders
+}
+
+// Done reports whether the response was fully written: the body has been
+// finished and, for fixed-length responses, matched its Content-Length.
+func (w *Writer) Done() bool {
+	if w.state != StateDone && w.state != StateWritingBody {
+		return false
+	}
+	cl := w.headers.Get("Content-Length")
+	if isChunked(w.headers) || cl == "" {
+		return w.state == StateDone
+	}
+	n, err := strconv.ParseInt(cl, 10, 64)
+	return err == nil && n == w.bytesSent
+}
+
+// bodyWriter is the innermost body writer, handing bytes to the transport.
+type bodyWriter struct {
+	w *Writer
+}
+
+func (b bodyWriter) Write(p []byte) (int, error) {
+	n, err := b.w.transport.writeBody(p)
+	b.w.bytesSent += int64(n)
+	return n, err
+}
+
+// http1Transport serializes a response as HTTP/1.1, applying chunked
+// framing when the headers ask for it.
+type http1Transport struct {
+	writer  io.Writer
+	chunked bool
+	trailer string
+}
+
+func (t *http1Transport) writeHead(statusCode StatusCode, h headers.Headers) error {
+	line, err := statusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	if _, err := t.writer.Write([]byte(line)); err != nil {
+		return err
+	}
+
+	for k, v := range h {
+		if v == "" {
+			continue
+		}
+		for _, v := range h.Values(k) {
+			line := k + ": " + v + "\r\n"
+			if _, err := t.writer.Write([]byte(line)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := t.writer.Write([]byte("\r\n")); err != nil {
+		return err
+	}
+
+	t.chunked = isChunked(h)
+	t.trailer = h.Get("Trailer")
+	return nil
+}
+
+func (t *http1Transport) writeBody(p []byte) (int, error) {
+	if !t.chunked {
+		return t.writer.Write(p)
+	}
+
 	n := len(p)
 	if n == 0 {
 		return 0, nil
 	}
-
-	if _, err := w.writer.Write([]byte(fmt.Sprintf("%X\r\n", n))); err != nil {
+	if _, err := t.writer.Write([]byte(fmt.Sprintf("%X\r\n", n))); err != nil {
 		return 0, err
 	}
-	if _, err := w.writer.Write(p); err != nil {
+	if _, err := t.writer.Write(p); err != nil {
 		return 0, err
 	}
-	if _, err := w.writer.Write([]byte("\r\n")); err != nil {
+	if _, err := t.writer.Write([]byte("\r\n")); err != nil {
 		return 0, err
 	}
 	return n, nil
 }
 
-func (w *Writer) WriteChunkedBodyDone(h headers.Headers) (int, error) {
-	if w.state != StateWritingBody {
-		return 0, fmt.Errorf("writer state out-of-order")
-	}
-	if _, err := w.writer.Write([]byte("0\r\n")); err != nil {
-		return 0, err
+func (t *http1Transport) writeEnd(trailers headers.Headers) error {
+	if !t.chunked {
+		return nil
 	}
-	if err := w.WriteTrailers(h); err != nil {
-		return 0, err
+	if _, err := t.writer.Write([]byte("0\r\n")); err != nil {
+		return err
 	}
-	if _, err := w.writer.Write([]byte("\r\n")); err != nil {
-		return 0, err
+	if err := writeTrailers(t.writer, t.trailer, trailers); err != nil {
+		return err
 	}
-	w.state = StateDone
-	return 0, nil
+	_, err := t.writer.Write([]byte("\r\n"))
+	return err
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+// writeTrailers writes the fields of h named in the declared Trailer list.
+func writeTrailers(w io.Writer, declared string, h headers.Headers) error {
+	if h == nil {
+		return nil
+	}
 	t := h.Get("Trailer")
 	if len(t) == 0 {
-		return nil
+		t = declared
 	}
 
 	for k := range strings.SplitSeq(t, ",") {
@@ -138,9 +424,18 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 		if len(v) == 0 {
 			continue
 		}
-		if _, err := w.writer.Write([]byte(k + ": " + v + "\r\n")); err != nil {
+		if _, err := w.Write([]byte(k + ": " + v + "\r\n")); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func isChunked(h headers.Headers) bool {
+	for te := range strings.SplitSeq(h.Get("Transfer-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type upperWriter struct {
+	w      io.Writer
+	closed bool
+}
+
+func (u *upperWriter) Write(p []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(p))
+}
+
+func (u *upperWriter) Close() error {
+	u.closed = true
+	_, err := u.w.Write([]byte("!"))
+	return err
+}
+
+func TestWriterFixedLength(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	assert.Empty(t, buf.String(), "status line is sent with the headers")
+
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-length: 5\r\n\r\nhello", buf.String())
+	assert.Equal(t, int64(5), w.BytesWritten())
+	assert.True(t, w.Done())
+
+	// Test: Out-of-order writes
+	_, err = w.WriteBody([]byte("again"))
+	assert.Error(t, err)
+	assert.Error(t, NewWriter(&buf).WriteHeaders(h))
+}
+
+func TestWriterHooksAndWrappers(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	var u *upperWriter
+	w.OnHeaders(func(code StatusCode, h headers.Headers) {
+		assert.Equal(t, StatusOK, code)
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WrapBody(func(next io.Writer) io.Writer {
+			u = &upperWriter{w: next}
+			return u
+		})
+	})
+
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close())
+
+	assert.True(t, u.closed)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\ntransfer-encoding: chunked\r\n\r\n5\r\nHELLO\r\n1\r\n!\r\n0\r\n\r\n", buf.String())
+}
+
+func TestWriterTrailers(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	h.Set("X-Sum", "42")
+	require.NoError(t, w.WriteTrailers(h))
+
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n3\r\nabc\r\n0\r\nX-Sum: 42\r\n\r\n"), buf.String())
+}
+
+func TestWriterCloseSendsHeldStatusLine(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusBadGateway))
+	require.NoError(t, w.Close())
+
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 502 Bad Gateway\r\n"), buf.String())
+	assert.Contains(t, buf.String(), "content-length: 0\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"), buf.String())
+	assert.True(t, w.Done())
+}
+
+func TestWriteError(t *testing.T) {
+	rec, w := NewRecorder()
+	h := GetDefaultHeaders(0)
+	h.SetNew("Allow", "GET")
+	WriteError(w, StatusMethodNotAllowed, h)
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, StatusMethodNotAllowed, rec.StatusCode)
+	assert.Equal(t, "405 Method Not Allowed\n", rec.Body.String())
+	assert.Equal(t, "23", rec.Headers.Get("Content-Length"))
+	assert.Equal(t, "text/plain", rec.Headers.Get("Content-Type"))
+	assert.Equal(t, "GET", rec.Headers.Get("Allow"))
+
+	// Once the headers are out the status can't change.
+	rec, w = NewRecorder()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	WriteError(w, StatusInternalServerError, nil)
+	assert.Equal(t, StatusOK, rec.StatusCode)
+	assert.Empty(t, rec.Body.String())
+}
+
+func TestRecorder(t *testing.T) {
+	rec, rw := NewRecorder()
+	require.NoError(t, rw.WriteStatusLine(StatusNotFound))
+	h := GetDefaultHeaders(3)
+	require.NoError(t, rw.WriteHeaders(h))
+	_, err := rw.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, rw.Close())
+
+	assert.Equal(t, StatusNotFound, rec.StatusCode)
+	assert.Equal(t, "abc", rec.Body.String())
+	assert.True(t, rec.Finished)
+
+	rec.Body.WriteString("def")
+	var buf bytes.Buffer
+	require.NoError(t, rec.WriteTo(NewWriter(&buf)))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, buf.String(), "content-length: 6\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nabcdef"))
+}
+
+func TestWriterHijack(t *testing.T) {
+	_, w := NewRecorder()
+	_, _, err := w.Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	w = NewConnWriter(c1, func() (net.Conn, []byte, error) {
+		return c1, []byte("next"), nil
+	})
+	c, buffered, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, c1, c)
+	assert.Equal(t, "next", string(buffered))
+	assert.True(t, w.Hijacked())
+	assert.Error(t, w.WriteStatusLine(StatusOK), "the writer is done")
+	assert.NoError(t, w.Close())
+	_, _, err = w.Hijack()
+	assert.Error(t, err)
+}
@@ -0,0 +1,308 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+)
+
+// Router dispatches requests to handlers by method, host and path. Patterns
+// are slash-separated; a segment written {name} matches any single segment,
+// and a final segment written {name...} matches the rest of the path,
+// including nothing. Matched values are available via Request.PathValue.
+//
+// Requests that match no route get NotFound (404 if nil). Requests whose
+// path matches but whose method does not get 405 with an Allow header, and
+// OPTIONS requests are answered with 204 and Allow automatically.
+type Router struct {
+	RouteGroup
+	NotFound server.Handler
+
+	routes []*route
+}
+
+// RouteGroup registers routes sharing a host and path prefix.
+type RouteGroup struct {
+	router     *Router
+	host       string
+	prefix     string
+	middleware []server.Middleware
+}
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+type route struct {
+	method   string
+	host     string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+func New() *Router {
+	r := &Router{}
+	r.RouteGroup = RouteGroup{router: r}
+	return r
+}
+
+// Group returns a group whose routes are prefixed with prefix.
+func (g *RouteGroup) Group(prefix string) *RouteGroup {
+	return &RouteGroup{
+		router:     g.router,
+		host:       g.host,
+		prefix:     joinPath(g.prefix, prefix),
+		middleware: slices.Clone(g.middleware),
+	}
+}
+
+// Host returns a group whose routes only match requests for host. Routes
+// with a host take precedence over routes without one.
+func (g *RouteGroup) Host(host string) *RouteGroup {
+	return &RouteGroup{
+		router:     g.router,
+		host:       strings.ToLower(host),
+		prefix:     g.prefix,
+		middleware: slices.Clone(g.middleware),
+	}
+}
+
+// Use adds middleware to routes registered on g and its subgroups from now
+// on. The first middleware added is the outermost.
+func (g *RouteGroup) Use(m ...server.Middleware) {
+	g.middleware = append(g.middleware, m...)
+}
+
+// Handle registers h for method and pattern. An empty method matches any
+// method. It panics if the pattern is malformed.
+func (g *RouteGroup) Handle(method, pattern string, h server.Handler) {
+	full := joinPath(g.prefix, pattern)
+	segments, err := parsePattern(full)
+	if err != nil {
+		panic(err)
+	}
+	g.router.routes = append(g.router.routes, &route{
+		method:   method,
+		host:     g.host,
+		pattern:  full,
+		segments: segments,
+		handler:  server.Chain(h, g.middleware...),
+	})
+}
+
+func (g *RouteGroup) Get(pattern string, h server.Handler) {
+	g.Handle("GET", pattern, h)
+}
+
+func (g *RouteGroup) Head(pattern string, h server.Handler) {
+	g.Handle("HEAD", pattern, h)
+}
+
+func (g *RouteGroup) Post(pattern string, h server.Handler) {
+	g.Handle("POST", pattern, h)
+}
+
+func (g *RouteGroup) Put(pattern string, h server.Handler) {
+	g.Handle("PUT", pattern, h)
+}
+
+func (g *RouteGroup) Patch(pattern string, h server.Handler) {
+	g.Handle("PATCH", pattern, h)
+}
+
+func (g *RouteGroup) Delete(pattern string, h server.Handler) {
+	g.Handle("DELETE", pattern, h)
+}
+
+// Serve dispatches req; it has the signature of server.Handler.
+func (r *Router) Serve(w *response.Writer, req *request.Request) {
+	path := req.Path()
+	host := requestHost(req)
+	method := req.RequestLine.Method
+
+	var best *route
+	var bestValues map[string]string
+	var allowed []string
+	for _, hostOnly := range []bool{true, false} {
+		for _, rt := range r.routes {
+			if (rt.host != "") != hostOnly || (hostOnly && rt.host != host) {
+				continue
+			}
+			values, ok := rt.match(path)
+			if !ok {
+				continue
+			}
+			if rt.method != "" && rt.method != method {
+				allowed = append(allowed, rt.method)
+				continue
+			}
+			if best == nil || moreSpecific(rt, best) {
+				best, bestValues = rt, values
+			}
+		}
+		if best != nil || len(allowed) > 0 {
+			break
+		}
+	}
+
+	if best != nil {
+		for k, v := range bestValues {
+			req.SetPathValue(k, v)
+		}
+		best.handler(w, req)
+		return
+	}
+
+	if len(allowed) == 0 {
+		if r.NotFound != nil {
+			r.NotFound(w, req)
+			return
+		}
+		response.WriteError(w, response.StatusNotFound, nil)
+		return
+	}
+
+	h := response.GetDefaultHeaders(0)
+	h.SetNew("Allow", allowHeader(allowed))
+	if method == "OPTIONS" {
+		h.Del("Content-Type")
+		if err := w.WriteStatusLine(response.StatusNoContent); err != nil {
+			return
+		}
+		w.WriteHeaders(h)
+		return
+	}
+	response.WriteError(w, response.StatusMethodNotAllowed, h)
+}
+
+func (rt *route) match(path string) (map[string]string, bool) {
+	parts := splitPath(path)
+	var values map[string]string
+	set := func(k, v string) {
+		if values == nil {
+			values = make(map[string]string)
+		}
+		if unescaped, err := url.PathUnescape(v); err == nil {
+			v = unescaped
+		}
+		values[k] = v
+	}
+
+	for i, seg := range rt.segments {
+		if seg.kind == segmentWildcard {
+			set(seg.value, strings.Join(parts[i:], "/"))
+			return values, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			set(seg.value, parts[i])
+		}
+	}
+	if len(parts) != len(rt.segments) {
+		return nil, false
+	}
+	return values, true
+}
+
+// moreSpecific reports whether a should win over b when both match. Earlier
+// literal segments beat parameters, which beat wildcards; ties go to the
+// longer pattern, then to the route with a method.
+func moreSpecific(a, b *route) bool {
+	for i := range min(len(a.segments), len(b.segments)) {
+		if a.segments[i].kind != b.segments[i].kind {
+			return a.segments[i].kind < b.segments[i].kind
+		}
+	}
+	if len(a.segments) != len(b.segments) {
+		return len(a.segments) > len(b.segments)
+	}
+	return a.method != "" && b.method == ""
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("router: pattern %q must begin with /", pattern)
+	}
+
+	parts := splitPath(pattern)
+	segments := make([]segment, 0, len(parts))
+	seen := map[string]bool{}
+	for i, p := range parts {
+		if !strings.HasPrefix(p, "{") || !strings.HasSuffix(p, "}") {
+			if strings.ContainsAny(p, "{}") {
+				return nil, fmt.Errorf("router: bad segment %q in pattern %q", p, pattern)
+			}
+			segments = append(segments, segment{kind: segmentLiteral, value: p})
+			continue
+		}
+
+		name := p[1 : len(p)-1]
+		kind := segmentParam
+		if n, ok := strings.CutSuffix(name, "..."); ok {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("router: wildcard %q must be last in pattern %q", p, pattern)
+			}
+			name, kind = n, segmentWildcard
+		}
+		if name == "" || seen[name] {
+			return nil, fmt.Errorf("router: bad or duplicate parameter %q in pattern %q", p, pattern)
+		}
+		seen[name] = true
+		segments = append(segments, segment{kind: kind, value: name})
+	}
+	return segments, nil
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+func joinPath(prefix, pattern string) string {
+	if prefix == "" {
+		return pattern
+	}
+	if pattern == "" || pattern == "/" {
+		return prefix
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(pattern, "/")
+}
+
+func requestHost(req *request.Request) string {
+	host := req.Headers.Get("Host")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func allowHeader(methods []string) string {
+	methods = append(methods, "OPTIONS")
+	slices.Sort(methods)
+	return strings.Join(slices.Compact(methods), ", ")
+}
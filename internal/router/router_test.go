@@ -0,0 +1,124 @@
+package router
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, r *Router, raw string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(bytes.NewBufferString(raw))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	r.Serve(response.NewWriter(&buf), req)
+	return buf.String()
+}
+
+func named(name string) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		body := []byte(name + " id=" + req.PathValue("id") + " rest=" + req.PathValue("rest"))
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+}
+
+func TestRouterMatching(t *testing.T) {
+	r := New()
+	r.Get("/", named("root"))
+	r.Get("/users/{id}", named("user"))
+	r.Get("/users/me", named("me"))
+	r.Post("/users/{id}", named("update"))
+	r.Get("/static/{rest...}", named("static"))
+	api := r.Group("/api")
+	v1 := api.Group("/v1")
+	v1.Get("/items/{id}", named("item"))
+	r.Host("admin.example.com").Get("/", named("admin"))
+
+	cases := []struct {
+		req  string
+		want string
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", "root id= rest="},
+		{"GET /users/42 HTTP/1.1\r\n\r\n", "user id=42 rest="},
+		{"GET /users/me HTTP/1.1\r\n\r\n", "me id= rest="},
+		{"POST /users/42 HTTP/1.1\r\n\r\n", "update id=42 rest="},
+		{"GET /users/a%20b?x=1 HTTP/1.1\r\n\r\n", "user id=a b rest="},
+		{"GET /static/css/site.css HTTP/1.1\r\n\r\n", "static id= rest=css/site.css"},
+		{"GET /static HTTP/1.1\r\n\r\n", "static id= rest="},
+		{"GET /api/v1/items/7 HTTP/1.1\r\n\r\n", "item id=7 rest="},
+		{"GET / HTTP/1.1\r\nHost: admin.example.com:8080\r\n\r\n", "admin id= rest="},
+		{"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "root id= rest="},
+	}
+	for _, c := range cases {
+		out := serve(t, r, c.req)
+		assert.Contains(t, out, "HTTP/1.1 200 OK\r\n", c.req)
+		assert.Contains(t, out, "\r\n\r\n"+c.want, c.req)
+	}
+}
+
+func TestRouterAutomaticResponses(t *testing.T) {
+	r := New()
+	r.Get("/users/{id}", named("user"))
+	r.Delete("/users/{id}", named("delete"))
+
+	// Test: 404
+	out := serve(t, r, "GET /nope HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 404 Not Found\r\n")
+
+	// Test: 405 with Allow
+	out = serve(t, r, "PUT /users/1 HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 405 Method Not Allowed\r\n")
+	assert.Contains(t, out, "allow: DELETE, GET, OPTIONS\r\n")
+
+	// Test: OPTIONS
+	out = serve(t, r, "OPTIONS /users/1 HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "HTTP/1.1 204 No Content\r\n")
+	assert.Contains(t, out, "allow: DELETE, GET, OPTIONS\r\n")
+
+	// Test: Custom NotFound
+	r.NotFound = named("custom")
+	out = serve(t, r, "GET /nope HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "custom")
+}
+
+func TestBadPatterns(t *testing.T) {
+	r := New()
+	assert.Panics(t, func() { r.Get("users", named("x")) })
+	assert.Panics(t, func() { r.Get("/{rest...}/x", named("x")) })
+	assert.Panics(t, func() { r.Get("/{id}/{id}", named("x")) })
+	assert.Panics(t, func() { r.Get("/a{id}", named("x")) })
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	tag := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(w *response.Writer, req *request.Request) {
+				w.OnHeaders(func(_ response.StatusCode, h headers.Headers) {
+					h.Set("X-Mw", name)
+				})
+				next(w, req)
+			}
+		}
+	}
+
+	r := New()
+	r.Use(tag("root"))
+	r.Get("/a", named("a"))
+	api := r.Group("/api")
+	api.Use(tag("api"))
+	api.Get("/b", named("b"))
+
+	out := serve(t, r, "GET /a HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "x-mw: root\r\n")
+
+	out = serve(t, r, "GET /api/b HTTP/1.1\r\n\r\n")
+	assert.Contains(t, out, "x-mw: root, api\r\n")
+}
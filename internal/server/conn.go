@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, used to unblock a pending Read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// conn applies the server's read timeout from the first byte of each
+// request rather than from when the server starts waiting for it.
+type conn struct {
+	net.Conn
+	readTimeout time.Duration
+	idle        bool
+	firstByteAt time.Time
+
+	// A background read watches for the client going away while a handler
+	// runs. A byte it reads belongs to the next request and is kept in
+	// pending; an error means the client is gone.
+	bgDone  chan struct{}
+	bgErr   error
+	pending []byte
+}
+
+func (c *conn) awaitRequest(timeout time.Duration) {
+	c.idle = true
+	c.firstByteAt = time.Time{}
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		c.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if len(c.pending) > 0 {
+		n = copy(p, c.pending)
+		c.pending = c.pending[n:]
+	} else {
+		n, err = c.Conn.Read(p)
+	}
+	if n > 0 && c.idle {
+		c.idle = false
+		c.firstByteAt = time.Now()
+		if c.readTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+	}
+	return n, err
+}
+
+func (c *conn) setWriteDeadline(timeout time.Duration) {
+	if timeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(timeout))
+	} else {
+		c.SetWriteDeadline(time.Time{})
+	}
+}
+
+// startBackgroundRead calls cancel if the client disconnects before
+// stopBackgroundRead is called.
+func (c *conn) startBackgroundRead(cancel context.CancelFunc) {
+	c.bgDone = make(chan struct{})
+	go func() {
+		defer close(c.bgDone)
+		var b [1]byte
+		n, err := c.Conn.Read(b[:])
+		if n > 0 {
+			c.pending = append(c.pending, b[0])
+		}
+		if err != nil && !isTimeout(err) {
+			c.bgErr = err
+			cancel()
+		}
+	}()
+}
+
+func (c *conn) stopBackgroundRead() {
+	if c.bgDone == nil {
+		return
+	}
+	c.Conn.SetReadDeadline(aLongTimeAgo)
+	<-c.bgDone
+	c.bgDone = nil
+	c.Conn.SetReadDeadline(time.Time{})
+}
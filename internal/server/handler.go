@@ -1,8 +1,36 @@
 package server
 
 import (
+	"net"
+
 	"github.com/nhdewitt/http-from-tcp/internal/request"
 	"github.com/nhdewitt/http-from-tcp/internal/response"
 )
 
 type Handler func(w *response.Writer, req *request.Request)
+
+// ErrorHandler writes the response for a request that could not be parsed.
+// req holds whatever was parsed before the error along with the connection
+// metadata; its RequestLine may be empty.
+type ErrorHandler func(w *response.Writer, req *request.Request, err error)
+
+// PanicHandler receives the value and stack of a recovered handler panic
+// along with the request being served.
+type PanicHandler func(p any, stack []byte, req *request.Request)
+
+type ConnState int
+
+const (
+	// StateNew is reported for every accepted connection, including ones
+	// rejected for being over a limit.
+	StateNew ConnState = iota
+	// StateClosed is reported once the server is done with a connection.
+	StateClosed
+	// StateHijacked is reported when a handler takes over a connection
+	// with response.Writer.Hijack. The server is done with it from then
+	// on and reports no further states.
+	StateHijacked
+)
+
+// ConnStateHook is called as connections move between states.
+type ConnStateHook func(c net.Conn, state ConnState)
@@ -0,0 +1,15 @@
+package server
+
+// Middleware wraps a Handler to run code before and after it, or instead of
+// it. To observe or rewrite the response, a middleware registers hooks on
+// the Writer (OnHeaders, WrapBody) or hands the next handler the Writer of
+// a response.Recorder.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h in m so that m[0] is the outermost middleware and runs first.
+func Chain(h Handler, m ...Middleware) Handler {
+	for i := len(m) - 1; i >= 0; i-- {
+		h = m[i](h)
+	}
+	return h
+}
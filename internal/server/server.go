@@ -1,71 +1,725 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/http2"
 	"github.com/nhdewitt/http-from-tcp/internal/request"
 	"github.com/nhdewitt/http-from-tcp/internal/response"
 )
 
+var ErrServerClosed = errors.New("server closed")
+
+// Server accepts connections and dispatches parsed requests to Handler.
+// Fields must be set before calling ListenAndServe or Serve.
 type Server struct {
-	listener    net.Listener
-	isListening atomic.Bool
-	handler     func(w *response.Writer, req *request.Request)
+	// Addrs lists the addresses ListenAndServe binds to, in host:port form.
+	// The host may be empty (all interfaces), an IPv4 or bracketed IPv6
+	// address, a hostname, or the name of a network interface, in which
+	// case every address of that interface is bound.
+	Addrs   []string
+	Handler Handler
+
+	// TLS is enabled for ListenAndServe and ServeTLS when TLSConfig,
+	// Certificates or SelfSignedTLS is set. Certificates are loaded from
+	// disk, picked by SNI (the first is the default) and reloaded when the
+	// files change, checked at most every CertReloadInterval (10s if zero).
+	// SelfSignedTLS generates a development certificate at startup.
+	// Listeners passed to Serve are used as-is.
+	TLSConfig          *tls.Config
+	Certificates       []CertKeyPair
+	CertReloadInterval time.Duration
+	SelfSignedTLS      bool
+
+	// ClientAuth sets whether client certificates are requested or required
+	// and verified. They are verified against ClientCAs, plus the PEM
+	// certificates in ClientCAFile if set.
+	ClientAuth   tls.ClientAuthType
+	ClientCAs    *x509.CertPool
+	ClientCAFile string
+
+	MaxHeaderBytes int
+	MaxBodyBytes   int64
+
+	// H2C serves HTTP/2 on connections that aren't TLS, to clients that
+	// start with the HTTP/2 connection preface or upgrade a request with
+	// "Upgrade: h2c". ReadTimeout does not apply to HTTP/2 connections.
+	H2C bool
+
+	// MaxConns caps concurrently served connections across all listeners.
+	// LimitMode selects what happens once the cap is reached.
+	// MaxConnsPerIP caps connections from a single client IP; excess
+	// connections are always rejected with 503.
+	MaxConns      int
+	LimitMode     LimitMode
+	MaxConnsPerIP int
+
+	// ReadTimeout bounds reading a request once its first byte arrives.
+	// WriteTimeout bounds writing the response. IdleTimeout bounds how long
+	// a connection waits for its next request; ReadTimeout is used if zero.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// HandlerTimeout, if set, bounds each request's context. Handlers must
+	// watch req.Context() for it to have an effect.
+	HandlerTimeout time.Duration
+
+	// Logger receives errors the server cannot return to a caller, such as
+	// failed accepts. log.Default() is used if nil.
+	Logger *log.Logger
+	// ErrorHandler writes the response to requests that fail to parse.
+	ErrorHandler ErrorHandler
+	// ConnState, if set, is called when connections are accepted and
+	// closed.
+	ConnState ConnStateHook
+	// PanicHandler, if set, is called after a panic in Handler has been
+	// recovered and logged, for reporting it elsewhere.
+	PanicHandler PanicHandler
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	perIP     map[string]int
+	closed    atomic.Bool
+	nextID    atomic.Uint64
+	initOnce  sync.Once
+	sem       chan struct{}
+	done      chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+type LimitMode int
+
+const (
+	// LimitBlock stops accepting until a connection slot frees up, leaving
+	// new clients waiting in the listen backlog.
+	LimitBlock LimitMode = iota
+	// LimitReject accepts the connection, answers 503 and closes it.
+	LimitReject
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+func (s *Server) ListenAndServe() error {
+	if len(s.Addrs) == 0 {
+		return fmt.Errorf("no listen addresses configured")
+	}
+
+	tlsConfig, err := s.tlsConfig()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	var addrs []string
+	for _, a := range s.Addrs {
+		resolved, err := resolveListenAddr(a)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, resolved...)
+	}
+
+	var listeners []net.Listener
+	for _, a := range addrs {
+		l, err := net.Listen("tcp", a)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", a, err)
+		}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errs <- s.Serve(l)
+		}()
+	}
+
+	var first error
+	for range listeners {
+		err := <-errs
+		if first == nil || errors.Is(first, ErrServerClosed) {
+			first = err
+		}
+		if !errors.Is(err, ErrServerClosed) {
+			s.Close()
+		}
+	}
+	return first
+}
+
+// Serve accepts connections on l until the server is closed or Accept fails
+// permanently. It always returns a non-nil error; ErrServerClosed after
+// Close.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	s.initOnce.Do(s.init)
+
+	var backoff time.Duration
+	for {
+		if s.LimitMode == LimitBlock && !s.acquire() {
+			return ErrServerClosed
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			if s.LimitMode == LimitBlock {
+				s.release()
+			}
+			if s.closed.Load() {
+				return ErrServerClosed
+			}
+			if isTemporary(err) {
+				backoff = max(min(backoff*2, maxAcceptBackoff), minAcceptBackoff)
+				s.logf("Error accepting connection: %v; retrying in %v", err, backoff)
+				select {
+				case <-time.After(backoff):
+				case <-s.done:
+				}
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		s.setState(conn, StateNew)
+
+		if s.LimitMode == LimitReject && !s.tryAcquire() {
+			go s.reject(conn)
+			continue
+		}
+
+		if !s.trackConn(conn, true) {
+			s.release()
+			conn.Close()
+			s.setState(conn, StateClosed)
+			return ErrServerClosed
+		}
+		if !s.acquireIP(conn) {
+			s.trackConn(conn, false)
+			s.release()
+			go s.reject(conn)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) init() {
+	s.done = make(chan struct{})
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.MaxConns > 0 {
+		s.sem = make(chan struct{}, s.MaxConns)
+	}
+}
+
+func (s *Server) acquire() bool {
+	if s.sem == nil {
+		return true
+	}
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *Server) tryAcquire() bool {
+	if s.sem == nil {
+		return true
+	}
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) release() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+func (s *Server) acquireIP(c net.Conn) bool {
+	if s.MaxConnsPerIP <= 0 {
+		return true
+	}
+	ip := clientIP(c)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perIP[ip] >= s.MaxConnsPerIP {
+		return false
 	}
-	s := &Server{
-		listener: listener,
-		handler:  handler,
+	if s.perIP == nil {
+		s.perIP = make(map[string]int)
 	}
-	s.isListening.Store(true)
-	go s.listen()
+	s.perIP[ip]++
+	return true
+}
+
+func (s *Server) releaseIP(c net.Conn) {
+	if s.MaxConnsPerIP <= 0 {
+		return
+	}
+	ip := clientIP(c)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+// reject answers a connection that is over a limit with 503 and closes it
+// without reading the request.
+func (s *Server) reject(c net.Conn) {
+	defer s.setState(c, StateClosed)
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	response.WriteError(response.NewWriter(c), response.StatusServiceUnavailable, nil)
+}
 
-	return s, nil
+// ServeTLS is like Serve but terminates TLS on l using the server's TLS
+// settings.
+func (s *Server) ServeTLS(l net.Listener) error {
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig == nil {
+		return errors.New("TLS is not configured")
+	}
+	return s.Serve(tls.NewListener(l, tlsConfig))
 }
 
 func (s *Server) Close() error {
-	if !s.isListening.CompareAndSwap(true, false) {
+	if !s.closed.CompareAndSwap(false, true) {
 		return nil
 	}
+	s.initOnce.Do(s.init)
+	close(s.done)
+	s.cancel()
 
-	if s.listener != nil {
-		return s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.Close()
 	}
+	return err
+}
+
+// ListenAddrs returns the addresses of the listeners currently being served.
+func (s *Server) ListenAddrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return nil
+	var addrs []net.Addr
+	for l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
 }
 
-func (s *Server) listen() {
-	for {
-		conn, err := s.listener.Accept()
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.closed.Load() {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.closed.Load() {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) handle(c net.Conn) {
+	var tlsInfo *request.TLSInfo
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			c.Close()
+			s.forget(c, StateClosed)
+		}
+	}()
+
+	if tc, ok := c.(*tls.Conn); ok {
+		if s.ReadTimeout > 0 {
+			tc.SetDeadline(time.Now().Add(s.ReadTimeout))
+		}
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		tlsInfo = request.NewTLSInfo(tc.ConnectionState())
+	}
+
+	conn := &conn{Conn: c, readTimeout: s.ReadTimeout}
+	rr := request.NewReader(conn, request.Limits{
+		MaxHeaderBytes: s.MaxHeaderBytes,
+		MaxBodyBytes:   s.MaxBodyBytes,
+	})
+
+	connID := s.nextID.Add(1)
+	timeout := s.ReadTimeout
+	if s.H2C && tlsInfo == nil {
+		conn.awaitRequest(timeout)
+		ok, err := sniffPreface(conn)
+		if ok {
+			http2.ServeConn(conn, s.http2Config(c, connID), nil)
+			return
+		}
+		if err != nil && len(conn.pending) == 0 {
+			return
+		}
+	}
+	for seq := 1; ; seq++ {
+		conn.awaitRequest(timeout)
+		start := time.Now()
+		req, err := rr.ReadRequest()
 		if err != nil {
-			if !s.isListening.Load() {
+			if conn.idle && (errors.Is(err, io.EOF) || isTimeout(err)) {
 				return
 			}
-			log.Printf("Error accepting connection: %v", err)
-			continue
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if req == nil {
+				req = &request.Request{Headers: headers.NewHeaders()}
+			}
+			setConnInfo(req, conn, connID, seq, start, tlsInfo)
+			conn.setWriteDeadline(s.WriteTimeout)
+			w := response.NewWriter(conn)
+			s.writeError(w, req, err)
+			w.Close()
+			return
 		}
+		setConnInfo(req, conn, connID, seq, start, tlsInfo)
+		conn.SetReadDeadline(time.Time{})
+		conn.setWriteDeadline(s.WriteTimeout)
 
-		go s.handle(conn)
+		if s.H2C && tlsInfo == nil && http2.IsUpgrade(req) {
+			s.upgradeH2C(c, conn, rr, req, connID)
+			return
+		}
+
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if s.HandlerTimeout > 0 {
+			ctx, cancel = context.WithTimeout(s.ctx, s.HandlerTimeout)
+		} else {
+			ctx, cancel = context.WithCancel(s.ctx)
+		}
+		req = req.WithContext(ctx)
+
+		w := response.NewConnWriter(conn, func() (net.Conn, []byte, error) {
+			conn.stopBackgroundRead()
+			c.SetDeadline(time.Time{})
+			buffered := append(slices.Clone(rr.Buffered()), conn.pending...)
+			conn.pending = nil
+			hijacked = true
+			s.forget(c, StateHijacked)
+			return c, buffered, nil
+		})
+		conn.startBackgroundRead(cancel)
+		ok := s.serveRequest(c, w, req)
+		conn.stopBackgroundRead()
+		cancel()
+		if hijacked || !ok || conn.bgErr != nil {
+			return
+		}
+
+		if s.closed.Load() || !keepAlive(req, w) {
+			return
+		}
+
+		timeout = s.IdleTimeout
+		if timeout == 0 {
+			timeout = s.ReadTimeout
+		}
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+// sniffPreface reads from c for as long as the input matches the HTTP/2
+// connection preface and reports whether all of it arrived. The bytes read
+// are left for the next reader of c either way.
+func sniffPreface(c *conn) (bool, error) {
+	buf := make([]byte, len(http2.Preface))
+	n := 0
+	var err error
+	for n < len(buf) && err == nil && string(buf[:n]) == http2.Preface[:n] {
+		var m int
+		m, err = c.Read(buf[n:])
+		n += m
+	}
+	c.pending = append(buf[:n], c.pending...)
+	return string(buf[:n]) == http2.Preface, err
+}
 
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
+// upgradeH2C switches the connection to HTTP/2 for a request with
+// "Upgrade: h2c", which is then served as the first stream.
+func (s *Server) upgradeH2C(c net.Conn, conn *conn, rr *request.Reader, req *request.Request, connID uint64) {
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+	w := response.NewWriter(conn)
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	conn.pending = append(slices.Clone(rr.Buffered()), conn.pending...)
+	http2.ServeConn(conn, s.http2Config(c, connID), req)
+}
+
+func (s *Server) http2Config(c net.Conn, connID uint64) http2.Config {
+	idle := s.IdleTimeout
+	if idle == 0 {
+		idle = s.ReadTimeout
+	}
+	return http2.Config{
+		Handler: func(w *response.Writer, req *request.Request) bool {
+			// After a panic the response may still be whole: the 500
+			// sent in place of one that hadn't started.
+			return s.serveRequest(c, w, req) || w.Done()
+		},
+		ErrorHandler:   s.writeError,
+		MaxHeaderBytes: s.MaxHeaderBytes,
+		MaxBodyBytes:   s.MaxBodyBytes,
+		IdleTimeout:    idle,
+		WriteTimeout:   s.WriteTimeout,
+		HandlerTimeout: s.HandlerTimeout,
+		Context:        s.ctx,
+		ConnID:         connID,
+	}
+}
+
+// forget stops tracking c, freeing its connection slots, and reports
+// state. Close no longer closes c afterwards.
+func (s *Server) forget(c net.Conn, state ConnState) {
+	s.trackConn(c, false)
+	s.releaseIP(c)
+	s.release()
+	s.setState(c, state)
+}
+
+// serveRequest runs the handler, recovering from panics. It reports false if
+// the handler panicked and the connection must not be reused.
+func (s *Server) serveRequest(c net.Conn, w *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		ok = false
+
+		stack := debug.Stack()
+		s.logf("panic serving %s \"%s %s HTTP/%s\": %v\n%s", c.RemoteAddr(),
+			req.RequestLine.Method, req.RequestLine.RequestTarget, req.RequestLine.HttpVersion, p, stack)
+		if s.PanicHandler != nil {
+			s.PanicHandler(p, stack, req)
+		}
+		// Once the headers are out, a 500 can't be sent; closing the
+		// connection is the only way left to signal the failure.
+		if w.Reset() == nil {
+			response.WriteError(w, response.StatusInternalServerError, nil)
+		}
+	}()
+
+	if s.Handler == nil {
+		response.WriteError(w, response.StatusNotFound, nil)
+		return true
+	}
+	s.Handler(w, req)
+	return w.Close() == nil
+}
+
+func setConnInfo(req *request.Request, c *conn, connID uint64, seq int, start time.Time, tlsInfo *request.TLSInfo) {
+	req.RemoteAddr = c.RemoteAddr()
+	req.LocalAddr = c.LocalAddr()
+	req.ConnID = connID
+	req.Sequence = seq
+	req.ReceivedAt = c.firstByteAt
+	if req.ReceivedAt.IsZero() {
+		// The request was already buffered from an earlier read.
+		req.ReceivedAt = start
+	}
+	req.ReadAt = time.Now()
+	req.TLS = tlsInfo
+}
+
+func (s *Server) writeError(w *response.Writer, req *request.Request, err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(w, req, err)
+		return
+	}
+	DefaultErrorHandler(w, req, err)
+}
+
+// DefaultErrorHandler answers a request that failed to parse with 431, 413,
+// 501, 408 or 400 depending on err.
+func DefaultErrorHandler(w *response.Writer, req *request.Request, err error) {
+	switch {
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		response.WriteError(w, response.StatusRequestHeaderFieldsTooLarge, nil)
+	case errors.Is(err, request.ErrBodyTooLarge):
+		response.WriteError(w, response.StatusRequestEntityTooLarge, nil)
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		response.WriteError(w, response.StatusNotImplemented, nil)
+	case isTimeout(err):
+		response.WriteError(w, response.StatusRequestTimeout, nil)
+	default:
+		response.WriteError(w, response.StatusBadRequest, nil)
+	}
+}
+
+func (s *Server) setState(c net.Conn, state ConnState) {
+	if s.ConnState != nil {
+		s.ConnState(c, state)
+	}
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
 		return
 	}
+	log.Printf(format, args...)
+}
+
+func keepAlive(req *request.Request, w *response.Writer) bool {
+	if strings.EqualFold(req.Headers.Get("Connection"), "close") {
+		return false
+	}
+	h := w.Headers()
+	if h == nil || strings.EqualFold(h.Get("Connection"), "close") {
+		return false
+	}
+	bodyless := w.StatusCode() == response.StatusNoContent || w.StatusCode() == response.StatusNotModified
+	if !bodyless && h.Get("Content-Length") == "" && !strings.EqualFold(h.Get("Transfer-Encoding"), "chunked") {
+		return false
+	}
+	return w.Done()
+}
+
+func isTemporary(err error) bool {
+	if isTimeout(err) {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+func clientIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// resolveListenAddr expands an address whose host names a network interface
+// into one address per IP assigned to that interface.
+func resolveListenAddr(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return []string{addr}, nil
+	}
+	ifAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("addresses of interface %s: %w", host, err)
+	}
 
-	resp := response.NewWriter(conn)
-	s.handler(resp, req)
+	var addrs []string
+	for _, a := range ifAddrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.String()
+		if ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+			ip += "%" + iface.Name
+		}
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses", host)
+	}
+	return addrs, nil
 }
@@ -0,0 +1,675 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		err := <-done
+		assert.True(t, errors.Is(err, ErrServerClosed), "unexpected Serve error: %v", err)
+	})
+	return l.Addr().String()
+}
+
+func textHandler(body string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(body))
+		h.SetNew("Connection", "keep-alive")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}
+}
+
+func readResponse(t *testing.T, r *bufio.Reader) (status string, body string) {
+	t.Helper()
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	length := 0
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+		k, v, _ := strings.Cut(strings.TrimSpace(line), ":")
+		if strings.EqualFold(k, "content-length") {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			require.NoError(t, err)
+			length = n
+		}
+	}
+	b := make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	require.NoError(t, err)
+	return strings.TrimSpace(status), string(b)
+}
+
+func TestServeKeepAlive(t *testing.T) {
+	addr := startServer(t, &Server{Handler: textHandler("hello")})
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	for range 3 {
+		_, err = io.WriteString(c, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		require.NoError(t, err)
+		status, body := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, "hello", body)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler:        textHandler("hello"),
+		MaxHeaderBytes: 64,
+		MaxBodyBytes:   4,
+	})
+
+	cases := []struct {
+		req    string
+		status string
+	}{
+		{"GARBAGE\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"GET / HTTP/1.1\r\nX: " + strings.Repeat("a", 100) + "\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large"},
+		{"POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789", "HTTP/1.1 413 Content Too Large"},
+	}
+	for _, tc := range cases {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		_, err = io.WriteString(c, tc.req)
+		require.NoError(t, err)
+		status, _ := readResponse(t, bufio.NewReader(c))
+		assert.Equal(t, tc.status, status)
+		c.Close()
+	}
+}
+
+func TestServeChunkedRequest(t *testing.T) {
+	addr := startServer(t, &Server{Handler: func(w *response.Writer, req *request.Request) {
+		textHandler(req.Path()+" "+string(req.Body))(w, req)
+	}})
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+
+	// The chunk bytes must not be taken for the next request.
+	_, err = io.WriteString(c, "POST /a HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"3\r\nabc\r\n0\r\n\r\n"+
+		"GET /b HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	status, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "/a abc", body)
+	status, body = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "/b ", body)
+
+	cases := []struct {
+		te     string
+		status string
+	}{
+		{"Transfer-Encoding: chunked\r\nContent-Length: 3\r\n", "HTTP/1.1 400 Bad Request"},
+		{"Transfer-Encoding: gzip\r\n", "HTTP/1.1 501 Not Implemented"},
+	}
+	for _, tc := range cases {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(c, "POST /a HTTP/1.1\r\n"+tc.te+"\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\n\r\n")
+		require.NoError(t, err)
+		r := bufio.NewReader(c)
+		status, _ := readResponse(t, r)
+		assert.Equal(t, tc.status, status)
+		_, err = r.ReadByte()
+		assert.Error(t, err, "the connection is closed before /smuggled is served")
+		c.Close()
+	}
+}
+
+func TestServeIdleTimeout(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler:     textHandler("hello"),
+		IdleTimeout: 50 * time.Millisecond,
+	})
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	_, err = io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	readResponse(t, r)
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestListenAndServeMultipleAddrs(t *testing.T) {
+	s := &Server{
+		Addrs:   []string{"127.0.0.1:0", "[::1]:0"},
+		Handler: textHandler("hello"),
+	}
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		s.Addrs = s.Addrs[:1]
+	} else {
+		l.Close()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	require.Eventually(t, func() bool {
+		return len(s.ListenAddrs()) == len(s.Addrs)
+	}, time.Second, 10*time.Millisecond)
+
+	for _, a := range s.ListenAddrs() {
+		c, err := net.Dial("tcp", a.String())
+		require.NoError(t, err)
+		_, err = io.WriteString(c, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+		require.NoError(t, err)
+		status, _ := readResponse(t, bufio.NewReader(c))
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		c.Close()
+	}
+
+	s.Close()
+	assert.ErrorIs(t, <-done, ErrServerClosed)
+}
+
+func blockingHandler(release <-chan struct{}) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		<-release
+		textHandler("done")(w, req)
+	}
+}
+
+func TestMaxConnsReject(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	addr := startServer(t, &Server{
+		Handler:   blockingHandler(release),
+		MaxConns:  1,
+		LimitMode: LimitReject,
+	})
+
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busy.Close()
+	_, err = io.WriteString(busy, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	status, _ := readResponse(t, bufio.NewReader(c))
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", status)
+}
+
+func TestMaxConnsBlock(t *testing.T) {
+	release := make(chan struct{})
+	addr := startServer(t, &Server{
+		Handler:  blockingHandler(release),
+		MaxConns: 1,
+	})
+
+	first, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer first.Close()
+	_, err = io.WriteString(first, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+
+	second, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer second.Close()
+	_, err = io.WriteString(second, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+
+	second.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = second.Read(make([]byte, 1))
+	require.True(t, isTimeout(err), "second connection served while first was busy: %v", err)
+	second.SetReadDeadline(time.Time{})
+
+	close(release)
+	status, _ := readResponse(t, bufio.NewReader(first))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	status, _ = readResponse(t, bufio.NewReader(second))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	addr := startServer(t, &Server{
+		Handler:       blockingHandler(release),
+		MaxConnsPerIP: 1,
+	})
+
+	busy, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busy.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	status, _ := readResponse(t, bufio.NewReader(c))
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable", status)
+}
+
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{Handler: textHandler("hello"), Logger: log.New(io.Discard, "", 0)}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(&flakyListener{Listener: l, failures: 3})
+	}()
+
+	start := time.Now()
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	status, _ := readResponse(t, bufio.NewReader(c))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.GreaterOrEqual(t, time.Since(start), minAcceptBackoff*(1+2+4))
+
+	s.Close()
+	assert.ErrorIs(t, <-done, ErrServerClosed)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	var buf strings.Builder
+	var mu sync.Mutex
+	panics := make(chan any, 2)
+	addr := startServer(t, &Server{
+		H2C: true,
+		Handler: func(w *response.Writer, req *request.Request) {
+			w.WriteStatusLine(response.StatusOK)
+			switch req.RequestLine.RequestTarget {
+			case "/late":
+				w.WriteHeaders(response.GetDefaultHeaders(0))
+			case "/partial":
+				h := headers.NewHeaders()
+				h.Set("Transfer-Encoding", "chunked")
+				w.WriteHeaders(h)
+				w.Write([]byte("abc"))
+			}
+			panic("boom")
+		},
+		Logger: log.New(writerFunc(func(p []byte) (int, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return buf.Write(p)
+		}), "", 0),
+		PanicHandler: func(p any, stack []byte, req *request.Request) {
+			panics <- p
+		},
+	})
+
+	// Test: Panic before the headers are sent yields a 500
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = io.WriteString(c, "GET /early HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	status, _ := readResponse(t, bufio.NewReader(c))
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", status)
+	assert.Equal(t, "boom", <-panics)
+
+	// Test: Panic after the headers are sent aborts the connection
+	c2, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c2.Close()
+	_, err = io.WriteString(c2, "GET /late HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	b, err := io.ReadAll(c2)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(b), "\r\n\r\n"))
+	assert.Equal(t, "boom", <-panics)
+
+	// Test: Over HTTP/2 a 500 still ends the stream, while a response
+	// broken off by the panic is reset
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}, Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + addr + "/early")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "boom", <-panics)
+	resp, err = client.Get("http://" + addr + "/partial")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.ErrorContains(t, err, "INTERNAL_ERROR")
+	assert.Equal(t, "boom", <-panics)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, buf.String(), `"GET /early HTTP/1.1": boom`)
+	assert.Contains(t, buf.String(), "goroutine")
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestConnectionMetadata(t *testing.T) {
+	reqs := make(chan *request.Request, 4)
+	addr := startServer(t, &Server{
+		Handler: func(w *response.Writer, req *request.Request) {
+			reqs <- req
+			textHandler("ok")(w, req)
+		},
+	})
+
+	var conns []net.Conn
+	for range 2 {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close()
+		conns = append(conns, c)
+	}
+
+	// Two pipelined requests on the first connection, one on the second.
+	_, err := io.WriteString(conns[0], "GET /1 HTTP/1.1\r\n\r\nGET /2 HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conns[0])
+	readResponse(t, r)
+	readResponse(t, r)
+	_, err = io.WriteString(conns[1], "GET /3 HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	readResponse(t, bufio.NewReader(conns[1]))
+
+	first, second, third := <-reqs, <-reqs, <-reqs
+	assert.Equal(t, conns[0].LocalAddr().String(), first.RemoteAddr.String())
+	assert.Equal(t, addr, first.LocalAddr.String())
+	assert.Equal(t, 1, first.Sequence)
+	assert.Equal(t, 2, second.Sequence)
+	assert.Equal(t, first.ConnID, second.ConnID)
+	assert.NotEqual(t, first.ConnID, third.ConnID)
+	assert.Equal(t, 1, third.Sequence)
+	assert.False(t, first.ReceivedAt.IsZero())
+	assert.False(t, first.ReadAt.Before(first.ReceivedAt))
+	assert.Nil(t, first.TLS)
+}
+
+func TestRequestContext(t *testing.T) {
+	errs := make(chan error, 1)
+	ctxHandler := func(w *response.Writer, req *request.Request) {
+		select {
+		case <-req.Context().Done():
+			errs <- context.Cause(req.Context())
+		case <-time.After(5 * time.Second):
+			errs <- errors.New("context not cancelled")
+		}
+	}
+
+	// Test: Client disconnect
+	addr := startServer(t, &Server{Handler: ctxHandler})
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+
+	// Test: Handler timeout
+	addr = startServer(t, &Server{Handler: ctxHandler, HandlerTimeout: 20 * time.Millisecond})
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	assert.ErrorIs(t, <-errs, context.DeadlineExceeded)
+
+	// Test: Server close
+	s := &Server{Handler: ctxHandler}
+	addr = startServer(t, s)
+	c, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+}
+
+func TestPipelinedAfterBackgroundRead(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler: func(w *response.Writer, req *request.Request) {
+			time.Sleep(20 * time.Millisecond)
+			textHandler(req.RequestLine.RequestTarget)(w, req)
+		},
+	})
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	_, err = io.WriteString(c, "GET /first HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	// Arrives while the first handler runs, so the background read takes
+	// its first byte.
+	_, err = io.WriteString(c, "GET /second HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+
+	_, body := readResponse(t, r)
+	assert.Equal(t, "/first", body)
+	_, body = readResponse(t, r)
+	assert.Equal(t, "/second", body)
+}
+
+func TestHijack(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	hijackErr := make(chan error, 1)
+	s := &Server{
+		Handler: func(w *response.Writer, req *request.Request) {
+			if req.Path() == "/late" {
+				textHandler("x")(w, req)
+				_, _, err := w.Hijack()
+				hijackErr <- err
+				return
+			}
+			// Give the client's next bytes time to reach the background
+			// read.
+			time.Sleep(20 * time.Millisecond)
+			c, buffered, err := w.Hijack()
+			if err != nil {
+				hijackErr <- err
+				return
+			}
+			// Serve the connection after the handler has returned.
+			go func() {
+				defer c.Close()
+				io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\n\r\n")
+				c.Write(buffered)
+				io.Copy(c, c)
+			}()
+		},
+		MaxConns:  1,
+		LimitMode: LimitReject,
+		ConnState: func(c net.Conn, state ConnState) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, state)
+		},
+	}
+	addr := startServer(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+
+	_, err = io.WriteString(c, "GET / HTTP/1.1\r\n\r\nab")
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = io.WriteString(c, "c")
+	require.NoError(t, err)
+
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	_, err = r.ReadString('\n')
+	require.NoError(t, err)
+	got := make([]byte, 3)
+	_, err = io.ReadFull(r, got)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(got), "buffered bytes come first, in order")
+
+	mu.Lock()
+	assert.Equal(t, []ConnState{StateNew, StateHijacked}, states)
+	mu.Unlock()
+
+	// Test: The hijacked connection no longer holds the only slot
+	c2, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c2.Close()
+	_, err = io.WriteString(c2, "GET /late HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	status, body := readResponse(t, bufio.NewReader(c2))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "x", body)
+	assert.Error(t, <-hijackErr, "too late once the headers are out")
+
+	// Test: Close leaves hijacked connections alone
+	s.Close()
+	_, err = io.WriteString(c, "still here")
+	require.NoError(t, err)
+	got = make([]byte, len("still here"))
+	_, err = io.ReadFull(r, got)
+	require.NoError(t, err)
+	assert.Equal(t, "still here", string(got))
+}
+
+func TestH2C(t *testing.T) {
+	addr := startServer(t, &Server{
+		H2C: true,
+		Handler: func(w *response.Writer, req *request.Request) {
+			body := req.RequestLine.HttpVersion + " " + req.Path() + " " + strconv.Itoa(req.Sequence)
+			textHandler(body)(w, req)
+		},
+	})
+
+	// Test: Prior knowledge
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}, Timeout: 5 * time.Second}
+	for i := 1; i <= 2; i++ {
+		resp, err := client.Get("http://" + addr + "/prior")
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, "2.0 /prior "+strconv.Itoa(i), string(body))
+		assert.Empty(t, resp.Header.Get("Connection"))
+	}
+
+	// Test: HTTP/1.1 is still served
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	io.WriteString(c, "GET /one HTTP/1.1\r\n\r\n")
+	status, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "1.1 /one 1", body)
+
+	// Test: Upgrade; the request becomes stream 1, sent the next frames
+	io.WriteString(c, "GET /up HTTP/1.1\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\n"+
+		"HTTP2-Settings: AAMAAABk\r\n\r\n"+
+		"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x00\x04\x00\x00\x00\x00\x00")
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+	var got []byte
+	for {
+		var hdr [9]byte
+		_, err := io.ReadFull(r, hdr[:])
+		require.NoError(t, err)
+		payload := make([]byte, int(hdr[0])<<16|int(hdr[1])<<8|int(hdr[2]))
+		_, err = io.ReadFull(r, payload)
+		require.NoError(t, err)
+		typ, flags, id := hdr[3], hdr[4], hdr[8]
+		if typ == 0x1 {
+			assert.Equal(t, byte(1), id)
+			assert.Equal(t, byte(0x88), payload[0], ":status 200")
+		}
+		if typ == 0x0 && id == 1 {
+			got = append(got, payload...)
+			if flags&0x1 != 0 {
+				break
+			}
+		}
+	}
+	assert.Equal(t, "2.0 /up 2", string(got))
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultCertReloadInterval = 10 * time.Second
+
+// CertKeyPair names a PEM certificate chain and its private key on disk.
+type CertKeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// tlsConfig builds the TLS configuration for ListenAndServe, or returns nil
+// if TLS is not configured.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.TLSConfig == nil && len(s.Certificates) == 0 && !s.SelfSignedTLS {
+		return nil, nil
+	}
+
+	var cfg *tls.Config
+	if s.TLSConfig != nil {
+		cfg = s.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	switch {
+	case len(s.Certificates) > 0:
+		interval := s.CertReloadInterval
+		if interval == 0 {
+			interval = defaultCertReloadInterval
+		}
+		r, err := newCertReloader(s.Certificates, interval)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetCertificate = r.getCertificate
+	case s.SelfSignedTLS:
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		for _, a := range s.Addrs {
+			if host, _, err := net.SplitHostPort(a); err == nil && host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		cert, err := SelfSignedCertificate(hosts...)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+
+	if s.ClientAuth != tls.NoClientCert {
+		cfg.ClientAuth = s.ClientAuth
+	}
+	if s.ClientCAs != nil || s.ClientCAFile != "" {
+		pool := s.ClientCAs
+		if pool == nil {
+			pool = x509.NewCertPool()
+		} else {
+			pool = pool.Clone()
+		}
+		if s.ClientCAFile != "" {
+			pem, err := os.ReadFile(s.ClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("read client CA file: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", s.ClientCAFile)
+			}
+		}
+		cfg.ClientCAs = pool
+	}
+	if cfg.ClientAuth >= tls.VerifyClientCertIfGiven && cfg.ClientCAs == nil {
+		return nil, errors.New("client certificate verification configured without client CAs")
+	}
+
+	if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil && cfg.GetConfigForClient == nil {
+		return nil, errors.New("TLS configured without certificates")
+	}
+	return cfg, nil
+}
+
+// certReloader serves certificates loaded from disk, picking one by SNI and
+// reloading the files when their modification time changes. Files are
+// checked at most once per interval, during handshakes.
+type certReloader struct {
+	pairs    []CertKeyPair
+	interval time.Duration
+
+	mu        sync.Mutex
+	certs     []*tls.Certificate
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(pairs []CertKeyPair, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{
+		pairs:    pairs,
+		interval: interval,
+		certs:    make([]*tls.Certificate, len(pairs)),
+		modTimes: make([]time.Time, len(pairs)),
+	}
+	for i := range pairs {
+		if err := r.load(i); err != nil {
+			return nil, err
+		}
+	}
+	r.lastCheck = time.Now()
+	return r, nil
+}
+
+func (r *certReloader) load(i int) error {
+	p := r.pairs[i]
+	mod, err := modTime(p)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s: %w", p.CertFile, err)
+	}
+	r.certs[i] = &cert
+	r.modTimes[i] = mod
+	return nil
+}
+
+func (r *certReloader) reloadIfChanged() {
+	if time.Since(r.lastCheck) < r.interval {
+		return
+	}
+	r.lastCheck = time.Now()
+
+	for i, p := range r.pairs {
+		mod, err := modTime(p)
+		if err != nil || mod.Equal(r.modTimes[i]) {
+			continue
+		}
+		// A failed reload, e.g. while the files are half-written, keeps
+		// serving the previous certificate and is retried next interval.
+		r.load(i)
+	}
+}
+
+func (r *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reloadIfChanged()
+	if hello.ServerName != "" {
+		for _, c := range r.certs {
+			if hello.SupportsCertificate(c) == nil {
+				return c, nil
+			}
+		}
+	}
+	return r.certs[0], nil
+}
+
+func modTime(p CertKeyPair) (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{p.CertFile, p.KeyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// SelfSignedCertificate generates a throwaway certificate valid for hosts,
+// which may be hostnames or IP addresses. It is meant for development only.
+func SelfSignedCertificate(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"http-from-tcp development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns PEM encoded certificate and key signed by the CA.
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage, names ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, n)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) writePair(t *testing.T, dir, name string, names ...string) CertKeyPair {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, names[0], x509.ExtKeyUsageServerAuth, names...)
+	p := CertKeyPair{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, os.WriteFile(p.CertFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(p.KeyFile, keyPEM, 0o600))
+	return p
+}
+
+func startTLSServer(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeTLS(l)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return l.Addr().String()
+}
+
+func tlsGet(t *testing.T, addr string, cfg *tls.Config) (*x509.Certificate, string) {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, cfg)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = io.WriteString(c, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	_, body := readResponse(t, bufio.NewReader(c))
+	return c.ConnectionState().PeerCertificates[0], body
+}
+
+func TestTLSSNI(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	addr := startTLSServer(t, &Server{
+		Handler: textHandler("secure"),
+		Certificates: []CertKeyPair{
+			ca.writePair(t, dir, "a", "a.example.com"),
+			ca.writePair(t, dir, "b", "b.example.com"),
+		},
+	})
+
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		cert, body := tlsGet(t, addr, &tls.Config{ServerName: name, RootCAs: ca.pool})
+		assert.Equal(t, name, cert.Subject.CommonName)
+		assert.Equal(t, "secure", body)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	pair := ca.writePair(t, dir, "a", "old.example.com")
+	addr := startTLSServer(t, &Server{
+		Handler:            textHandler("secure"),
+		Certificates:       []CertKeyPair{pair},
+		CertReloadInterval: time.Millisecond,
+	})
+
+	cert, _ := tlsGet(t, addr, &tls.Config{ServerName: "old.example.com", RootCAs: ca.pool})
+	assert.Equal(t, "old.example.com", cert.Subject.CommonName)
+
+	ca.writePair(t, dir, "a", "new.example.com")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(pair.CertFile, future, future))
+	time.Sleep(5 * time.Millisecond)
+
+	cert, _ = tlsGet(t, addr, &tls.Config{ServerName: "new.example.com", RootCAs: ca.pool})
+	assert.Equal(t, "new.example.com", cert.Subject.CommonName)
+}
+
+func TestTLSSelfSigned(t *testing.T) {
+	addr := startTLSServer(t, &Server{
+		Handler:       textHandler("dev"),
+		SelfSignedTLS: true,
+	})
+
+	cert, body := tlsGet(t, addr, &tls.Config{InsecureSkipVerify: true})
+	assert.Equal(t, "dev", body)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	_, err := cert.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: pool})
+	assert.NoError(t, err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	clientCA := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "clients.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCA.cert.Raw}), 0o600))
+
+	infos := make(chan *request.TLSInfo, 1)
+	addr := startTLSServer(t, &Server{
+		Handler: func(w *response.Writer, req *request.Request) {
+			infos <- req.TLS
+			textHandler("ok")(w, req)
+		},
+		Certificates: []CertKeyPair{ca.writePair(t, dir, "srv", "localhost")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAFile: caFile,
+	})
+
+	certPEM, keyPEM := clientCA.issue(t, "billing-service", x509.ExtKeyUsageClientAuth, "billing.internal")
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	_, body := tlsGet(t, addr, &tls.Config{
+		ServerName:   "localhost",
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	assert.Equal(t, "ok", body)
+
+	info := <-infos
+	require.NotNil(t, info)
+	assert.True(t, info.Verified())
+	assert.Equal(t, "CN=billing-service", info.Subject())
+	assert.Equal(t, []string{"billing.internal"}, info.SANs())
+	assert.Equal(t, "TLS 1.3", info.VersionName())
+	assert.NotEmpty(t, info.CipherSuiteName())
+
+	// Test: No client certificate is rejected during the handshake
+	c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", RootCAs: ca.pool})
+	if err == nil {
+		defer c.Close()
+		_, err = io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+		if err == nil {
+			_, err = c.Read(make([]byte, 1))
+		}
+	}
+	assert.Error(t, err)
+}
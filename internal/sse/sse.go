@@ -0,0 +1,256 @@
+// Package sse streams Server-Sent Events (the text/event-stream format of
+// the HTML Living Standard) over a chunked response.
+package sse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+)
+
+// DefaultHeartbeat is how often Stream sends a comment to keep idle
+// connections open when Options.Heartbeat is 0.
+const DefaultHeartbeat = 15 * time.Second
+
+// ErrInvalidField is returned by Send for an ID or event name containing a
+// line break, which would corrupt the stream.
+var ErrInvalidField = errors.New("sse: line break in id or event field")
+
+// Event is one event. Data may span several lines; it is sent as one data
+// field per line. Retry, if set, tells the client how long to wait before
+// reconnecting.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// Replayer supplies the events a reconnecting client missed: those after
+// the one it reports in Last-Event-ID.
+type Replayer interface {
+	Since(lastEventID string) []Event
+}
+
+// Options configures the streams made by Start.
+type Options struct {
+	// Heartbeat is the interval of the comments sent to keep proxies and
+	// clients from timing out a quiet stream; DefaultHeartbeat if 0,
+	// negative to send none.
+	Heartbeat time.Duration
+	// Replay, if set, supplies the events sent first to clients that
+	// reconnect with Last-Event-ID.
+	Replay Replayer
+	// Retry, if set, is sent at the start of the stream as the client's
+	// reconnection delay.
+	Retry time.Duration
+}
+
+// Stream is an open event stream. Its methods are safe for concurrent use.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start sends the response headers for an event stream, followed by the
+// Retry field and any events to replay, and starts the heartbeat.
+func Start(w *response.Writer, req *request.Request, opts Options) (*Stream, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	if err := w.WriteStatusLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	s := &Stream{
+		w:           w,
+		lastEventID: req.Headers.Get("Last-Event-ID"),
+		ctx:         ctx,
+		cancel:      cancel,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if opts.Retry > 0 {
+		if err := s.write([]byte("retry: " + strconv.FormatInt(opts.Retry.Milliseconds(), 10) + "\n\n")); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	if s.lastEventID != "" && opts.Replay != nil {
+		for _, e := range opts.Replay.Since(s.lastEventID) {
+			if err := s.Send(e); err != nil {
+				cancel()
+				return nil, err
+			}
+		}
+	}
+
+	interval := opts.Heartbeat
+	if interval == 0 {
+		interval = DefaultHeartbeat
+	}
+	if interval < 0 {
+		close(s.done)
+		return s, nil
+	}
+	go s.heartbeat(interval)
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID the client reconnected with, or ""
+// for a first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the client disconnects, the request's context ends
+// or a write fails.
+func (s *Stream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Send writes e.
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ErrInvalidField
+	}
+	var b bytes.Buffer
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	data := strings.ReplaceAll(strings.ReplaceAll(e.Data, "\r\n", "\n"), "\r", "\n")
+	for line := range strings.SplitSeq(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.Bytes())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r", " "), "\n", " ")
+	return s.write([]byte(": " + text + "\n\n"))
+}
+
+// Close stops the heartbeat and ends the response.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.w.Close()
+}
+
+func (s *Stream) heartbeat(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.Comment("heartbeat")
+		}
+	}
+}
+
+func (s *Stream) write(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.closed {
+		return errors.New("sse: stream closed")
+	}
+	if _, err := s.w.WriteChunkedBody(p); err != nil {
+		s.err = err
+		s.cancel()
+		return err
+	}
+	return nil
+}
+
+// History is a Replayer keeping the most recent events in memory. It is
+// safe for concurrent use.
+type History struct {
+	mu     sync.Mutex
+	size   int
+	events []Event
+}
+
+// NewHistory returns a History holding up to size events.
+func NewHistory(size int) *History {
+	return &History{size: size}
+}
+
+// Add records e, dropping the oldest event if the history is full. Events
+// without an ID can't be asked for and are not recorded.
+func (h *History) Add(e Event) {
+	if e.ID == "" || h.size <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.events) == h.size {
+		h.events = append(h.events[:0], h.events[1:]...)
+	}
+	h.events = append(h.events, e)
+}
+
+// Since returns the events after the one with lastEventID. If that event is
+// no longer held, all held events are returned, since the client may have
+// missed any of them.
+func (h *History) Since(lastEventID string) []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.events) - 1; i >= 0; i-- {
+		if h.events[i].ID == lastEventID {
+			return append([]Event(nil), h.events[i+1:]...)
+		}
+	}
+	return append([]Event(nil), h.events...)
+}
@@ -0,0 +1,118 @@
+package sse
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(t *testing.T, extra string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("GET /events HTTP/1.1\r\nHost: example.com\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestSend(t *testing.T) {
+	rec, w := response.NewRecorder()
+	s, err := Start(w, newRequest(t, ""), Options{Heartbeat: -1, Retry: 3 * time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, "text/event-stream; charset=utf-8", rec.Headers.Get("Content-Type"))
+	assert.Equal(t, "no-cache", rec.Headers.Get("Cache-Control"))
+
+	require.NoError(t, s.Send(Event{ID: "1", Event: "update", Data: "a\nb\r\nc\rd"}))
+	require.NoError(t, s.Send(Event{Data: "", Retry: 500 * time.Millisecond}))
+	require.NoError(t, s.Comment("two\nlines"))
+	assert.ErrorIs(t, s.Send(Event{ID: "1\n2"}), ErrInvalidField)
+	assert.ErrorIs(t, s.Send(Event{Event: "a\rb"}), ErrInvalidField)
+	require.NoError(t, s.Close())
+	assert.True(t, rec.Finished)
+
+	assert.Equal(t, "retry: 3000\n\n"+
+		"id: 1\nevent: update\ndata: a\ndata: b\ndata: c\ndata: d\n\n"+
+		"retry: 500\ndata: \n\n"+
+		": two lines\n\n", rec.Body.String())
+	assert.Error(t, s.Send(Event{Data: "late"}))
+}
+
+func TestReplay(t *testing.T) {
+	h := NewHistory(3)
+	for _, id := range []string{"1", "", "2", "3", "4"} {
+		h.Add(Event{ID: id, Data: "e" + id})
+	}
+	ids := func(events []Event) []string {
+		var out []string
+		for _, e := range events {
+			out = append(out, e.ID)
+		}
+		return out
+	}
+	assert.Equal(t, []string{"3", "4"}, ids(h.Since("2")))
+	assert.Empty(t, h.Since("4"))
+	assert.Equal(t, []string{"2", "3", "4"}, ids(h.Since("1")), "evicted IDs replay everything held")
+
+	rec, w := response.NewRecorder()
+	s, err := Start(w, newRequest(t, "Last-Event-ID: 3\r\n"), Options{Heartbeat: -1, Replay: h})
+	require.NoError(t, err)
+	assert.Equal(t, "3", s.LastEventID())
+	require.NoError(t, s.Close())
+	assert.Equal(t, "id: 4\ndata: e4\n\n", rec.Body.String())
+
+	// Test: First connections get no replay
+	rec, w = response.NewRecorder()
+	s, err = Start(w, newRequest(t, ""), Options{Heartbeat: -1, Replay: h})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	assert.Empty(t, rec.Body.String())
+}
+
+func TestHeartbeatAndDisconnect(t *testing.T) {
+	done := make(chan struct{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &server.Server{Handler: func(w *response.Writer, req *request.Request) {
+		s, err := Start(w, req, Options{Heartbeat: 20 * time.Millisecond})
+		require.NoError(t, err)
+		s.Send(Event{Data: "hello"})
+		<-s.Done()
+		s.Close()
+		close(done)
+	}}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(c, "GET /events HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 5 {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{"data: hello\n", "\n", ": heartbeat\n", "\n", ": heartbeat\n"}, lines)
+
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not ended after the client disconnected")
+	}
+}
@@ -0,0 +1,529 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a data message.
+type MessageType int
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	maxControlPayload = 125
+	// closeTimeout bounds the wait for the peer's answer to a close frame.
+	closeTimeout = 5 * time.Second
+)
+
+// Close codes (RFC 6455 section 7.4.1).
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// deflateTail ends every compressed message; senders strip it and receivers
+// put it back (RFC 7692 section 7.2.1).
+const deflateTail = "\x00\x00\xff\xff"
+
+var (
+	// ErrClosed is returned for writes after a close frame was sent.
+	ErrClosed = errors.New("websocket: connection closed")
+	// ErrProtocol, ErrMessageTooBig and ErrInvalidUTF8 are returned by
+	// ReadMessage when the peer breaks the protocol. The connection is
+	// closed with the matching close code.
+	ErrProtocol      = errors.New("websocket: protocol error")
+	ErrMessageTooBig = errors.New("websocket: message too big")
+	ErrInvalidUTF8   = errors.New("websocket: invalid UTF-8")
+)
+
+// CloseError is returned by ReadMessage once the peer has closed the
+// connection. Code is CloseNoStatus if the peer gave none.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with code %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. One goroutine may read while others
+// write; writes are serialized.
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	server   bool
+	maxSize  int64
+	protocol string
+	compress bool
+	level    int
+	fragment int
+
+	readMu  sync.Mutex
+	readErr error
+	inflate io.ReadCloser
+
+	writeMu   sync.Mutex
+	closeSent bool
+	deflate   *flate.Writer
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// frame is a decoded frame, with its payload unmasked.
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  byte
+	payload []byte
+}
+
+// newConn wraps c, reading buffered first. Servers expect masked frames
+// and send unmasked ones; clients do the opposite.
+func newConn(c net.Conn, buffered []byte, server bool, maxSize int64) *Conn {
+	var r io.Reader = c
+	if len(buffered) > 0 {
+		r = io.MultiReader(bytes.NewReader(buffered), c)
+	}
+	return &Conn{
+		conn:    c,
+		br:      bufio.NewReader(r),
+		server:  server,
+		maxSize: maxSize,
+		done:    make(chan struct{}),
+	}
+}
+
+// Subprotocol returns the negotiated subprotocol, or "" if there is none.
+func (c *Conn) Subprotocol() string {
+	return c.protocol
+}
+
+// Compressed reports whether permessage-deflate was negotiated.
+func (c *Conn) Compressed() bool {
+	return c.compress
+}
+
+// NetConn returns the underlying connection, e.g. to set deadlines.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// ReadMessage returns the next data message, answering pings on the way.
+// Once the connection has ended it keeps returning the same error: a
+// *CloseError if the peer closed it.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.readMessage()
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	t, data, err := c.nextMessage()
+	if err != nil {
+		c.readErr = err
+		if code := closeCode(err); code != 0 {
+			c.writeClose(code, "")
+		}
+		c.closeConn()
+	}
+	return t, data, err
+}
+
+func (c *Conn) nextMessage() (MessageType, []byte, error) {
+	var t MessageType
+	var data []byte
+	var compressed, inMessage bool
+	for {
+		f, err := c.readFrame(int64(len(data)))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch f.opcode {
+		case opPing:
+			if err := c.writeControl(opPong, f.payload); err != nil && !errors.Is(err, ErrClosed) {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opText, opBinary:
+			if inMessage {
+				return 0, nil, fmt.Errorf("%w: new message before the previous one ended", ErrProtocol)
+			}
+			inMessage = true
+			t = MessageType(f.opcode)
+			compressed = f.rsv1
+		case opContinuation:
+			if !inMessage {
+				return 0, nil, fmt.Errorf("%w: continuation without a message", ErrProtocol)
+			}
+			if f.rsv1 {
+				return 0, nil, fmt.Errorf("%w: RSV1 set on a continuation frame", ErrProtocol)
+			}
+		}
+		data = append(data, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if compressed {
+			if data, err = c.inflateMessage(data); err != nil {
+				return 0, nil, err
+			}
+		}
+		if t == TextMessage && !utf8.Valid(data) {
+			return 0, nil, ErrInvalidUTF8
+		}
+		return t, data, nil
+	}
+}
+
+// readFrame reads the next frame. read is the size of the message read so
+// far, for enforcing the size limit before the payload is allocated.
+func (c *Conn) readFrame(read int64) (frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{
+		fin:    head[0]&0x80 != 0,
+		rsv1:   head[0]&0x40 != 0,
+		opcode: head[0] & 0x0f,
+	}
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	if head[0]&0x30 != 0 {
+		return frame{}, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	control := f.opcode >= opClose
+	switch f.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return frame{}, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, f.opcode)
+	}
+	if f.rsv1 && (!c.compress || control) {
+		return frame{}, fmt.Errorf("%w: RSV1 set without compression", ErrProtocol)
+	}
+	if control && (!f.fin || length > maxControlPayload) {
+		return frame{}, fmt.Errorf("%w: fragmented or oversized control frame", ErrProtocol)
+	}
+	if masked != c.server {
+		return frame{}, fmt.Errorf("%w: frame masking is wrong for its direction", ErrProtocol)
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return frame{}, fmt.Errorf("%w: invalid payload length", ErrProtocol)
+		}
+	}
+	if !control && length > uint64(c.maxSize-read) {
+		return frame{}, ErrMessageTooBig
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return frame{}, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return frame{}, err
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+// handleClose answers the peer's close frame and returns the error that
+// ends reading.
+func (c *Conn) handleClose(payload []byte) error {
+	ce := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return fmt.Errorf("%w: truncated close code", ErrProtocol)
+	case len(payload) >= 2:
+		ce.Code = int(binary.BigEndian.Uint16(payload))
+		ce.Reason = string(payload[2:])
+		if !validCloseCode(ce.Code) {
+			return fmt.Errorf("%w: invalid close code %d", ErrProtocol, ce.Code)
+		}
+		if !utf8.ValidString(ce.Reason) {
+			return ErrInvalidUTF8
+		}
+	}
+	// Echo the code; this does nothing if it answers our own close.
+	c.writeClose(ce.Code, "")
+	return ce
+}
+
+func (c *Conn) inflateMessage(p []byte) ([]byte, error) {
+	r := io.MultiReader(bytes.NewReader(p), strings.NewReader(deflateTail))
+	if c.inflate == nil {
+		c.inflate = flate.NewReader(r)
+	} else {
+		c.inflate.(flate.Resetter).Reset(r, nil)
+	}
+	// Without the final block the stream ends at the tail; ErrUnexpectedEOF
+	// is how flate reports that.
+	data, err := io.ReadAll(io.LimitReader(c.inflate, c.maxSize+1))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("%w: invalid compressed data: %v", ErrProtocol, err)
+	}
+	if int64(len(data)) > c.maxSize {
+		return nil, ErrMessageTooBig
+	}
+	return data, nil
+}
+
+// WriteMessage sends data as one message, split into frames if
+// Options.WriteFragmentSize asks for it.
+func (c *Conn) WriteMessage(t MessageType, data []byte) error {
+	if t != TextMessage && t != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", t)
+	}
+	if t == TextMessage && !utf8.Valid(data) {
+		return ErrInvalidUTF8
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	payload := data
+	if c.compress {
+		var err error
+		if payload, err = c.deflateMessage(data); err != nil {
+			return err
+		}
+	}
+
+	op := byte(t)
+	for first := true; ; first = false {
+		n := len(payload)
+		if c.fragment > 0 && n > c.fragment {
+			n = c.fragment
+		}
+		fin := n == len(payload)
+		if err := c.writeFrame(fin, c.compress && first, op, payload[:n]); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		payload = payload[n:]
+		op = opContinuation
+	}
+}
+
+func (c *Conn) deflateMessage(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if c.deflate == nil {
+		fw, err := flate.NewWriter(&buf, c.level)
+		if err != nil {
+			return nil, err
+		}
+		c.deflate = fw
+	} else {
+		c.deflate.Reset(&buf)
+	}
+	if _, err := c.deflate.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.deflate.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte(deflateTail)), nil
+}
+
+// Ping sends a ping; the peer answers with a pong, which ReadMessage
+// consumes.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(opPing, data)
+}
+
+// Close starts the closing handshake with code and reason, waits for the
+// peer's close frame for up to five seconds and closes the connection. If
+// another goroutine is in ReadMessage, that call receives the peer's
+// answer.
+func (c *Conn) Close(code int, reason string) error {
+	err := c.writeClose(code, reason)
+	if c.readMu.TryLock() {
+		if c.readErr == nil {
+			c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+			for c.readErr == nil {
+				c.readMessage()
+			}
+		}
+		c.readMu.Unlock()
+	} else {
+		select {
+		case <-c.done:
+		case <-time.After(closeTimeout):
+		}
+	}
+	c.closeConn()
+	if errors.Is(err, ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// writeClose sends a close frame unless one was sent already.
+func (c *Conn) writeClose(code int, reason string) error {
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	if len(payload) > maxControlPayload {
+		return fmt.Errorf("websocket: close reason too long")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	c.closeSent = true
+	return c.writeFrame(true, false, opClose, payload)
+}
+
+func (c *Conn) writeControl(op byte, payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return fmt.Errorf("websocket: control payload too long")
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return c.writeFrame(true, false, op, payload)
+}
+
+// writeFrame must be called with writeMu held.
+func (c *Conn) writeFrame(fin, rsv1 bool, op byte, payload []byte) error {
+	b := make([]byte, 0, 14+len(payload))
+	first := op
+	if fin {
+		first |= 0x80
+	}
+	if rsv1 {
+		first |= 0x40
+	}
+	b = append(b, first)
+
+	var maskBit byte
+	if !c.server {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+
+	if c.server {
+		b = append(b, payload...)
+	} else {
+		var key [4]byte
+		rand.Read(key[:])
+		b = append(b, key[:]...)
+		start := len(b)
+		b = append(b, payload...)
+		maskBytes(key, b[start:])
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *Conn) closeConn() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// closeCode is the code to close with after a read error, or 0 if the
+// connection is beyond sending one.
+func closeCode(err error) int {
+	switch {
+	case errors.Is(err, ErrProtocol):
+		return CloseProtocolError
+	case errors.Is(err, ErrMessageTooBig):
+		return CloseMessageTooBig
+	case errors.Is(err, ErrInvalidUTF8):
+		return CloseInvalidPayload
+	}
+	return 0
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
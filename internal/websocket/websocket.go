@@ -0,0 +1,218 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455), including the permessage-deflate extension (RFC 7692).
+package websocket
+
+import (
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nhdewitt/http-from-tcp/internal/headers"
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+)
+
+// DefaultMaxMessageSize bounds received messages when Options.MaxMessageSize
+// is 0.
+const DefaultMaxMessageSize = 1 << 20
+
+const (
+	acceptGUID    = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	deflateName   = "permessage-deflate"
+	deflateAccept = deflateName + "; server_no_context_takeover; client_no_context_takeover"
+)
+
+// ErrBadHandshake is returned by Accept for requests that are not valid
+// WebSocket upgrades. Accept has answered them already.
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// Options configures the connections made by Accept.
+type Options struct {
+	// Subprotocols lists the subprotocols the server speaks. The first one
+	// the client offers is selected.
+	Subprotocols []string
+	// CheckOrigin decides whether to accept a request given its Origin
+	// header. nil accepts requests without Origin and those whose Origin
+	// has the same host as the request, which keeps other sites' pages
+	// from connecting with the user's cookies.
+	CheckOrigin func(req *request.Request) bool
+	// MaxMessageSize bounds received messages, after decompression;
+	// DefaultMaxMessageSize if 0. Larger messages close the connection
+	// with CloseMessageTooBig.
+	MaxMessageSize int64
+	// WriteFragmentSize, if set, splits sent messages into frames carrying
+	// at most this many payload bytes.
+	WriteFragmentSize int
+	// EnableCompression negotiates permessage-deflate with clients that
+	// offer it. Compression uses no context takeover in either direction,
+	// so each message is compressed on its own. CompressionLevel is a
+	// compress/flate level; 0 means flate.DefaultCompression.
+	EnableCompression bool
+	CompressionLevel  int
+}
+
+// Accept completes the opening handshake for req and takes over the
+// connection. If req is not a valid upgrade it answers with a 4xx status
+// and returns an error wrapping ErrBadHandshake.
+func Accept(w *response.Writer, req *request.Request, opts Options) (*Conn, error) {
+	if req.RequestLine.Method != "GET" {
+		h := response.GetDefaultHeaders(0)
+		h.SetNew("Allow", "GET")
+		response.WriteError(w, response.StatusMethodNotAllowed, h)
+		return nil, fmt.Errorf("%w: method %s", ErrBadHandshake, req.RequestLine.Method)
+	}
+	if !hasToken(req.Headers.Get("Connection"), "upgrade") || !hasToken(req.Headers.Get("Upgrade"), "websocket") {
+		h := response.GetDefaultHeaders(0)
+		h.SetNew("Upgrade", "websocket")
+		response.WriteError(w, response.StatusUpgradeRequired, h)
+		return nil, fmt.Errorf("%w: not an upgrade request", ErrBadHandshake)
+	}
+	if v := req.Headers.Get("Sec-WebSocket-Version"); v != "13" {
+		h := response.GetDefaultHeaders(0)
+		h.SetNew("Sec-WebSocket-Version", "13")
+		response.WriteError(w, response.StatusUpgradeRequired, h)
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrBadHandshake, v)
+	}
+	key := req.Headers.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		response.WriteError(w, response.StatusBadRequest, nil)
+		return nil, fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrBadHandshake)
+	}
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		response.WriteError(w, response.StatusForbidden, nil)
+		return nil, fmt.Errorf("%w: origin %q not allowed", ErrBadHandshake, req.Headers.Get("Origin"))
+	}
+	level := opts.CompressionLevel
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		response.WriteError(w, response.StatusInternalServerError, nil)
+		return nil, fmt.Errorf("websocket: invalid compression level %d", level)
+	}
+
+	protocol := selectSubprotocol(req.Headers.Get("Sec-WebSocket-Protocol"), opts.Subprotocols)
+	compress := opts.EnableCompression && acceptDeflate(req.Headers.Get("Sec-WebSocket-Extensions"))
+
+	c, buffered, err := w.Hijack()
+	if err != nil {
+		response.WriteError(w, response.StatusInternalServerError, nil)
+		return nil, err
+	}
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	if protocol != "" {
+		h.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	if compress {
+		h.Set("Sec-WebSocket-Extensions", deflateAccept)
+	}
+	hw := response.NewWriter(c)
+	if err := hw.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := hw.WriteHeaders(h); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	maxSize := opts.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	conn := newConn(c, buffered, true, maxSize)
+	conn.protocol = protocol
+	conn.compress = compress
+	conn.level = level
+	conn.fragment = opts.WriteFragmentSize
+	return conn, nil
+}
+
+// acceptKey computes Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Headers.Get("Host"))
+}
+
+func selectSubprotocol(offered string, supported []string) string {
+	for p := range strings.SplitSeq(offered, ",") {
+		p = strings.TrimSpace(p)
+		for _, s := range supported {
+			if p == s {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// acceptDeflate reports whether one of the permessage-deflate offers in a
+// Sec-WebSocket-Extensions value can be accepted. The response always asks
+// for no context takeover both ways, which offers can't rule out, but a
+// server window smaller than compress/flate's can't be honoured.
+func acceptDeflate(extensions string) bool {
+	for offer := range strings.SplitSeq(extensions, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != deflateName {
+			continue
+		}
+		ok := true
+		seen := map[string]bool{}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			if seen[name] {
+				ok = false
+				break
+			}
+			seen[name] = true
+			switch name {
+			case "server_no_context_takeover", "client_no_context_takeover":
+			case "client_max_window_bits":
+				// Inflating handles any window size.
+			case "server_max_window_bits":
+				ok = value == "15"
+			default:
+				ok = false
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasToken reports whether the comma-separated header value v contains
+// token, ignoring case.
+func hasToken(v, token string) bool {
+	for t := range strings.SplitSeq(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhdewitt/http-from-tcp/internal/request"
+	"github.com/nhdewitt/http-from-tcp/internal/response"
+	"github.com/nhdewitt/http-from-tcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// startServer serves h and returns the server's address.
+func startServer(t *testing.T, h server.Handler) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &server.Server{Handler: h}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// startEcho serves WebSocket connections that echo every message, sending
+// what ended each connection to errs.
+func startEcho(t *testing.T, opts Options) (string, chan error) {
+	t.Helper()
+	errs := make(chan error, 1)
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		c, err := Accept(w, req, opts)
+		if err != nil {
+			errs <- err
+			return
+		}
+		for {
+			mt, data, err := c.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := c.WriteMessage(mt, data); err != nil {
+				errs <- err
+				return
+			}
+		}
+	})
+	return addr, errs
+}
+
+// dial opens a client connection to addr with the extra request header
+// lines.
+func dial(t *testing.T, addr string, extra ...string) (*Conn, *http.Response) {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { nc.Close() })
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	raw := "GET /ws HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + testKey + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n"
+	for _, h := range extra {
+		raw += h + "\r\n"
+	}
+	_, err = io.WriteString(nc, raw+"\r\n")
+	require.NoError(t, err)
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	buffered, _ := br.Peek(br.Buffered())
+	c := newConn(nc, buffered, false, DefaultMaxMessageSize)
+	c.compress = strings.HasPrefix(resp.Header.Get("Sec-WebSocket-Extensions"), deflateName)
+	c.level = -1
+	return c, resp
+}
+
+func TestAcceptRejects(t *testing.T) {
+	handshake := "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+	cases := []struct {
+		name   string
+		raw    string
+		status int
+		header string
+		value  string
+	}{
+		{"method", "POST /ws HTTP/1.1\r\nHost: example.com\r\n", 405, "Allow", "GET"},
+		{"no upgrade", "GET /ws HTTP/1.1\r\nHost: example.com\r\n", 426, "Upgrade", "websocket"},
+		{"version", handshake + "Sec-WebSocket-Version: 8\r\nSec-WebSocket-Key: " + testKey + "\r\n", 426, "Sec-WebSocket-Version", "13"},
+		{"key", handshake + "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: c2hvcnQ=\r\n", 400, "", ""},
+		{"origin", handshake + "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\nOrigin: https://evil.example\r\n", 403, "", ""},
+	}
+	for _, c := range cases {
+		req, err := request.RequestFromReader(strings.NewReader(c.raw + "\r\n"))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		w := response.NewWriter(&buf)
+		_, err = Accept(w, req, Options{})
+		assert.ErrorIs(t, err, ErrBadHandshake, c.name)
+
+		resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+		require.NoError(t, err, c.name)
+		assert.Equal(t, c.status, resp.StatusCode, c.name)
+		if c.header != "" {
+			assert.Equal(t, c.value, resp.Header.Get(c.header), c.name)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	addr, _ := startEcho(t, Options{Subprotocols: []string{"chat", "superchat"}})
+
+	_, resp := dial(t, addr, "Sec-WebSocket-Protocol: v2.chat, superchat, chat", "Origin: http://"+addr)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", resp.Header.Get("Connection"))
+	// The example from RFC 6455 section 1.3.
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "superchat", resp.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"), "compression is off")
+
+	_, resp = dial(t, addr, "Sec-WebSocket-Protocol: mqtt")
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Protocol"))
+}
+
+func TestMessages(t *testing.T) {
+	addr, _ := startEcho(t, Options{WriteFragmentSize: 4})
+	c, _ := dial(t, addr)
+
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("héllo")))
+	mt, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, mt)
+	assert.Equal(t, "héllo", string(data))
+
+	big := bytes.Repeat([]byte{0, 1, 2, 3}, 20000)
+	require.NoError(t, c.WriteMessage(BinaryMessage, big))
+	mt, data, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, mt)
+	assert.Equal(t, big, data)
+
+	// Test: The server fragments its messages and answers pings between
+	// fragments of ours
+	require.NoError(t, c.writeFrame(false, false, opText, []byte("ab")))
+	require.NoError(t, c.Ping([]byte("p")))
+	require.NoError(t, c.writeFrame(true, false, opContinuation, []byte("cdef")))
+	f, err := c.readFrame(0)
+	require.NoError(t, err)
+	assert.Equal(t, frame{fin: true, opcode: opPong, payload: []byte("p")}, f)
+	f, err = c.readFrame(0)
+	require.NoError(t, err)
+	assert.Equal(t, frame{fin: false, opcode: opText, payload: []byte("abcd")}, f)
+	f, err = c.readFrame(0)
+	require.NoError(t, err)
+	assert.Equal(t, frame{fin: true, opcode: opContinuation, payload: []byte("ef")}, f)
+}
+
+func TestCompression(t *testing.T) {
+	addr, _ := startEcho(t, Options{EnableCompression: true})
+
+	// Test: Offers asking for a small server window are declined
+	_, resp := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10, x-webkit-deflate-frame")
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"))
+
+	c, resp := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10, permessage-deflate; client_max_window_bits")
+	assert.Equal(t, deflateAccept, resp.Header.Get("Sec-WebSocket-Extensions"))
+	require.True(t, c.Compressed())
+
+	msg := strings.Repeat("all work and no play ", 500)
+	require.NoError(t, c.WriteMessage(TextMessage, []byte(msg)))
+	f, err := c.readFrame(0)
+	require.NoError(t, err)
+	assert.True(t, f.rsv1)
+	assert.Less(t, len(f.payload), len(msg)/10)
+	data, err := c.inflateMessage(f.payload)
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(data))
+
+	for _, m := range []string{"", "x", msg} {
+		require.NoError(t, c.WriteMessage(TextMessage, []byte(m)))
+		_, data, err := c.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, m, string(data))
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		send func(c *Conn) error
+		code int
+		want error
+	}{
+		{"too big", func(c *Conn) error {
+			return c.WriteMessage(BinaryMessage, make([]byte, 11))
+		}, CloseMessageTooBig, ErrMessageTooBig},
+		{"too big in fragments", func(c *Conn) error {
+			c.writeFrame(false, false, opBinary, make([]byte, 6))
+			return c.writeFrame(true, false, opContinuation, make([]byte, 6))
+		}, CloseMessageTooBig, ErrMessageTooBig},
+		{"invalid UTF-8", func(c *Conn) error {
+			return c.writeFrame(true, false, opText, []byte{0xff, 0xfe})
+		}, CloseInvalidPayload, ErrInvalidUTF8},
+		{"unmasked", func(c *Conn) error {
+			c.server = true
+			return c.writeFrame(true, false, opText, []byte("hi"))
+		}, CloseProtocolError, ErrProtocol},
+		{"stray continuation", func(c *Conn) error {
+			return c.writeFrame(true, false, opContinuation, []byte("hi"))
+		}, CloseProtocolError, ErrProtocol},
+		{"fragmented ping", func(c *Conn) error {
+			return c.writeFrame(false, false, opPing, nil)
+		}, CloseProtocolError, ErrProtocol},
+		{"compressed without negotiation", func(c *Conn) error {
+			return c.writeFrame(true, true, opText, []byte("hi"))
+		}, CloseProtocolError, ErrProtocol},
+		{"bad close code", func(c *Conn) error {
+			return c.writeFrame(true, false, opClose, []byte{0x03, 0xe8 + 4})
+		}, CloseProtocolError, ErrProtocol},
+	}
+	for _, tc := range cases {
+		addr, errs := startEcho(t, Options{MaxMessageSize: 10})
+		c, _ := dial(t, addr)
+		require.NoError(t, tc.send(c), tc.name)
+		c.server = false
+
+		_, _, err := c.ReadMessage()
+		var ce *CloseError
+		require.True(t, errors.As(err, &ce), "%s: %v", tc.name, err)
+		assert.Equal(t, tc.code, ce.Code, tc.name)
+		assert.ErrorIs(t, <-errs, tc.want, tc.name)
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	addr, errs := startEcho(t, Options{})
+
+	// Test: Client closes; the server echoes and ends the connection
+	c, _ := dial(t, addr)
+	require.NoError(t, c.Close(CloseGoingAway, "bye"))
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Reason: "bye"}, <-errs)
+	assert.ErrorIs(t, c.WriteMessage(TextMessage, []byte("late")), ErrClosed)
+	_, _, err := c.ReadMessage()
+	assert.Equal(t, &CloseError{Code: CloseGoingAway}, err, "the echoed close")
+
+	// Test: Server closes while the client is reading
+	closed := make(chan error, 1)
+	addr = startServer(t, func(w *response.Writer, req *request.Request) {
+		c, err := Accept(w, req, Options{})
+		require.NoError(t, err)
+		closed <- c.Close(CloseNormal, "done")
+	})
+	c, _ = dial(t, addr)
+	_, _, err = c.ReadMessage()
+	assert.Equal(t, &CloseError{Code: CloseNormal, Reason: "done"}, err)
+	assert.NoError(t, <-closed)
+}